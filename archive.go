@@ -1,15 +1,35 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
-	_ "github.com/mattn/go-sqlite3"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"github.com/mattn/go-sqlite3"
+	"os"
+	"strings"
+	"time"
 )
 
+// readOnlyDriver is the name of the database driver that opens an
+// in-memory copy of an archive, see readOnlyCopyDriver
+const readOnlyDriver = "sqlite3-read-only-copy"
+
+func init() {
+	sql.Register(readOnlyDriver, &readOnlyCopyDriver{})
+}
+
+// chunkedArchiveId is recorded as the amazon id of content that is
+// stored as chunks, which are listed in the chunk manifest of the content
+const chunkedArchiveId = "chunked"
+
 /**
  * archive represents a sql.DB
  */
 type archive struct {
 	conn *sql.DB
+	path string
 }
 
 /**
@@ -23,13 +43,66 @@ func NewArchive(path string) (*archive, error) {
 	if err != nil {
 		return nil, err
 	}
-	archive := &archive{conn: conn}
+	// sqlite only allows a single writer at a time, and every new
+	// connection to ":memory:" opens a fresh database, so all
+	// goroutines share one connection.
+	conn.SetMaxOpenConns(1)
+	archive := &archive{conn: conn, path: path}
+	if err := archive.ensureTables(); err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+/**
+ * NewReadOnlyArchive opens an existing archive without ever writing
+ * to it. The archive is copied into memory, so archives created by
+ * older versions are upgraded without touching the file.
+ * Fails if the archive doesn't exist.
+ */
+func NewReadOnlyArchive(path string) (*archive, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	conn, err := sql.Open(readOnlyDriver, path)
+	if err != nil {
+		return nil, err
+	}
+	// the copy lives as long as its connection
+	conn.SetMaxOpenConns(1)
+	archive := &archive{conn: conn, path: path}
 	if err := archive.ensureTables(); err != nil {
+		conn.Close()
 		return nil, err
 	}
 	return archive, nil
 }
 
+/**
+ * readOnlyCopyDriver opens the database at the given path read-only
+ * and returns a connection to an in-memory copy of it
+ */
+type readOnlyCopyDriver struct{}
+
+func (d *readOnlyCopyDriver) Open(path string) (driver.Conn, error) {
+	sqlite := &sqlite3.SQLiteDriver{}
+	src, err := sqlite.Open("file:" + path + "?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	dst, err := sqlite.Open(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	if err := backupDatabase(dst.(*sqlite3.SQLiteConn), src.(*sqlite3.SQLiteConn)); err != nil {
+		dst.Close()
+		return nil, err
+	}
+	return dst, nil
+}
+
 /**
  * ensureTables creates the required tables in the
  * database in case they don't yet exist
@@ -38,6 +111,18 @@ func (a *archive) ensureTables() error {
 	queries := [...]string{
 		"CREATE TABLE IF NOT EXISTS file (hash text, filename text, is_deleted boolean, PRIMARY KEY(hash, filename))",
 		"CREATE TABLE IF NOT EXISTS upload (hash text, amazon_id text, PRIMARY KEY(hash, amazon_id))",
+		"CREATE TABLE IF NOT EXISTS multipart (upload_id text, vault text, filename text, hash text, part_size integer, size integer, PRIMARY KEY(upload_id))",
+		"CREATE TABLE IF NOT EXISTS multipart_part (upload_id text, start integer, tree_hash text, PRIMARY KEY(upload_id, start))",
+		"CREATE TABLE IF NOT EXISTS restore_job (id integer PRIMARY KEY AUTOINCREMENT, job_id text, amazon_id text, hash text, status text, bytes_downloaded integer)",
+		"CREATE TABLE IF NOT EXISTS snapshot (amazon_id text, created datetime, PRIMARY KEY(amazon_id))",
+		"CREATE TABLE IF NOT EXISTS restore_target (restore_job_id integer, target text, PRIMARY KEY(restore_job_id, target))",
+		"CREATE TABLE IF NOT EXISTS run (id integer PRIMARY KEY AUTOINCREMENT, started datetime, finished datetime)",
+		"CREATE TABLE IF NOT EXISTS file_version (filename text, hash text, first_run integer, last_run integer, size integer, PRIMARY KEY(filename, first_run))",
+		"CREATE INDEX IF NOT EXISTS file_version_runs ON file_version (first_run, last_run)",
+		"CREATE TABLE IF NOT EXISTS file_stat (filename text, hash text, size integer, mtime integer, inode integer, device integer, PRIMARY KEY(filename))",
+		"CREATE TABLE IF NOT EXISTS setting (name text, value text, PRIMARY KEY(name))",
+		"CREATE TABLE IF NOT EXISTS chunk (hash text, position integer, chunk_hash text, length integer, PRIMARY KEY(hash, position))",
+		"CREATE TABLE IF NOT EXISTS bundle_member (hash text, amazon_id text, start integer, length integer, tree_hash text, PRIMARY KEY(hash, amazon_id))",
 	}
 
 	for _, query := range queries {
@@ -47,7 +132,81 @@ func (a *archive) ensureTables() error {
 		}
 	}
 
-	return nil
+	columns := [...]struct{ table, column, definition string }{
+		{"upload", "tree_hash", "text"},
+		{"upload", "size", "integer"},
+		{"upload", "uploaded", "datetime"},
+		{"upload", "key_id", "text"},
+		{"upload", "nonce_scheme", "text"},
+		{"upload", "encryption_version", "integer"},
+		{"upload", "codec", "text"},
+	}
+
+	for _, c := range columns {
+		if err := a.ensureColumn(c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+
+	return a.ensureHistory()
+}
+
+/**
+ * ensureHistory records the current files of archives created by
+ * older versions, which have no history yet, as the first run
+ */
+func (a *archive) ensureHistory() error {
+	var runs, files int
+	if err := a.conn.QueryRow("SELECT COUNT(*) FROM run").Scan(&runs); err != nil {
+		return err
+	}
+	if err := a.conn.QueryRow("SELECT COUNT(*) FROM file WHERE is_deleted=0").Scan(&files); err != nil {
+		return err
+	}
+	if runs > 0 || files == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	result, err := a.conn.Exec("INSERT INTO run(started, finished) VALUES (?, ?)", now, now)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	_, err = a.conn.Exec("INSERT INTO file_version(filename, hash, first_run, last_run) SELECT filename, hash, ?, ? FROM file WHERE is_deleted=0", id, id)
+	return err
+}
+
+/**
+ * ensureColumn adds a column to a table in case it doesn't
+ * yet exist, i.e. in archives created by older versions
+ */
+func (a *archive) ensureColumn(table, column, definition string) error {
+	rows, err := a.conn.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var cid, notNull, pk int
+	var name, columnType string
+	var defaultValue interface{}
+	for rows.Next() {
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	rows.Close()
+
+	_, err = a.conn.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
 }
 
 /**
@@ -59,10 +218,25 @@ func (a *archive) Connection() *sql.DB {
 }
 
 /**
- * AddFile adds a file to the archive
+ * AddFile adds a file to the archive.
+ * Any other content previously recorded for the same filename
+ * is marked as deleted, since a file can only have one current
+ * version. Adding a file that is already in the archive
+ * (or was deleted from it) makes it current again.
  */
 func (a *archive) AddFile(file *ArchivedFile) error {
-	stmt, err := a.conn.Prepare("INSERT INTO file(hash, filename, is_deleted) VALUES (?, ?, ?)")
+	stmt, err := a.conn.Prepare("UPDATE file SET is_deleted=1 WHERE filename=? AND hash<>?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(file.Filename(), file.Hash())
+	if err != nil {
+		return err
+	}
+
+	stmt, err = a.conn.Prepare("INSERT OR REPLACE INTO file(hash, filename, is_deleted) VALUES (?, ?, ?)")
 	if err != nil {
 		return err
 	}
@@ -77,6 +251,8 @@ func (a *archive) AddFile(file *ArchivedFile) error {
 	if err != nil {
 		return err
 	}
+	defer stmt.Close()
+
 	_, err = stmt.Exec(file.Hash(), file.AmazonId())
 	if err != nil {
 		return err
@@ -85,8 +261,30 @@ func (a *archive) AddFile(file *ArchivedFile) error {
 	return nil
 }
 
-func (a *archive) ListFiles() ([]*ArchivedFile, error) {
-	stmt, err := a.conn.Prepare("SELECT f.hash, f.filename, f.is_deleted, u.amazon_id FROM file AS f INNER JOIN upload AS u ON f.hash=u.hash WHERE f.is_deleted=0")
+/**
+ * AddUpload records that content with a given hash
+ * is stored in a Glacier archive
+ */
+func (a *archive) AddUpload(upload *UploadRecord) error {
+	stmt, err := a.conn.Prepare("INSERT OR REPLACE INTO upload(hash, amazon_id, tree_hash, size, uploaded, key_id, nonce_scheme, encryption_version, codec) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(upload.Hash(), upload.AmazonId(), upload.TreeHash(), upload.Size(), upload.Uploaded(), upload.KeyId(), upload.NonceScheme(), upload.EncryptionVersion(), upload.Codec())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * ListUploads returns all archives known to be stored in Glacier
+ */
+func (a *archive) ListUploads() ([]*UploadRecord, error) {
+	stmt, err := a.conn.Prepare("SELECT " + uploadColumns + " FROM upload")
 	if err != nil {
 		return nil, err
 	}
@@ -96,82 +294,1062 @@ func (a *archive) ListFiles() ([]*ArchivedFile, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	var files []*ArchivedFile
-	var hash, filename, amazonId string
-	var isDeleted bool
+	var uploads []*UploadRecord
 	for rows.Next() {
-		rows.Scan(&hash, &filename, &isDeleted, &amazonId)
-		files = append(files, &ArchivedFile{
-			filename:  filename,
-			hash:      hash,
-			amazonId:  amazonId,
-			isDeleted: isDeleted,
-		})
+		upload, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
 	}
 
-	return files, nil
+	return uploads, nil
 }
 
 /**
- * FindFileByFilename returns an ArchivedFile given a filename
+ * FindUpload returns the upload of the content with the given hash
+ * in the archive with the given amazon id. If there is no such
+ * upload the function returns an error
  */
-func (a *archive) FindFileByFilename(filename string) (*ArchivedFile, error) {
-	stmt, err := a.conn.Prepare("SELECT f.hash, f.filename, f.is_deleted, u.amazon_id FROM file AS f INNER JOIN upload AS u ON f.hash=u.hash WHERE f.filename=? AND f.is_deleted=0")
+func (a *archive) FindUpload(hash, amazonId string) (*UploadRecord, error) {
+	stmt, err := a.conn.Prepare("SELECT " + uploadColumns + " FROM upload WHERE hash=? AND amazon_id=?")
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
-	var hash, fname, amazonId string
-	var isDeleted bool
-	err = stmt.QueryRow(filename).Scan(&hash, &fname, &isDeleted, &amazonId)
+	return scanUpload(stmt.QueryRow(hash, amazonId))
+}
+
+// uploadColumns are the columns scanUpload expects
+const uploadColumns = "hash, amazon_id, COALESCE(tree_hash, ''), COALESCE(size, 0), uploaded, COALESCE(key_id, ''), COALESCE(nonce_scheme, ''), COALESCE(encryption_version, 0), COALESCE(codec, '')"
+
+/**
+ * scanUpload reads an upload selected with uploadColumns
+ */
+func scanUpload(row interface {
+	Scan(dest ...interface{}) error
+}) (*UploadRecord, error) {
+	upload := &UploadRecord{}
+	var uploaded *time.Time
+	err := row.Scan(&upload.hash, &upload.amazonId, &upload.treeHash, &upload.size, &uploaded, &upload.keyId, &upload.nonceScheme, &upload.encryptionVersion, &upload.codec)
 	if err != nil {
 		return nil, err
 	}
+	if uploaded != nil {
+		upload.uploaded = *uploaded
+	}
+	return upload, nil
+}
 
-	return &ArchivedFile{
-		filename:  fname,
-		hash:      hash,
-		amazonId:  amazonId,
-		isDeleted: isDeleted,
-	}, nil
+/**
+ * DeleteUpload forgets about an archive, so content only
+ * stored in that archive is uploaded again by the next backup.
+ * This includes content stored as chunks of which a chunk
+ * was only stored in that archive.
+ */
+func (a *archive) DeleteUpload(amazonId string) error {
+	for _, table := range []string{"upload", "bundle_member"} {
+		stmt, err := a.conn.Prepare("DELETE FROM " + table + " WHERE amazon_id=?")
+		if err != nil {
+			return err
+		}
+
+		_, err = stmt.Exec(amazonId)
+		stmt.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	stmt, err := a.conn.Prepare("DELETE FROM upload WHERE amazon_id=? AND hash IN (SELECT c.hash FROM chunk AS c WHERE NOT EXISTS (SELECT 1 FROM upload AS u WHERE u.hash=c.chunk_hash AND u.amazon_id<>?))")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(chunkedArchiveId, chunkedArchiveId)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
 /**
- * FindAmazonIdByHash returns the amazon id of a given hash
- * If there is no such file known the function returns an error
+ * AddChunks records the chunk manifest of content stored as
+ * chunks, replacing any manifest previously recorded for it
+ * @param chunks []*Chunk The chunks in the order they make up the content
  */
-func (a *archive) FindAmazonIdByHash(hash string) (*string, error) {
-	stmt, err := a.conn.Prepare("SELECT amazon_id FROM upload WHERE hash=?")
+func (a *archive) AddChunks(hash string, chunks []*Chunk) error {
+	stmt, err := a.conn.Prepare("DELETE FROM chunk WHERE hash=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(hash)
+	if err != nil {
+		return err
+	}
+
+	stmt, err = a.conn.Prepare("INSERT INTO chunk(hash, position, chunk_hash, length) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for position, chunk := range chunks {
+		if _, err := stmt.Exec(hash, position, chunk.Hash(), chunk.Length()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+ * ListChunks returns the chunk manifest of the content with the given
+ * hash. Returns no chunks if the content isn't stored as chunks.
+ */
+func (a *archive) ListChunks(hash string) ([]*Chunk, error) {
+	stmt, err := a.conn.Prepare("SELECT chunk_hash, length FROM chunk WHERE hash=? ORDER BY position")
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
-	var amazonId string
-	err = stmt.QueryRow(hash).Scan(&amazonId)
+	rows, err := stmt.Query(hash)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return &amazonId, nil
+	var chunks []*Chunk
+	for rows.Next() {
+		chunk := &Chunk{}
+		if err := rows.Scan(&chunk.hash, &chunk.length); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, nil
 }
 
 /**
- * DeleteFile marks a file as deleted
+ * FindChunkAmazonId returns the amazon id of an archive the content
+ * with the given hash is stored in, not taking content stored as
+ * chunks into account. If there is no such archive the function
+ * returns sql.ErrNoRows
  */
-func (a *archive) DeleteFile(hash, filename string) error {
-	stmt, err := a.conn.Prepare("UPDATE file SET is_deleted=1 WHERE hash=? AND filename=?")
+func (a *archive) FindChunkAmazonId(hash string) (string, error) {
+	stmt, err := a.conn.Prepare("SELECT amazon_id FROM upload WHERE hash=? AND amazon_id<>? LIMIT 1")
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+
+	var amazonId string
+	err = stmt.QueryRow(hash, chunkedArchiveId).Scan(&amazonId)
+	return amazonId, err
+}
+
+/**
+ * AddBundleMember records where the content with a given
+ * hash is stored within a bundle archive
+ */
+func (a *archive) AddBundleMember(member *BundleMember) error {
+	stmt, err := a.conn.Prepare("INSERT OR REPLACE INTO bundle_member(hash, amazon_id, start, length, tree_hash) VALUES (?, ?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(hash, filename)
+	_, err = stmt.Exec(member.Hash(), member.AmazonId(), member.Offset(), member.Length(), member.TreeHash())
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+/**
+ * FindBundleMember returns where the content with the given hash is
+ * stored within the archive with the given amazon id. If the content
+ * is not part of a bundle the function returns sql.ErrNoRows
+ */
+func (a *archive) FindBundleMember(hash, amazonId string) (*BundleMember, error) {
+	stmt, err := a.conn.Prepare("SELECT hash, amazon_id, start, length, tree_hash FROM bundle_member WHERE hash=? AND amazon_id=?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	member := &BundleMember{}
+	err = stmt.QueryRow(hash, amazonId).Scan(&member.hash, &member.amazonId, &member.offset, &member.length, &member.treeHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return member, nil
+}
+
+func (a *archive) ListFiles() ([]*ArchivedFile, error) {
+	stmt, err := a.conn.Prepare("SELECT f.hash, f.filename, f.is_deleted, MIN(u.amazon_id) FROM file AS f INNER JOIN upload AS u ON f.hash=u.hash WHERE f.is_deleted=0 GROUP BY f.hash, f.filename")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []*ArchivedFile
+	var hash, filename, amazonId string
+	var isDeleted bool
+	for rows.Next() {
+		rows.Scan(&hash, &filename, &isDeleted, &amazonId)
+		files = append(files, &ArchivedFile{
+			filename:  filename,
+			hash:      hash,
+			amazonId:  amazonId,
+			isDeleted: isDeleted,
+		})
+	}
+
+	return files, nil
+}
+
+/**
+ * ListAllFiles returns all files, including deleted ones
+ * and files without upload, ordered by filename
+ */
+func (a *archive) ListAllFiles() ([]*ArchivedFile, error) {
+	stmt, err := a.conn.Prepare("SELECT hash, filename, is_deleted FROM file ORDER BY filename")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []*ArchivedFile
+	for rows.Next() {
+		file := &ArchivedFile{}
+		if err := rows.Scan(&file.hash, &file.filename, &file.isDeleted); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+/**
+ * ListFilesWithoutUpload returns all files that are not deleted
+ * but whose content is not known to be stored in Glacier
+ */
+func (a *archive) ListFilesWithoutUpload() ([]*ArchivedFile, error) {
+	stmt, err := a.conn.Prepare("SELECT f.hash, f.filename, f.is_deleted FROM file AS f LEFT JOIN upload AS u ON f.hash=u.hash WHERE f.is_deleted=0 AND u.hash IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []*ArchivedFile
+	for rows.Next() {
+		file := &ArchivedFile{}
+		if err := rows.Scan(&file.hash, &file.filename, &file.isDeleted); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+/**
+ * FindFileByFilename returns an ArchivedFile given a filename
+ */
+func (a *archive) FindFileByFilename(filename string) (*ArchivedFile, error) {
+	stmt, err := a.conn.Prepare("SELECT f.hash, f.filename, f.is_deleted, u.amazon_id FROM file AS f INNER JOIN upload AS u ON f.hash=u.hash WHERE f.filename=? AND f.is_deleted=0")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var hash, fname, amazonId string
+	var isDeleted bool
+	err = stmt.QueryRow(filename).Scan(&hash, &fname, &isDeleted, &amazonId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ArchivedFile{
+		filename:  fname,
+		hash:      hash,
+		amazonId:  amazonId,
+		isDeleted: isDeleted,
+	}, nil
+}
+
+/**
+ * AddFileStat records the size, modification time, inode and
+ * device of a file at the time it was found to have the given hash
+ */
+func (a *archive) AddFileStat(filename, hash string, stat *FileStat) error {
+	stmt, err := a.conn.Prepare("INSERT OR REPLACE INTO file_stat(filename, hash, size, mtime, inode, device) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(filename, hash, stat.size, stat.mtime, int64(stat.inode), int64(stat.device))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * FindFileStat returns the hash of a file and the stat
+ * recorded along with it when it was last hashed.
+ * If there is no such file known the function returns an error
+ */
+func (a *archive) FindFileStat(filename string) (string, *FileStat, error) {
+	stmt, err := a.conn.Prepare("SELECT hash, size, mtime, inode, device FROM file_stat WHERE filename=?")
+	if err != nil {
+		return "", nil, err
+	}
+	defer stmt.Close()
+
+	var hash string
+	var inode, device int64
+	stat := &FileStat{}
+	err = stmt.QueryRow(filename).Scan(&hash, &stat.size, &stat.mtime, &inode, &device)
+	if err != nil {
+		return "", nil, err
+	}
+	stat.inode, stat.device = uint64(inode), uint64(device)
+
+	return hash, stat, nil
+}
+
+/**
+ * FindAmazonIdByHash returns the amazon id of a given hash
+ * If there is no such file known the function returns an error
+ */
+func (a *archive) FindAmazonIdByHash(hash string) (*string, error) {
+	stmt, err := a.conn.Prepare("SELECT amazon_id FROM upload WHERE hash=?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var amazonId string
+	err = stmt.QueryRow(hash).Scan(&amazonId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &amazonId, nil
+}
+
+/**
+ * DeleteFile marks a file as deleted
+ */
+func (a *archive) DeleteFile(hash, filename string) error {
+	stmt, err := a.conn.Prepare("UPDATE file SET is_deleted=1 WHERE hash=? AND filename=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(hash, filename)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * AddMultipartUpload records a multipart upload that has been
+ * initiated so it can be resumed if it doesn't complete
+ */
+func (a *archive) AddMultipartUpload(upload *MultipartUpload) error {
+	stmt, err := a.conn.Prepare("INSERT INTO multipart(upload_id, vault, filename, hash, part_size, size) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(upload.UploadId(), upload.Vault(), upload.Filename(), upload.Hash(), upload.PartSize(), upload.Size())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * AddMultipartPart records a part of a multipart upload as completed
+ * @param treeHash string Hex encoded tree hash of the part
+ */
+func (a *archive) AddMultipartPart(uploadId string, start int64, treeHash string) error {
+	stmt, err := a.conn.Prepare("INSERT OR REPLACE INTO multipart_part(upload_id, start, tree_hash) VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(uploadId, start, treeHash)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * SetMultipartParts replaces the completed parts of a multipart
+ * upload, i.e. with the parts Glacier reports to have received
+ * @param parts map[int64]string Hex encoded tree hashes by part offset
+ */
+func (a *archive) SetMultipartParts(uploadId string, parts map[int64]string) error {
+	stmt, err := a.conn.Prepare("DELETE FROM multipart_part WHERE upload_id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(uploadId)
+	if err != nil {
+		return err
+	}
+
+	for start, treeHash := range parts {
+		if err := a.AddMultipartPart(uploadId, start, treeHash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+ * FindMultipartUpload returns an unfinished multipart upload to
+ * a vault of content with the given hash, size and part size.
+ * If there is no such upload the function returns an error
+ */
+func (a *archive) FindMultipartUpload(vault, hash string, size, partSize int64) (*MultipartUpload, error) {
+	stmt, err := a.conn.Prepare("SELECT upload_id, vault, filename, hash, part_size, size FROM multipart WHERE vault=? AND hash=? AND size=? AND part_size=?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	upload := &MultipartUpload{}
+	err = stmt.QueryRow(vault, hash, size, partSize).Scan(&upload.uploadId, &upload.vault, &upload.filename, &upload.hash, &upload.partSize, &upload.size)
+	if err != nil {
+		return nil, err
+	}
+
+	if upload.parts, err = a.listMultipartParts(upload.uploadId); err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+/**
+ * ListMultipartUploads returns all unfinished multipart uploads
+ */
+func (a *archive) ListMultipartUploads() ([]*MultipartUpload, error) {
+	stmt, err := a.conn.Prepare("SELECT upload_id, vault, filename, hash, part_size, size FROM multipart")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uploads []*MultipartUpload
+	for rows.Next() {
+		upload := &MultipartUpload{}
+		if err := rows.Scan(&upload.uploadId, &upload.vault, &upload.filename, &upload.hash, &upload.partSize, &upload.size); err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	rows.Close()
+
+	for _, upload := range uploads {
+		if upload.parts, err = a.listMultipartParts(upload.uploadId); err != nil {
+			return nil, err
+		}
+	}
+
+	return uploads, nil
+}
+
+/**
+ * listMultipartParts returns the hex encoded tree hashes of the
+ * completed parts of a multipart upload by offset
+ */
+func (a *archive) listMultipartParts(uploadId string) (map[int64]string, error) {
+	stmt, err := a.conn.Prepare("SELECT start, tree_hash FROM multipart_part WHERE upload_id=?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(uploadId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	parts := make(map[int64]string)
+	var start int64
+	var treeHash string
+	for rows.Next() {
+		if err := rows.Scan(&start, &treeHash); err != nil {
+			return nil, err
+		}
+		parts[start] = treeHash
+	}
+
+	return parts, nil
+}
+
+/**
+ * DeleteMultipartUpload forgets about a multipart upload
+ * once it's completed or aborted
+ */
+func (a *archive) DeleteMultipartUpload(uploadId string) error {
+	for _, query := range []string{"DELETE FROM multipart_part WHERE upload_id=?", "DELETE FROM multipart WHERE upload_id=?"} {
+		stmt, err := a.conn.Prepare(query)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		if _, err = stmt.Exec(uploadId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+ * AddRestoreJob records a retrieval job that has been initiated,
+ * together with the paths its output should be restored to
+ */
+func (a *archive) AddRestoreJob(job *RestoreJob) error {
+	stmt, err := a.conn.Prepare("INSERT INTO restore_job(job_id, amazon_id, hash, status, bytes_downloaded) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(job.JobId(), job.AmazonId(), job.Hash(), job.Status(), job.BytesDownloaded())
+	if err != nil {
+		return err
+	}
+
+	if job.id, err = result.LastInsertId(); err != nil {
+		return err
+	}
+
+	stmt, err = a.conn.Prepare("INSERT OR IGNORE INTO restore_target(restore_job_id, target) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, target := range job.Targets() {
+		if _, err = stmt.Exec(job.id, target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+ * UpdateRestoreJob stores the job id, status and
+ * download progress of a retrieval job
+ */
+func (a *archive) UpdateRestoreJob(job *RestoreJob) error {
+	stmt, err := a.conn.Prepare("UPDATE restore_job SET job_id=?, status=?, bytes_downloaded=? WHERE id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(job.JobId(), job.Status(), job.BytesDownloaded(), job.id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * ListRestoreJobs returns all retrieval jobs
+ * whose output has not been restored yet
+ */
+func (a *archive) ListRestoreJobs() ([]*RestoreJob, error) {
+	stmt, err := a.conn.Prepare("SELECT id, job_id, amazon_id, hash, status, bytes_downloaded FROM restore_job WHERE status NOT IN ('Restored', 'Failed') ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*RestoreJob
+	for rows.Next() {
+		job := &RestoreJob{}
+		if err := rows.Scan(&job.id, &job.jobId, &job.amazonId, &job.hash, &job.status, &job.bytesDownloaded); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	rows.Close()
+
+	stmt, err = a.conn.Prepare("SELECT target FROM restore_target WHERE restore_job_id=? ORDER BY target")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	for _, job := range jobs {
+		rows, err := stmt.Query(job.id)
+		if err != nil {
+			return nil, err
+		}
+		var target string
+		for rows.Next() {
+			if err := rows.Scan(&target); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			job.targets = append(job.targets, target)
+		}
+		rows.Close()
+	}
+
+	return jobs, nil
+}
+
+/**
+ * Snapshot writes a consistent copy of the archive to dest
+ * using the sqlite backup API, so it can be made while
+ * the archive is in use
+ */
+func (a *archive) Snapshot(dest string) error {
+	sqlite := &sqlite3.SQLiteDriver{}
+	src, err := sqlite.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := sqlite.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	return backupDatabase(dst.(*sqlite3.SQLiteConn), src.(*sqlite3.SQLiteConn))
+}
+
+/**
+ * backupDatabase copies the database of src to dst
+ * using the sqlite backup API
+ */
+func backupDatabase(dst, src *sqlite3.SQLiteConn) error {
+	backup, err := dst.Backup("main", src, "main")
+	if err != nil {
+		return err
+	}
+	defer backup.Finish()
+
+	// the backup doesn't progress while the archive is locked by a writer
+	for retries := 0; retries < 100; retries++ {
+		done, err := backup.Step(-1)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.New("Archive stayed locked, unable to copy it")
+}
+
+/**
+ * AddSnapshot records a snapshot of the archive
+ * that was uploaded to the index vault
+ */
+func (a *archive) AddSnapshot(amazonId string, created time.Time) error {
+	stmt, err := a.conn.Prepare("INSERT INTO snapshot(amazon_id, created) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(amazonId, created)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * FindLatestSnapshot returns the amazon id and creation time of the
+ * snapshot of the archive that was uploaded last.
+ * If there are no snapshots the function returns an error
+ */
+func (a *archive) FindLatestSnapshot() (string, time.Time, error) {
+	stmt, err := a.conn.Prepare("SELECT amazon_id, created FROM snapshot ORDER BY created DESC LIMIT 1")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer stmt.Close()
+
+	var amazonId string
+	var created time.Time
+	err = stmt.QueryRow().Scan(&amazonId, &created)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return amazonId, created, nil
+}
+
+/**
+ * ListOldSnapshots returns the amazon ids of all snapshots
+ * of the archive except for the keep latest ones
+ */
+func (a *archive) ListOldSnapshots(keep int) ([]string, error) {
+	stmt, err := a.conn.Prepare("SELECT amazon_id FROM snapshot ORDER BY created DESC LIMIT -1 OFFSET ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(keep)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var amazonIds []string
+	for rows.Next() {
+		var amazonId string
+		if err := rows.Scan(&amazonId); err != nil {
+			return nil, err
+		}
+		amazonIds = append(amazonIds, amazonId)
+	}
+
+	return amazonIds, rows.Err()
+}
+
+/**
+ * DeleteSnapshot removes a snapshot of the archive
+ * that was deleted from the index vault
+ */
+func (a *archive) DeleteSnapshot(amazonId string) error {
+	stmt, err := a.conn.Prepare("DELETE FROM snapshot WHERE amazon_id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(amazonId)
+	return err
+}
+
+/**
+ * EncryptionSalt returns the salt used to derive the encryption
+ * key from a passphrase. A random salt is created the first time.
+ */
+func (a *archive) EncryptionSalt() ([]byte, error) {
+	var value string
+	err := a.conn.QueryRow("SELECT value FROM setting WHERE name='encryption_salt'").Scan(&value)
+	if err == nil {
+		return hex.DecodeString(value)
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := a.conn.Exec("INSERT INTO setting(name, value) VALUES ('encryption_salt', ?)", hex.EncodeToString(salt)); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+/**
+ * StartRun records the start of a new backup run
+ */
+func (a *archive) StartRun() (*Run, error) {
+	run := &Run{started: time.Now()}
+	if err := a.conn.QueryRow("SELECT COALESCE(MAX(id), 0) FROM run").Scan(&run.previous); err != nil {
+		return nil, err
+	}
+
+	stmt, err := a.conn.Prepare("INSERT INTO run(started) VALUES (?)")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(run.started)
+	if err != nil {
+		return nil, err
+	}
+
+	run.id, err = result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+/**
+ * FinishRun records that a backup run completed
+ */
+func (a *archive) FinishRun(run *Run) error {
+	stmt, err := a.conn.Prepare("UPDATE run SET finished=? WHERE id=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	run.finished = time.Now()
+	_, err = stmt.Exec(run.finished, run.id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * ListRuns returns all backup runs, oldest first
+ */
+func (a *archive) ListRuns() ([]*Run, error) {
+	stmt, err := a.conn.Prepare("SELECT id, started, finished FROM run ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []*Run
+	var previous int64
+	for rows.Next() {
+		run := &Run{previous: previous}
+		var finished *time.Time
+		if err := rows.Scan(&run.id, &run.started, &finished); err != nil {
+			return nil, err
+		}
+		if finished != nil {
+			run.finished = *finished
+		}
+		previous = run.id
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
+
+/**
+ * AddFileVersion records that a file had the given content during a run.
+ * If the file had the same content during the previous run, the
+ * existing version is extended to this run, otherwise a new version starts.
+ * @param size int64 Size of the content in bytes
+ */
+func (a *archive) AddFileVersion(run *Run, filename, hash string, size int64) error {
+	stmt, err := a.conn.Prepare("UPDATE file_version SET last_run=?, size=? WHERE filename=? AND hash=? AND last_run IN (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(run.id, size, filename, hash, run.previous, run.id)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated > 0 {
+		return err
+	}
+
+	stmt, err = a.conn.Prepare("INSERT OR REPLACE INTO file_version(filename, hash, first_run, last_run, size) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(filename, hash, run.id, run.id, size)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * ListVersions returns all versions of a file, oldest first
+ */
+func (a *archive) ListVersions(filename string) ([]*FileVersion, error) {
+	stmt, err := a.conn.Prepare("SELECT v.filename, v.hash, COALESCE((SELECT u.amazon_id FROM upload AS u WHERE u.hash=v.hash LIMIT 1), ''), v.first_run, v.last_run, COALESCE(v.size, 0) FROM file_version AS v WHERE v.filename=? ORDER BY v.first_run")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []*FileVersion
+	for rows.Next() {
+		version := &FileVersion{}
+		if err := rows.Scan(&version.filename, &version.hash, &version.amazonId, &version.firstRun, &version.lastRun, &version.size); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
+
+/**
+ * ListAllVersions returns the versions of all files,
+ * ordered by filename and newest first
+ */
+func (a *archive) ListAllVersions() ([]*FileVersion, error) {
+	stmt, err := a.conn.Prepare("SELECT v.filename, v.hash, COALESCE((SELECT u.amazon_id FROM upload AS u WHERE u.hash=v.hash LIMIT 1), ''), v.first_run, v.last_run, COALESCE(v.size, 0) FROM file_version AS v ORDER BY v.filename, v.first_run DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []*FileVersion
+	for rows.Next() {
+		version := &FileVersion{}
+		if err := rows.Scan(&version.filename, &version.hash, &version.amazonId, &version.firstRun, &version.lastRun, &version.size); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, nil
+}
+
+/**
+ * DeleteFileVersion forgets about a version of a file,
+ * so it's no longer listed in the history of the file
+ */
+func (a *archive) DeleteFileVersion(version *FileVersion) error {
+	stmt, err := a.conn.Prepare("DELETE FROM file_version WHERE filename=? AND first_run=?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(version.Filename(), version.FirstRun())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * ListFilesAtRun returns the files in a directory as they were
+ * during a run. Files whose content is not stored in Glacier are
+ * left out, since they can't be restored.
+ * @param dir string Directory to list recursively, or an empty string for all files
+ */
+func (a *archive) ListFilesAtRun(runId int64, dir string) ([]*ArchivedFile, error) {
+	prefix := ""
+	if dir != "" {
+		prefix = strings.TrimSuffix(dir, "/") + "/"
+	}
+
+	stmt, err := a.conn.Prepare("SELECT v.hash, v.filename, (SELECT u.amazon_id FROM upload AS u WHERE u.hash=v.hash LIMIT 1) AS amazon_id FROM file_version AS v WHERE v.first_run<=? AND v.last_run>=? AND substr(v.filename, 1, length(?))=? AND amazon_id IS NOT NULL ORDER BY v.filename")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(runId, runId, prefix, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []*ArchivedFile
+	for rows.Next() {
+		file := &ArchivedFile{}
+		if err := rows.Scan(&file.hash, &file.filename, &file.amazonId); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxDescriptionLength is the maximum length
+// Glacier allows for archive descriptions
+const maxDescriptionLength = 1024
+
+// treeHashPrefix marks hashes in the archive that are Glacier tree
+// hashes because the content hash of an archive could not be determined
+const treeHashPrefix = "treehash:"
+
+// snapshotDescriptionPrefix starts the description of
+// snapshots of the archive in the index vault
+const snapshotDescriptionPrefix = "gobackup catalog snapshot "
+
+/**
+ * archiveDescription returns the description stored with an archive
+ * in Glacier. It consists of the hash of the content and the
+ * (quoted) path of the file, so the archive can be rebuilt from
+ * a vault inventory. Glacier only allows printable ASCII, so
+ * other characters in the path are escaped. Paths too long to fit
+ * are left out.
+ * i.e. hash `h12345` and path `/tmp/foo.txt` becomes h12345 "/tmp/foo.txt"
+ */
+func archiveDescription(hash, path string) string {
+	description := hash + " " + strconv.QuoteToASCII(path)
+	if len(description) > maxDescriptionLength {
+		return hash
+	}
+	return description
+}
+
+/**
+ * parseArchiveDescription extracts the hash and path from an
+ * archive description. Descriptions of archives uploaded before
+ * the hash was stored consist of just the path, in that case
+ * the returned hash is empty.
+ */
+func parseArchiveDescription(description string) (hash, path string) {
+	parts := strings.SplitN(description, " ", 2)
+	if len(parts) == 1 {
+		if isSha1(parts[0]) {
+			return parts[0], ""
+		}
+		return "", description
+	}
+
+	path, err := strconv.Unquote(parts[1])
+	if err != nil || !isSha1(parts[0]) {
+		return "", description
+	}
+	return parts[0], path
+}
+
+/**
+ * isOwnDescription checks if an archive description is one this
+ * tool produces, either a snapshot of the archive, a bundle, an
+ * encrypted description, with the hash of the (compressed) content
+ * or, for archives uploaded before the hash was stored, just the path.
+ */
+func isOwnDescription(description string) bool {
+	if strings.HasPrefix(description, snapshotDescriptionPrefix) ||
+		strings.HasPrefix(description, bundleDescriptionPrefix) ||
+		isEncryptedDescription(description) {
+		return true
+	}
+	_, description = parseDescribedCodec(description)
+	hash, path := parseArchiveDescription(description)
+	return hash != "" || filepath.IsAbs(path)
+}
+
+/**
+ * isSha1 checks if a string is a hex encoded SHA1 hash
+ */
+func isSha1(hash string) bool {
+	if len(hash) != 40 {
+		return false
+	}
+	for _, c := range hash {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
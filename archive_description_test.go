@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestArchiveDescription(t *testing.T) {
+	hash := "32d10c7b8cf96570ca04ce37f2a19d84240d3a89"
+	tests := map[string]string{
+		"/tmp/foo.txt":                      hash + ` "/tmp/foo.txt"`,
+		"/tmp/with space.txt":               hash + ` "/tmp/with space.txt"`,
+		"/tmp/café.txt":                     hash + ` "/tmp/caf\u00e9.txt"`,
+		"/tmp/" + strings.Repeat("a", 1024): hash,
+	}
+
+	for path, expected := range tests {
+		if actual := archiveDescription(hash, path); actual != expected {
+			t.Errorf("Description for `%s` was expected to be `%s`, got `%s`", path, expected, actual)
+		}
+	}
+}
+
+func TestParseArchiveDescription(t *testing.T) {
+	hash := "32d10c7b8cf96570ca04ce37f2a19d84240d3a89"
+	tests := []struct {
+		description, hash, path string
+	}{
+		{archiveDescription(hash, "/tmp/café.txt"), hash, "/tmp/café.txt"},
+		{archiveDescription(hash, "/tmp/with space.txt"), hash, "/tmp/with space.txt"},
+		{hash, hash, ""},
+		{"/tmp/foo.txt", "", "/tmp/foo.txt"},
+		{"/tmp/with space.txt", "", "/tmp/with space.txt"},
+	}
+
+	for _, test := range tests {
+		hash, path := parseArchiveDescription(test.description)
+		if hash != test.hash || path != test.path {
+			t.Errorf("Description `%s` was expected to give hash `%s` and path `%s`, got `%s` and `%s`", test.description, test.hash, test.path, hash, path)
+		}
+	}
+}
+
+func TestIsOwnDescription(t *testing.T) {
+	hash := "32d10c7b8cf96570ca04ce37f2a19d84240d3a89"
+	tests := map[string]bool{
+		archiveDescription(hash, "/tmp/foo.txt"):      true,
+		describeArchive(hash, "/tmp/foo.txt", "gzip"): true,
+		hash:                           true,
+		bundleDescriptionPrefix + hash: true,
+		snapshotDescriptionPrefix + "2015-05-22T12:00:00Z": true,
+		encryptedDescriptionPrefix + "c2VhbGVk":            true,
+		"/tmp/foo.txt":                                     true,
+		"backup of another tool":                           false,
+	}
+
+	for description, expected := range tests {
+		if actual := isOwnDescription(description); actual != expected {
+			t.Errorf("Expected isOwnDescription(`%s`) to be %v", description, expected)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/rdwilliamson/aws/glacier"
+	"hash"
+	"io"
+)
+
+// treeHashChunkSize is the size of the chunks
+// Glacier computes the leaves of tree hashes of
+const treeHashChunkSize = 1024 * 1024
+
+/**
+ * ArchiveHashes are the size and hashes of content Glacier needs
+ * to store it as an archive. Computing them up front saves the
+ * backend from reading the content an extra time.
+ */
+type ArchiveHashes struct {
+	size     int64
+	treeHash []byte
+	sha256   []byte
+	// chunkHashes are the hashes of every 1 MiB of the content,
+	// from which the tree hash of any part can be derived
+	chunkHashes [][]byte
+}
+
+/**
+ * hashArchive computes the archive hashes of the content read from src
+ */
+func hashArchive(src io.Reader) (*ArchiveHashes, error) {
+	hasher := newArchiveHasher()
+	if _, err := copyToTreeHash(hasher, src); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(), nil
+}
+
+/**
+ * copyToTreeHash copies src to dst, which is or includes a tree hash.
+ * The vendored tree hash mishandles writes of several MiB, so any
+ * WriterTo of src is hidden to make io.Copy write in small chunks.
+ * @return int64 The number of bytes copied
+ */
+func copyToTreeHash(dst io.Writer, src io.Reader) (int64, error) {
+	return io.Copy(dst, struct{ io.Reader }{src})
+}
+
+/**
+ * archiveHasher computes the archive hashes of the content written to it
+ */
+type archiveHasher struct {
+	th      *glacier.TreeHash
+	chunk   hash.Hash
+	written int
+	size    int64
+	chunks  [][]byte
+}
+
+/**
+ * newArchiveHasher creates an archiveHasher without content
+ */
+func newArchiveHasher() *archiveHasher {
+	return &archiveHasher{
+		th:    glacier.NewTreeHash(),
+		chunk: sha256.New(),
+	}
+}
+
+func (a *archiveHasher) Write(p []byte) (int, error) {
+	if _, err := a.th.Write(p); err != nil {
+		return 0, err
+	}
+	a.size += int64(len(p))
+
+	n := len(p)
+	for len(p) > 0 {
+		size := treeHashChunkSize - a.written
+		if size > len(p) {
+			size = len(p)
+		}
+		a.chunk.Write(p[:size])
+		a.written += size
+		p = p[size:]
+		if a.written == treeHashChunkSize {
+			a.endChunk()
+		}
+	}
+	return n, nil
+}
+
+/**
+ * endChunk records the hash of the current chunk and starts the next
+ */
+func (a *archiveHasher) endChunk() {
+	a.chunks = append(a.chunks, a.chunk.Sum(nil))
+	a.chunk.Reset()
+	a.written = 0
+}
+
+/**
+ * Sum returns the archive hashes of all content written.
+ * Nothing may be written afterwards.
+ */
+func (a *archiveHasher) Sum() *ArchiveHashes {
+	if a.written > 0 {
+		a.endChunk()
+	}
+	a.th.Close()
+	return &ArchiveHashes{
+		size:        a.size,
+		treeHash:    a.th.TreeHash(),
+		sha256:      a.th.Hash(),
+		chunkHashes: a.chunks,
+	}
+}
+
+func (a *ArchiveHashes) Size() int64 {
+	return a.size
+}
+
+/**
+ * TreeHash returns the hex encoded SHA256 tree hash of the content
+ * @return string
+ */
+func (a *ArchiveHashes) TreeHash() string {
+	return fmt.Sprintf("%x", a.treeHash)
+}
+
+/**
+ * Sha256 returns the hex encoded SHA256 hash of the content
+ * @return string
+ */
+func (a *ArchiveHashes) Sha256() string {
+	return fmt.Sprintf("%x", a.sha256)
+}
+
+/**
+ * PartTreeHash returns the tree hash of size bytes of the content
+ * starting at start, which must be a multiple of 1 MiB
+ * @return []byte
+ */
+func (a *ArchiveHashes) PartTreeHash(start, size int64) []byte {
+	first := start / treeHashChunkSize
+	last := (start + size + treeHashChunkSize - 1) / treeHashChunkSize
+	if last > int64(len(a.chunkHashes)) {
+		last = int64(len(a.chunkHashes))
+	}
+	return combineTreeHashes(a.chunkHashes[first:last])
+}
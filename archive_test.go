@@ -1,8 +1,13 @@
 package main
 
 import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestAndListMulti(t *testing.T) {
@@ -106,6 +111,24 @@ func TestAndListSameHash(t *testing.T) {
 	}
 }
 
+func TestListFilesWithContentUploadedTwice(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	archive.AddFile(&ArchivedFile{filename: "hello.txt", hash: "h12345", amazonId: "a1"})
+	archive.AddFile(&ArchivedFile{filename: "bye.txt", hash: "h12345", amazonId: "a2"})
+
+	listedFiles, err := archive.ListFiles()
+	if err != nil {
+		t.Errorf("Unexpected error while listing files: %s", err)
+	}
+	if len(listedFiles) != 2 {
+		t.Errorf("Expected every file to be listed once, got %d files", len(listedFiles))
+	}
+}
+
 func findFileInList(file *ArchivedFile, files []*ArchivedFile) bool {
 	for _, compare := range files {
 		if reflect.DeepEqual(file, compare) {
@@ -242,3 +265,690 @@ func TestAddAndDeleteFile(t *testing.T) {
 		t.Errorf("Expected no files in list, got %d", len(listedFiles))
 	}
 }
+
+func TestAddFileTwice(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	file := &ArchivedFile{
+		filename:  "hello.txt",
+		hash:      "h12345",
+		amazonId:  "a12345",
+		isDeleted: false,
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = archive.AddFile(file); err != nil {
+			t.Errorf("Adding the same file again should not fail, got error: %s", err)
+		}
+	}
+
+	listedFiles, err := archive.ListFiles()
+	if err != nil {
+		t.Errorf("Unexpected error while listing files: %s", err)
+	}
+
+	if len(listedFiles) != 1 {
+		t.Errorf("Expected 1 file in list, got %d", len(listedFiles))
+	}
+}
+
+func TestAddChangedFile(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	original := &ArchivedFile{
+		filename:  "hello.txt",
+		hash:      "h12345",
+		amazonId:  "a12345",
+		isDeleted: false,
+	}
+	changed := &ArchivedFile{
+		filename:  "hello.txt",
+		hash:      "h54321",
+		amazonId:  "a54321",
+		isDeleted: false,
+	}
+
+	if err = archive.AddFile(original); err != nil {
+		t.Errorf("File should have been added, but got error: %s", err)
+	}
+	if err = archive.AddFile(changed); err != nil {
+		t.Errorf("File should have been added, but got error: %s", err)
+	}
+
+	file, err := archive.FindFileByFilename("hello.txt")
+	if err != nil {
+		t.Errorf("Should be able to find file but got error: %s", err)
+	} else if !reflect.DeepEqual(file, changed) {
+		t.Errorf("Expected the changed file to be current, got hash `%s`", file.Hash())
+	}
+
+	if _, err = archive.FindAmazonIdByHash("h12345"); err != nil {
+		t.Errorf("AmazonID for hash `h12345` should still be in DB even though file changed")
+	}
+
+	listedFiles, err := archive.ListFiles()
+	if err != nil {
+		t.Errorf("Unexpected error while listing files: %s", err)
+	}
+
+	if len(listedFiles) != 1 {
+		t.Errorf("Expected 1 file in list, got %d", len(listedFiles))
+	}
+}
+
+func TestMultipartUploads(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	upload := &MultipartUpload{
+		uploadId: "u12345",
+		vault:    "test",
+		filename: "big.bin",
+		hash:     "h12345",
+		partSize: 1024 * 1024,
+		size:     3 * 1024 * 1024,
+	}
+	if err = archive.AddMultipartUpload(upload); err != nil {
+		t.Errorf("Multipart upload should have been added, but got error: %s", err)
+	}
+
+	if err = archive.AddMultipartPart("u12345", 1024*1024, "t2"); err != nil {
+		t.Errorf("Multipart part should have been added, but got error: %s", err)
+	}
+
+	found, err := archive.FindMultipartUpload("test", "h12345", 3*1024*1024, 1024*1024)
+	if err != nil {
+		t.Fatalf("Should be able to find multipart upload but got error: %s", err)
+	}
+	if found.UploadId() != "u12345" {
+		t.Errorf("Invalid upload id `%s`, expected `u12345`", found.UploadId())
+	}
+	if treeHash, ok := found.PartTreeHash(1024 * 1024); !ok || treeHash != "t2" {
+		t.Errorf("Expected part at 1 MiB to be completed with tree hash `t2`")
+	}
+	if _, ok := found.PartTreeHash(0); ok {
+		t.Errorf("Part at 0 should not be completed")
+	}
+
+	if _, err = archive.FindMultipartUpload("test", "h12345", 3*1024*1024, 2*1024*1024); err == nil {
+		t.Errorf("Should not find multipart upload with a different part size")
+	}
+
+	if _, err = archive.FindMultipartUpload("test_index", "h12345", 3*1024*1024, 1024*1024); err == nil {
+		t.Errorf("Should not find multipart upload to a different vault")
+	}
+
+	err = archive.SetMultipartParts("u12345", map[int64]string{0: "t1"})
+	if err != nil {
+		t.Errorf("Unexpected error while setting parts: %s", err)
+	}
+
+	uploads, err := archive.ListMultipartUploads()
+	if err != nil {
+		t.Fatalf("Unexpected error while listing multipart uploads: %s", err)
+	}
+	if len(uploads) != 1 || uploads[0].Vault() != "test" {
+		t.Fatalf("Expected 1 multipart upload to vault test, got %d", len(uploads))
+	}
+	if _, ok := uploads[0].PartTreeHash(1024 * 1024); ok {
+		t.Errorf("Part at 1 MiB should have been replaced")
+	}
+	if treeHash, ok := uploads[0].PartTreeHash(0); !ok || treeHash != "t1" {
+		t.Errorf("Expected part at 0 to be completed with tree hash `t1`")
+	}
+
+	if err = archive.DeleteMultipartUpload("u12345"); err != nil {
+		t.Errorf("Unexpected error while deleting multipart upload: %s", err)
+	}
+
+	if _, err = archive.FindMultipartUpload("test", "h12345", 3*1024*1024, 1024*1024); err == nil {
+		t.Errorf("Should not find multipart upload after it was deleted")
+	}
+}
+
+func TestRestoreJobs(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	job := &RestoreJob{
+		jobId:    "j12345",
+		amazonId: "a12345",
+		hash:     "h12345",
+		status:   "InProgress",
+		targets:  []string{"/restore/hello.txt", "/restore/bye.txt"},
+	}
+	if err = archive.AddRestoreJob(job); err != nil {
+		t.Errorf("Restore job should have been added, but got error: %s", err)
+	}
+
+	job.jobId = "j54321"
+	job.bytesDownloaded = 1024
+	if err = archive.UpdateRestoreJob(job); err != nil {
+		t.Errorf("Restore job should have been updated, but got error: %s", err)
+	}
+
+	jobs, err := archive.ListRestoreJobs()
+	if err != nil {
+		t.Fatalf("Unexpected error while listing restore jobs: %s", err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("Expected 1 restore job, got %d", len(jobs))
+	}
+	if !reflect.DeepEqual(jobs[0].Targets(), []string{"/restore/bye.txt", "/restore/hello.txt"}) {
+		t.Errorf("Invalid targets `%+v`", jobs[0].Targets())
+	}
+	if jobs[0].JobId() != "j54321" || jobs[0].BytesDownloaded() != 1024 || jobs[0].Hash() != "h12345" {
+		t.Errorf("Restore job was not updated correctly")
+	}
+
+	job.status = "Restored"
+	if err = archive.UpdateRestoreJob(job); err != nil {
+		t.Errorf("Restore job should have been updated, but got error: %s", err)
+	}
+
+	jobs, err = archive.ListRestoreJobs()
+	if err != nil {
+		t.Errorf("Unexpected error while listing restore jobs: %s", err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("Expected no outstanding restore jobs, got %d", len(jobs))
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobackup-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := NewArchive(filepath.Join(dir, "archive.db"))
+	if err != nil {
+		t.Fatalf("Could not create archive instance: %s", err)
+	}
+
+	file := &ArchivedFile{
+		filename:  "hello.txt",
+		hash:      "h12345",
+		amazonId:  "a12345",
+		isDeleted: false,
+	}
+	if err = archive.AddFile(file); err != nil {
+		t.Errorf("File should have been added, but got error: %s", err)
+	}
+
+	if err = archive.Snapshot(filepath.Join(dir, "snapshot.db")); err != nil {
+		t.Fatalf("Unexpected error while creating snapshot: %s", err)
+	}
+
+	snapshot, err := NewArchive(filepath.Join(dir, "snapshot.db"))
+	if err != nil {
+		t.Fatalf("Could not open snapshot: %s", err)
+	}
+
+	found, err := snapshot.FindFileByFilename("hello.txt")
+	if err != nil {
+		t.Errorf("Should be able to find file in snapshot but got error: %s", err)
+	} else if !reflect.DeepEqual(found, file) {
+		t.Errorf("File retrieved from snapshot is not the same as the one that was added.")
+	}
+}
+
+func TestAddAndFindLatestSnapshot(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	if _, _, err = archive.FindLatestSnapshot(); err == nil {
+		t.Errorf("Expected error when searching for snapshot in empty archive but got no error.")
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	archive.AddSnapshot("s1", now.Add(-time.Hour))
+	archive.AddSnapshot("s2", now)
+
+	amazonId, created, err := archive.FindLatestSnapshot()
+	if err != nil {
+		t.Errorf("Should be able to find snapshot but got error: %s", err)
+	}
+	if amazonId != "s2" || !created.Equal(now) {
+		t.Errorf("Expected snapshot `s2` created at %s, got `%s` created at %s", now, amazonId, created)
+	}
+}
+
+func TestListOldAndDeleteSnapshots(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	archive.AddSnapshot("s1", now.Add(-2*time.Hour))
+	archive.AddSnapshot("s2", now.Add(-time.Hour))
+	archive.AddSnapshot("s3", now)
+
+	old, err := archive.ListOldSnapshots(2)
+	if err != nil {
+		t.Errorf("Should be able to list old snapshots but got error: %s", err)
+	}
+	if !reflect.DeepEqual(old, []string{"s1"}) {
+		t.Errorf("Expected only snapshot `s1` to be old, got %v", old)
+	}
+
+	if err := archive.DeleteSnapshot("s1"); err != nil {
+		t.Errorf("Should be able to delete snapshot but got error: %s", err)
+	}
+	if old, _ = archive.ListOldSnapshots(0); !reflect.DeepEqual(old, []string{"s3", "s2"}) {
+		t.Errorf("Expected snapshots `s3` and `s2` to remain, got %v", old)
+	}
+}
+
+func TestAddListAndDeleteUploads(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	uploaded := time.Now().UTC().Truncate(time.Second)
+	upload := &UploadRecord{
+		hash:     "h12345",
+		amazonId: "a12345",
+		treeHash: "t12345",
+		size:     1024,
+		uploaded: uploaded,
+	}
+	if err = archive.AddUpload(upload); err != nil {
+		t.Errorf("Upload should have been added, but got error: %s", err)
+	}
+
+	uploads, err := archive.ListUploads()
+	if err != nil {
+		t.Fatalf("Unexpected error while listing uploads: %s", err)
+	}
+	if len(uploads) != 1 {
+		t.Fatalf("Expected 1 upload, got %d", len(uploads))
+	}
+	if !reflect.DeepEqual(uploads[0], upload) {
+		t.Errorf("Listed upload %+v is not the same as the one that was added %+v", uploads[0], upload)
+	}
+
+	if err = archive.DeleteUpload("a12345"); err != nil {
+		t.Errorf("Unexpected error while deleting upload: %s", err)
+	}
+
+	if _, err = archive.FindAmazonIdByHash("h12345"); err == nil {
+		t.Errorf("Should not find hash after its upload was deleted")
+	}
+}
+
+func TestUpgradeArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobackup-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "archive.db")
+	old, err := NewArchive(path)
+	if err != nil {
+		t.Fatalf("Could not create archive instance: %s", err)
+	}
+	conn := old.Connection()
+	conn.Exec("DROP TABLE upload")
+	conn.Exec("CREATE TABLE upload (hash text, amazon_id text, PRIMARY KEY(hash, amazon_id))")
+	conn.Exec("INSERT INTO upload(hash, amazon_id) VALUES ('h12345', 'a12345')")
+	conn.Close()
+
+	archive, err := NewArchive(path)
+	if err != nil {
+		t.Fatalf("Could not open archive created by an older version: %s", err)
+	}
+
+	uploads, err := archive.ListUploads()
+	if err != nil {
+		t.Fatalf("Unexpected error while listing uploads: %s", err)
+	}
+	if len(uploads) != 1 || uploads[0].AmazonId() != "a12345" || uploads[0].TreeHash() != "" || !uploads[0].Uploaded().IsZero() {
+		t.Errorf("Upload from older version was not listed correctly")
+	}
+}
+
+func TestUpgradeReadOnlyArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobackup-test")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "archive.db")
+	old, err := NewArchive(path)
+	if err != nil {
+		t.Fatalf("Could not create archive instance: %s", err)
+	}
+	conn := old.Connection()
+	conn.Exec("DROP TABLE upload")
+	conn.Exec("CREATE TABLE upload (hash text, amazon_id text, PRIMARY KEY(hash, amazon_id))")
+	conn.Exec("INSERT INTO upload(hash, amazon_id) VALUES ('h12345', 'a12345')")
+	conn.Close()
+	os.Chmod(path, 0444)
+
+	archive, err := NewReadOnlyArchive(path)
+	if err != nil {
+		t.Fatalf("Could not open archive created by an older version read-only: %s", err)
+	}
+
+	uploads, err := archive.ListUploads()
+	if err != nil {
+		t.Fatalf("Unexpected error while listing uploads: %s", err)
+	}
+	if len(uploads) != 1 || uploads[0].AmazonId() != "a12345" || uploads[0].TreeHash() != "" {
+		t.Errorf("Upload from older version was not listed correctly")
+	}
+	archive.Connection().Close()
+
+	// the file itself is left as it was
+	conn, err = sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Could not open archive: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Exec("SELECT tree_hash FROM upload"); err == nil {
+		t.Errorf("Expected the archive file not to be upgraded")
+	}
+}
+
+func TestFileVersions(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	archive.AddUpload(&UploadRecord{hash: "h1", amazonId: "a1"})
+	archive.AddUpload(&UploadRecord{hash: "h2", amazonId: "a2"})
+
+	// run 1: /dir/file1 has h1, /dir/file2 has h1
+	// run 2: /dir/file1 has h2, /dir/file2 is gone
+	// run 3: /dir/file1 has h1 again
+	contents := []map[string]string{
+		{"/dir/file1": "h1", "/dir/file2": "h1", "/other/file": "h2"},
+		{"/dir/file1": "h2"},
+		{"/dir/file1": "h1"},
+	}
+	sizes := map[string]int64{"h1": 10, "h2": 20}
+	var runs []*Run
+	for _, files := range contents {
+		run, err := archive.StartRun()
+		if err != nil {
+			t.Fatalf("Unexpected error while starting run: %s", err)
+		}
+		for filename, hash := range files {
+			if err := archive.AddFileVersion(run, filename, hash, sizes[hash]); err != nil {
+				t.Errorf("Version should have been added, but got error: %s", err)
+			}
+		}
+		// recording the same version twice in a run is harmless
+		if err := archive.AddFileVersion(run, "/dir/file1", files["/dir/file1"], sizes[files["/dir/file1"]]); err != nil {
+			t.Errorf("Version should have been added, but got error: %s", err)
+		}
+		if err := archive.FinishRun(run); err != nil {
+			t.Errorf("Run should have been finished, but got error: %s", err)
+		}
+		runs = append(runs, run)
+	}
+
+	listed, err := archive.ListRuns()
+	if err != nil {
+		t.Errorf("Unexpected error while listing runs: %s", err)
+	}
+	if len(listed) != 3 || listed[2].Id() != runs[2].Id() || listed[2].Finished().IsZero() {
+		t.Errorf("Expected 3 finished runs, got %d", len(listed))
+	}
+
+	versions, err := archive.ListVersions("/dir/file1")
+	if err != nil {
+		t.Errorf("Unexpected error while listing versions: %s", err)
+	}
+	expected := []FileVersion{
+		{"/dir/file1", "h1", "a1", runs[0].Id(), runs[0].Id(), 10},
+		{"/dir/file1", "h2", "a2", runs[1].Id(), runs[1].Id(), 20},
+		{"/dir/file1", "h1", "a1", runs[2].Id(), runs[2].Id(), 10},
+	}
+	if len(versions) != len(expected) {
+		t.Fatalf("Expected %d versions, got %d", len(expected), len(versions))
+	}
+	for i, version := range versions {
+		if *version != expected[i] {
+			t.Errorf("Expected version %v, got %v", expected[i], *version)
+		}
+	}
+
+	files, err := archive.ListFilesAtRun(runs[0].Id(), "/dir")
+	if err != nil {
+		t.Errorf("Unexpected error while listing files: %s", err)
+	}
+	if len(files) != 2 || files[0].Filename() != "/dir/file1" || files[1].Filename() != "/dir/file2" || files[1].AmazonId() != "a1" {
+		t.Errorf("Expected /dir/file1 and /dir/file2 in first run, got %d files", len(files))
+	}
+
+	files, err = archive.ListFilesAtRun(runs[1].Id(), "")
+	if err != nil {
+		t.Errorf("Unexpected error while listing files: %s", err)
+	}
+	if len(files) != 1 || files[0].Hash() != "h2" {
+		t.Errorf("Expected only /dir/file1 with hash h2 in second run, got %d files", len(files))
+	}
+}
+
+func TestUpgradeArchiveHistory(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	archive.AddFile(&ArchivedFile{filename: "/file1", hash: "h1", amazonId: "a1"})
+	archive.AddFile(&ArchivedFile{filename: "/file1", hash: "h2", amazonId: "a2"})
+
+	if err := archive.ensureHistory(); err != nil {
+		t.Errorf("Unexpected error while importing history: %s", err)
+	}
+
+	runs, err := archive.ListRuns()
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("Expected a single run for the existing files")
+	}
+
+	files, err := archive.ListFilesAtRun(runs[0].Id(), "")
+	if err != nil {
+		t.Errorf("Unexpected error while listing files: %s", err)
+	}
+	if len(files) != 1 || files[0].Hash() != "h2" {
+		t.Errorf("Expected the current version of /file1 in the imported run")
+	}
+}
+
+func TestAddAndFindFileStat(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	if _, _, err = archive.FindFileStat("hello.txt"); err == nil {
+		t.Errorf("Expected error when searching for stat in empty archive but got no error.")
+	}
+
+	stat := &FileStat{size: 1024, mtime: time.Now().UnixNano(), inode: 1 << 63, device: 42}
+	if err = archive.AddFileStat("hello.txt", "h12345", stat); err != nil {
+		t.Errorf("Stat should have been added, but got error: %s", err)
+	}
+
+	hash, found, err := archive.FindFileStat("hello.txt")
+	if err != nil {
+		t.Errorf("Should be able to find stat but got error: %s", err)
+	} else if hash != "h12345" || !found.Equal(stat) {
+		t.Errorf("Stat retrieved via FindFileStat is not the same as the one that was added.")
+	}
+}
+
+func TestEncryptionMetadata(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	salt, err := archive.EncryptionSalt()
+	if err != nil || len(salt) != saltSize {
+		t.Fatalf("Expected a salt of %d bytes, got %d (%v)", saltSize, len(salt), err)
+	}
+	if again, _ := archive.EncryptionSalt(); !reflect.DeepEqual(salt, again) {
+		t.Errorf("Salt should stay the same once created")
+	}
+
+	encrypted := &UploadRecord{hash: "h1", amazonId: "a1", keyId: "0123456789abcdef", nonceScheme: nonceScheme, encryptionVersion: encryptionVersion}
+	archive.AddUpload(encrypted)
+	archive.AddUpload(&UploadRecord{hash: "h2", amazonId: "a2"})
+
+	upload, err := archive.FindUpload("h1", "a1")
+	if err != nil {
+		t.Fatalf("Should be able to find upload but got error: %s", err)
+	}
+	if !upload.Encrypted() || upload.KeyId() != encrypted.KeyId() || upload.NonceScheme() != nonceScheme || upload.EncryptionVersion() != encryptionVersion {
+		t.Errorf("Encryption of upload retrieved via FindUpload is not the same as the one that was added.")
+	}
+
+	if upload, err := archive.FindUpload("h2", "a2"); err != nil || upload.Encrypted() {
+		t.Errorf("Expected upload a2 to be found and not to be encrypted")
+	}
+	if _, err := archive.FindUpload("h1", "a3"); err == nil {
+		t.Errorf("Expected error when searching for an unknown upload but got no error.")
+	}
+}
+
+func TestBundleMember(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	archive.AddUpload(&UploadRecord{hash: "bundle", amazonId: "a1", treeHash: "t1", size: 100})
+	archive.AddUpload(&UploadRecord{hash: "h1", amazonId: "a1", codec: "gzip"})
+	archive.AddUpload(&UploadRecord{hash: "h2", amazonId: "a1"})
+	member := &BundleMember{hash: "h1", amazonId: "a1", offset: 12, length: 30, treeHash: "t2"}
+	if err := archive.AddBundleMember(member); err != nil {
+		t.Fatalf("Unable to add bundle member: %s", err)
+	}
+
+	found, err := archive.FindBundleMember("h1", "a1")
+	if err != nil {
+		t.Fatalf("Should be able to find bundle member but got error: %s", err)
+	}
+	if !reflect.DeepEqual(found, member) {
+		t.Errorf("Bundle member retrieved via FindBundleMember is not the same as the one that was added.")
+	}
+	if _, err := archive.FindBundleMember("h2", "a1"); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for content not in a bundle, got %v", err)
+	}
+
+	if upload, err := archive.FindUpload("h1", "a1"); err != nil || upload.Codec() != "gzip" {
+		t.Errorf("Expected to find the upload of h1 in a1")
+	}
+	if upload, err := archive.FindUpload("bundle", "a1"); err != nil || upload.Size() != 100 {
+		t.Errorf("Expected to find the upload of the bundle in a1")
+	}
+
+	if err := archive.DeleteUpload("a1"); err != nil {
+		t.Fatalf("Unable to delete upload: %s", err)
+	}
+	if _, err := archive.FindBundleMember("h1", "a1"); err == nil {
+		t.Errorf("Expected bundle members to be deleted along with their bundle")
+	}
+}
+
+func TestChunks(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	chunks := []*Chunk{{hash: "c1", length: 10}, {hash: "c2", length: 20}, {hash: "c1", length: 10}}
+	if err := archive.AddChunks("h1", chunks); err != nil {
+		t.Fatalf("Unable to add chunks: %s", err)
+	}
+	archive.AddUpload(&UploadRecord{hash: "h1", amazonId: chunkedArchiveId})
+	archive.AddUpload(&UploadRecord{hash: "c1", amazonId: "a1"})
+	archive.AddUpload(&UploadRecord{hash: "c2", amazonId: "a2"})
+
+	found, err := archive.ListChunks("h1")
+	if err != nil || !reflect.DeepEqual(found, chunks) {
+		t.Errorf("Chunks retrieved via ListChunks are not the same as the ones that were added (%v)", err)
+	}
+	if found, _ := archive.ListChunks("h2"); len(found) != 0 {
+		t.Errorf("Expected no chunks for content that isn't chunked")
+	}
+
+	if amazonId, err := archive.FindChunkAmazonId("c2"); err != nil || amazonId != "a2" {
+		t.Errorf("Expected chunk c2 to be found in a2, got %s (%v)", amazonId, err)
+	}
+	if _, err := archive.FindChunkAmazonId("h1"); err != sql.ErrNoRows {
+		t.Errorf("Expected content stored as chunks not to be found as chunk, got %v", err)
+	}
+
+	// content is uploaded again once one of its chunks is gone
+	archive.DeleteUpload("a1")
+	if _, err := archive.FindAmazonIdByHash("h1"); err == nil {
+		t.Errorf("Expected content to be forgotten when one of its chunks is")
+	}
+}
+
+func TestListAllAndDeleteFileVersions(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	archive.AddUpload(&UploadRecord{hash: "h1", amazonId: "a1"})
+	var runs []*Run
+	for _, files := range []map[string]string{{"/b": "h1", "/a": "h1"}, {"/a": "h2"}} {
+		run, _ := archive.StartRun()
+		for filename, hash := range files {
+			archive.AddFileVersion(run, filename, hash, 10)
+		}
+		runs = append(runs, run)
+	}
+
+	versions, err := archive.ListAllVersions()
+	if err != nil {
+		t.Fatalf("Unexpected error while listing versions: %s", err)
+	}
+	expected := []FileVersion{
+		{"/a", "h2", "", runs[1].Id(), runs[1].Id(), 10},
+		{"/a", "h1", "a1", runs[0].Id(), runs[0].Id(), 10},
+		{"/b", "h1", "a1", runs[0].Id(), runs[0].Id(), 10},
+	}
+	if len(versions) != len(expected) {
+		t.Fatalf("Expected %d versions, got %d", len(expected), len(versions))
+	}
+	for i, version := range versions {
+		if *version != expected[i] {
+			t.Errorf("Expected version %v, got %v", expected[i], *version)
+		}
+	}
+
+	if err := archive.DeleteFileVersion(versions[1]); err != nil {
+		t.Errorf("Version should have been deleted, but got error: %s", err)
+	}
+	versions, _ = archive.ListVersions("/a")
+	if len(versions) != 1 || versions[0].Hash() != "h2" {
+		t.Errorf("Expected only the newest version of /a to be left, got %d versions", len(versions))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/rdwilliamson/aws/glacier"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+/**
+ * Backend stores archives in vaults. It follows the model of
+ * Glacier: archives are retrieved and vaults are listed through
+ * jobs, and large archives are uploaded in parts. Jobs, multipart
+ * uploads and inventories are described using the types of the
+ * glacier package.
+ */
+type Backend interface {
+	// EnsureVault creates a vault in case it doesn't exist yet
+	EnsureVault(vault string) error
+
+	// UploadArchive stores an archive and returns its id. The hashes
+	// of the archive may be passed if known, otherwise they are nil.
+	UploadArchive(vault string, archive io.ReadSeeker, description string, hashes *ArchiveHashes) (string, error)
+	DeleteArchive(vault, archiveId string) error
+
+	InitiateMultipart(vault string, partSize int64, description string) (string, error)
+	UploadMultipart(vault, uploadId string, start int64, body io.ReadSeeker) error
+	// CompleteMultipart assembles the uploaded parts to an archive and returns its id
+	CompleteMultipart(vault, uploadId, treeHash string, size int64) (string, error)
+	AbortMultipart(vault, uploadId string) error
+	ListMultipartUploads(vault string) ([]glacier.Multipart, error)
+	// ListMultipartParts returns the hex encoded tree hashes by offset
+	// of all parts received for a multipart upload
+	ListMultipartParts(vault, uploadId string) (map[int64]string, error)
+
+	InitiateRetrievalJob(vault, archiveId, description string) (string, error)
+	InitiateInventoryJob(vault, description string) (string, error)
+	DescribeJob(vault, jobId string) (*glacier.Job, error)
+	ListJobs(vault string) ([]glacier.Job, error)
+	// GetRetrievalJob returns the bytes start up to and including end of
+	// the output of a retrieval job, along with their tree hash if known
+	GetRetrievalJob(vault, jobId string, start, end int64) (io.ReadCloser, string, error)
+	GetInventoryJob(vault, jobId string) (*glacier.Inventory, error)
+}
+
+/**
+ * NewBackend creates the backend configured for a backup
+ */
+func NewBackend(backup *BackupConfig) (Backend, error) {
+	client, err := newHttpClient(backup)
+	if err != nil {
+		return nil, err
+	}
+
+	switch backup.Backend {
+	case "glacier":
+		return NewGlacierBackend(backup.AwsSecret, backup.AwsAccess, backup.Region.Region, backup.Endpoint, client)
+	case "directory":
+		return NewDirectoryBackend(backup.Directory), nil
+	case "s3":
+		return NewS3Backend(backup.Endpoint, backup.Bucket, backup.AwsSecret, backup.AwsAccess, backup.Region.Region, client), nil
+	}
+	return nil, fmt.Errorf("Unknown backend `%s`", backup.Backend)
+}
+
+/**
+ * newHttpClient creates the http client configured for a backup.
+ * Returns nil if nothing is configured, so the default client is used.
+ */
+func newHttpClient(backup *BackupConfig) (*http.Client, error) {
+	if backup.Timeout == 0 && backup.Proxy == "" && backup.CaFile == "" {
+		return nil, nil
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+
+	if backup.Proxy != "" {
+		proxy, err := url.Parse(backup.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy `%s`: %s", backup.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if backup.CaFile != "" {
+		pem, err := ioutil.ReadFile(backup.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in `%s`", backup.CaFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(backup.Timeout) * time.Second,
+	}, nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// catalogFormats are the formats catalog entries can be written in
+var catalogFormats = []string{"table", "csv", "json"}
+
+/**
+ * CatalogEntry is a file in the catalog of a backup
+ */
+type CatalogEntry struct {
+	Filename string `json:"filename"`
+	// Hash is the current content of the file, or
+	// the last content it had if it was deleted
+	Hash     string     `json:"hash"`
+	AmazonId string     `json:"amazon_id,omitempty"`
+	Uploaded *time.Time `json:"uploaded,omitempty"`
+	// Size is the size of the file, zero if unknown
+	Size     int64 `json:"size"`
+	Versions int   `json:"versions"`
+	// FirstSeen and LastSeen are the start of the
+	// first and last run the file was present in
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+	Deleted   bool       `json:"deleted"`
+}
+
+/**
+ * CatalogQuery selects files from the catalog. A file has to
+ * match all criteria that are set.
+ */
+type CatalogQuery struct {
+	// Paths are files or directories, as backed up
+	// or relative to the backup root
+	Paths []string
+	// Globs are gitignore style patterns like includes and excludes,
+	// matched against the path relative to the backup root
+	Globs []string
+	// Hash is matched against the start of the hash of every
+	// version of files
+	Hash string
+	// Deleted selects files that are deleted, and
+	// Current files that are not
+	Deleted bool
+	Current bool
+	// Run selects the files as they were during a run, 0 for their latest version
+	Run int64
+}
+
+/**
+ * catalogFile gathers what the archive knows about a filename
+ */
+type catalogFile struct {
+	current  string
+	deleted  string
+	versions []*FileVersion
+}
+
+/**
+ * BrowseCatalog returns the files in the catalog matching a query,
+ * ordered by filename
+ * @param root string Root path of the backup
+ * @return ([]*CatalogEntry, error)
+ */
+func BrowseCatalog(archive *archive, root string, query *CatalogQuery) ([]*CatalogEntry, error) {
+	globs, err := compileGlobs(query.Globs)
+	if err != nil {
+		return nil, err
+	}
+
+	runs, err := archive.ListRuns()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list runs: %s", err)
+	}
+	started := make(map[int64]time.Time)
+	for _, run := range runs {
+		started[run.Id()] = run.Started()
+	}
+
+	catalog := make(map[string]*catalogFile)
+	var filenames []string
+	get := func(filename string) *catalogFile {
+		file, ok := catalog[filename]
+		if !ok {
+			file = &catalogFile{}
+			catalog[filename] = file
+			filenames = append(filenames, filename)
+		}
+		return file
+	}
+
+	files, err := archive.ListAllFiles()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list files: %s", err)
+	}
+	for _, file := range files {
+		if file.IsDeleted() {
+			get(file.Filename()).deleted = file.Hash()
+		} else {
+			get(file.Filename()).current = file.Hash()
+		}
+	}
+
+	versions, err := archive.ListAllVersions()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list versions: %s", err)
+	}
+	for _, version := range versions {
+		file := get(version.Filename())
+		file.versions = append(file.versions, version)
+	}
+
+	uploads, err := archive.ListUploads()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list uploads: %s", err)
+	}
+	uploaded := make(map[string]*UploadRecord)
+	for _, upload := range uploads {
+		if _, ok := uploaded[upload.Hash()]; !ok {
+			uploaded[upload.Hash()] = upload
+		}
+	}
+
+	sort.Strings(filenames)
+	var entries []*CatalogEntry
+	for _, filename := range filenames {
+		entry := newCatalogEntry(filename, catalog[filename], query.Run)
+		if entry == nil || !query.matches(entry, catalog[filename], root, globs) {
+			continue
+		}
+
+		// versions are ordered newest first
+		if versions := catalog[filename].versions; len(versions) > 0 {
+			entry.FirstSeen = timeOfRun(started, versions[len(versions)-1].FirstRun())
+			entry.LastSeen = timeOfRun(started, versions[0].LastRun())
+		}
+		if upload, ok := uploaded[entry.Hash]; ok {
+			entry.AmazonId = upload.AmazonId()
+			if !upload.Uploaded().IsZero() {
+				when := upload.Uploaded()
+				entry.Uploaded = &when
+			}
+		}
+		// versions recorded before their size was kept
+		if hash, stat, err := archive.FindFileStat(filename); err == nil && hash == entry.Hash && entry.Size == 0 {
+			entry.Size = stat.Size()
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+/**
+ * newCatalogEntry creates the entry of a file, or returns nil
+ * if the file wasn't present during the given run
+ * @param run int64 Run to take the content of the file from, 0 for its latest version
+ */
+func newCatalogEntry(filename string, file *catalogFile, run int64) *CatalogEntry {
+	entry := &CatalogEntry{
+		Filename: filename,
+		Hash:     file.current,
+		Versions: len(file.versions),
+		Deleted:  file.current == "",
+	}
+	if run > 0 {
+		entry.Hash = ""
+		for _, version := range file.versions {
+			if version.FirstRun() <= run && version.LastRun() >= run {
+				entry.Hash = version.Hash()
+			}
+		}
+		if entry.Hash == "" {
+			return nil
+		}
+	} else if entry.Deleted {
+		entry.Hash = file.deleted
+		if len(file.versions) > 0 {
+			entry.Hash = file.versions[0].Hash()
+		}
+	}
+	for _, version := range file.versions {
+		if version.Hash() == entry.Hash && version.Size() > 0 {
+			entry.Size = version.Size()
+			break
+		}
+	}
+	return entry
+}
+
+/**
+ * matches checks if an entry matches the query
+ * @param globs globs The compiled globs of the query
+ */
+func (q *CatalogQuery) matches(entry *CatalogEntry, file *catalogFile, root string, globs globs) bool {
+	if (q.Deleted || q.Current) && !(q.Deleted && entry.Deleted) && !(q.Current && !entry.Deleted) {
+		return false
+	}
+
+	if len(q.Paths) > 0 && len(selectFiles([]*ArchivedFile{{filename: entry.Filename}}, root, q.Paths)) == 0 {
+		return false
+	}
+
+	if len(q.Globs) > 0 {
+		rel, err := filepath.Rel(root, entry.Filename)
+		if err != nil {
+			rel = entry.Filename
+		}
+		if !globs.MatchOrParent(filepath.ToSlash(rel)) {
+			return false
+		}
+	}
+
+	if q.Hash != "" {
+		matched := strings.HasPrefix(entry.Hash, q.Hash)
+		for _, version := range file.versions {
+			matched = matched || strings.HasPrefix(version.Hash(), q.Hash)
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+/**
+ * timeOfRun returns when a run started, or nil if the run is unknown
+ */
+func timeOfRun(started map[int64]time.Time, run int64) *time.Time {
+	when, ok := started[run]
+	if !ok {
+		return nil
+	}
+	return &when
+}
+
+/**
+ * writeCatalog writes catalog entries in one of the catalogFormats
+ */
+func writeCatalog(w io.Writer, entries []*CatalogEntry, format string) error {
+	header := []string{"filename", "hash", "amazon id", "uploaded", "size", "versions", "first seen", "last seen", "deleted"}
+	record := func(entry *CatalogEntry) []string {
+		return []string{
+			entry.Filename,
+			entry.Hash,
+			entry.AmazonId,
+			formatCatalogTime(entry.Uploaded),
+			strconv.FormatInt(entry.Size, 10),
+			strconv.Itoa(entry.Versions),
+			formatCatalogTime(entry.FirstSeen),
+			formatCatalogTime(entry.LastSeen),
+			strconv.FormatBool(entry.Deleted),
+		}
+	}
+
+	switch format {
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "%s\n", strings.ToUpper(strings.Join(header, "\t")))
+		for _, entry := range entries {
+			fmt.Fprintf(tw, "%s\n", strings.Join(record(entry), "\t"))
+		}
+		return tw.Flush()
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(header)
+		for _, entry := range entries {
+			cw.Write(record(entry))
+		}
+		cw.Flush()
+		return cw.Error()
+	case "json":
+		if entries == nil {
+			entries = []*CatalogEntry{}
+		}
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", data)
+		return err
+	}
+	return fmt.Errorf("Unknown format `%s`, supported are: %s", format, strings.Join(catalogFormats, ", "))
+}
+
+/**
+ * validCatalogFormat checks if entries can be written in a format
+ */
+func validCatalogFormat(format string) bool {
+	for _, f := range catalogFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * formatCatalogTime formats a time for table and CSV output,
+ * empty if there is no time
+ */
+func formatCatalogTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+/**
+ * runList lists the files in the catalog of a single backup,
+ * optionally limited to the paths given on the command line
+ * @param args []string Command line arguments following `list`
+ */
+func runList(config *Config, args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	name := flags.String("backup", "", "Name of the backup to list the files of")
+	run := flags.Int64("run", 0, "List files as they were during this run instead of their current version")
+	deleted := flags.Bool("deleted", false, "Only list deleted files")
+	all := flags.Bool("all", false, "List deleted files too")
+	format := flags.String("format", "table", "Output format: "+strings.Join(catalogFormats, ", "))
+	flags.Parse(args)
+
+	query := &CatalogQuery{
+		Paths:   flags.Args(),
+		Run:     *run,
+		Deleted: *deleted || *all,
+		Current: !*deleted,
+	}
+	browseCatalog(config, *name, query, *format)
+}
+
+/**
+ * runFind searches the catalog of a single backup for files
+ * matching the globs given on the command line or a hash,
+ * deleted files included. Globs follow the same rules as
+ * includes and excludes.
+ * @param args []string Command line arguments following `find`
+ */
+func runFind(config *Config, args []string) {
+	flags := flag.NewFlagSet("find", flag.ExitOnError)
+	name := flags.String("backup", "", "Name of the backup to search")
+	hash := flags.String("hash", "", "Find files that have or had content with this hash, or hash prefix")
+	deleted := flags.Bool("deleted", false, "Only find deleted files")
+	format := flags.String("format", "table", "Output format: "+strings.Join(catalogFormats, ", "))
+	flags.Parse(args)
+
+	if flags.NArg() == 0 && *hash == "" {
+		exitf(exitUsage, "Supply a glob or a hash to find")
+	}
+	if _, err := compileGlobs(flags.Args()); err != nil {
+		exitf(exitUsage, "%s", err)
+	}
+
+	query := &CatalogQuery{
+		Globs:   flags.Args(),
+		Hash:    strings.ToLower(*hash),
+		Deleted: *deleted,
+	}
+	browseCatalog(config, *name, query, *format)
+}
+
+/**
+ * browseCatalog prints the files in the catalog of a backup matching a query,
+ * exits with exitProblems if there are none so scripts can tell if a file
+ * is backed up
+ */
+func browseCatalog(config *Config, name string, query *CatalogQuery, format string) {
+	if !validCatalogFormat(format) {
+		exitf(exitUsage, "Unknown format `%s`, supported are: %s", format, strings.Join(catalogFormats, ", "))
+	}
+
+	backup, err := config.FindBackup(name)
+	if err != nil {
+		exitf(exitUsage, "%s", err)
+	}
+
+	archive, err := NewReadOnlyArchive(backup.Db)
+	if err != nil {
+		log.Fatalf("Error opening archive: %s", err)
+	}
+
+	entries, err := BrowseCatalog(archive, backup.Path, query)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	if err := writeCatalog(os.Stdout, entries, format); err != nil {
+		log.Fatalf("Unable to write catalog: %s", err)
+	}
+
+	if len(entries) == 0 {
+		os.Exit(exitProblems)
+	}
+}
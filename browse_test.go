@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBrowseCatalog(t *testing.T) {
+	config, backup, _, server, root := newFakeGlacierBackup(t)
+	defer os.RemoveAll(root)
+	defer server.Close()
+
+	if err := runBackup(config, backup, false); err != nil {
+		t.Fatalf("First backup failed: %s", err)
+	}
+	data := backup.Path
+	ioutil.WriteFile(filepath.Join(data, "file1.txt"), []byte("The content of file1 has changed\n"), 0644)
+	os.Remove(filepath.Join(data, "sub", "file2.txt"))
+	copyFile(filepath.Join(data, "file3.txt"), filepath.Join(data, "sub", "copy-of-file3.txt"))
+	if err := runBackup(config, backup, false); err != nil {
+		t.Fatalf("Second backup failed: %s", err)
+	}
+
+	archive, err := NewReadOnlyArchive(backup.Db)
+	if err != nil {
+		t.Fatalf("Unable to open archive: %s", err)
+	}
+	runs, _ := archive.ListRuns()
+	original, _ := NewFile("filesets/fileset1/file1.txt").Hash()
+
+	tests := []struct {
+		query    *CatalogQuery
+		expected []string
+	}{
+		{&CatalogQuery{Current: true}, []string{"file1.txt", "file3.txt", "sub/copy-of-file3.txt", "sub/file1.bin"}},
+		{&CatalogQuery{Current: true, Paths: []string{"sub"}}, []string{"sub/copy-of-file3.txt", "sub/file1.bin"}},
+		{&CatalogQuery{Deleted: true}, []string{"sub/file2.txt"}},
+		{&CatalogQuery{Globs: []string{"*.txt"}}, []string{"file1.txt", "file3.txt", "sub/copy-of-file3.txt", "sub/file2.txt"}},
+		{&CatalogQuery{Globs: []string{"sub/*2*"}}, []string{"sub/file2.txt"}},
+		{&CatalogQuery{Globs: []string{"/file1.*"}}, []string{"file1.txt"}},
+		{&CatalogQuery{Globs: []string{"file1.*"}}, []string{"file1.txt", "sub/file1.bin"}},
+		{&CatalogQuery{Globs: []string{"**/sub/**"}, Current: true}, []string{"sub/copy-of-file3.txt", "sub/file1.bin"}},
+		{&CatalogQuery{Globs: []string{"sub/"}}, []string{"sub/copy-of-file3.txt", "sub/file1.bin", "sub/file2.txt"}},
+		{&CatalogQuery{Globs: []string{"file1.txt/"}}, nil},
+		{&CatalogQuery{Hash: original[:8]}, []string{"file1.txt"}},
+		{&CatalogQuery{Run: runs[0].Id()}, []string{"file1.txt", "file3.txt", "sub/file1.bin", "sub/file2.txt"}},
+		{&CatalogQuery{Globs: []string{"*.csv"}}, nil},
+	}
+	for _, test := range tests {
+		entries, err := BrowseCatalog(archive, data, test.query)
+		if err != nil {
+			t.Fatalf("Unable to browse catalog: %s", err)
+		}
+		var found []string
+		for _, entry := range entries {
+			rel, _ := filepath.Rel(data, entry.Filename)
+			found = append(found, rel)
+		}
+		if len(found) != len(test.expected) || !compareInclusions(found, test.expected) {
+			t.Errorf("Expected %v for %+v, got %v", test.expected, test.query, found)
+		}
+	}
+
+	if _, err := BrowseCatalog(archive, data, &CatalogQuery{Globs: []string{"/"}}); err == nil {
+		t.Errorf("Expected error for an invalid glob")
+	}
+
+	entries, _ := BrowseCatalog(archive, data, &CatalogQuery{Paths: []string{"file1.txt"}})
+	if len(entries) != 1 {
+		t.Fatalf("Expected a single entry for file1.txt, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.Versions != 2 || entry.Size != 33 || entry.Deleted || entry.AmazonId == "" || entry.Uploaded == nil {
+		t.Errorf("Expected an uploaded file of 33 bytes with 2 versions, got %+v", entry)
+	}
+	if entry.FirstSeen == nil || !entry.FirstSeen.Equal(runs[0].Started()) || entry.LastSeen == nil || !entry.LastSeen.Equal(runs[1].Started()) {
+		t.Errorf("Expected file1.txt to be seen from the first to the last run, got %v and %v", entry.FirstSeen, entry.LastSeen)
+	}
+
+	entries, _ = BrowseCatalog(archive, data, &CatalogQuery{Run: runs[0].Id(), Paths: []string{"file1.txt"}})
+	if len(entries) != 1 || entries[0].Hash != original || entries[0].Size != 26 {
+		t.Errorf("Expected the original content of file1.txt in the first run, got %+v", entries)
+	}
+
+	entries, _ = BrowseCatalog(archive, data, &CatalogQuery{Deleted: true})
+	if len(entries) != 1 || !entries[0].Deleted || entries[0].Size != 10 || entries[0].AmazonId == "" {
+		t.Errorf("Expected the deleted file2.txt of 10 bytes, got %+v", entries)
+	}
+}
+
+func TestWriteCatalog(t *testing.T) {
+	entries := []*CatalogEntry{
+		{Filename: "/data/a, b.txt", Hash: "h1", AmazonId: "a1", Size: 10, Versions: 1},
+		{Filename: "/data/c.txt", Hash: "h2", Versions: 2, Deleted: true},
+	}
+
+	var table bytes.Buffer
+	if err := writeCatalog(&table, entries, "table"); err != nil {
+		t.Fatalf("Unable to write table: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "FILENAME") || !strings.HasPrefix(lines[1], "/data/a, b.txt  h1") {
+		t.Errorf("Expected a table with a header and 2 rows, got\n%s", table.String())
+	}
+
+	var out bytes.Buffer
+	if err := writeCatalog(&out, entries, "csv"); err != nil {
+		t.Fatalf("Unable to write CSV: %s", err)
+	}
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil || len(records) != 3 || records[1][0] != "/data/a, b.txt" || records[2][8] != "true" {
+		t.Errorf("Expected CSV with a header and 2 records, got %v (%v)", records, err)
+	}
+
+	out.Reset()
+	if err := writeCatalog(&out, entries, "json"); err != nil {
+		t.Fatalf("Unable to write JSON: %s", err)
+	}
+	var decoded []*CatalogEntry
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || len(decoded) != 2 || *decoded[1] != *entries[1] {
+		t.Errorf("Expected the entries as JSON, got %s (%v)", out.String(), err)
+	}
+
+	out.Reset()
+	if err := writeCatalog(&out, nil, "json"); err != nil || strings.TrimSpace(out.String()) != "[]" {
+		t.Errorf("Expected an empty JSON list, got %s (%v)", out.String(), err)
+	}
+
+	if err := writeCatalog(&out, entries, "xml"); err == nil {
+		t.Errorf("Expected error for unknown format")
+	}
+}
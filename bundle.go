@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// bundleMemberMagic marks the start of every member of a bundle archive
+const bundleMemberMagic = "GBM1"
+
+// bundleDescriptionPrefix starts the description of bundle archives,
+// it's followed by the hash of the bundle
+const bundleDescriptionPrefix = "gobackup bundle "
+
+/**
+ * Bundler packs small files and chunks of large files into bundle
+ * archives, so they don't each take up an archive in Glacier. A bundle is a sequence of
+ * members, each consisting of bundleMemberMagic, the length of the
+ * description as uint32, the description, the length of the content
+ * as uint64 and the content, all big endian. Descriptions and content
+ * are compressed and encrypted like those of single archives, so
+ * every member can be restored on its own with a ranged retrieval.
+ */
+type Bundler struct {
+	uploader  *Uploader
+	archive   *archive
+	run       *Run
+	threshold int64
+	size      int64
+	// chunkThreshold is the size in bytes from which files are
+	// split into chunks that are bundled, 0 to not chunk files
+	chunkThreshold int64
+	// chunkSize is the average size of chunks in bytes
+	chunkSize int
+	mu        sync.Mutex
+	current   *bundle
+	// uploading is the content of bundles being uploaded by hash
+	uploading map[string]*bundledContent
+}
+
+/**
+ * bundle is a bundle archive being filled in a temporary file
+ */
+type bundle struct {
+	tmp     *os.File
+	size    int64
+	hasher  hash.Hash
+	members []*bundledContent
+	byHash  map[string]*bundledContent
+}
+
+/**
+ * bundledContent is content in a bundle, along with all files
+ * that have that content and all chunked files it is a chunk of
+ */
+type bundledContent struct {
+	member  *BundleMember
+	upload  *UploadRecord
+	files   []*File
+	chunked []*chunkedFile
+}
+
+/**
+ * chunkedFile is a file being stored as chunks. It is recorded
+ * in the archive once none of its chunks is waiting to be uploaded.
+ */
+type chunkedFile struct {
+	file    *File
+	chunks  []*Chunk
+	waiting int
+}
+
+/**
+ * NewBundler creates a new bundler instance
+ * @param threshold int64 Size in bytes below which files are bundled
+ * @param size int64 Size in bytes a bundle is filled up to before it is uploaded
+ */
+func NewBundler(uploader *Uploader, archive *archive, run *Run, threshold, size int64) *Bundler {
+	return &Bundler{
+		uploader:  uploader,
+		archive:   archive,
+		run:       run,
+		threshold: threshold,
+		size:      size,
+		uploading: make(map[string]*bundledContent),
+	}
+}
+
+/**
+ * newBackupBundler returns the bundler configured for the backup,
+ * or nil if the backup neither bundles nor chunks files
+ */
+func newBackupBundler(uploader *Uploader, archive *archive, run *Run, backup *BackupConfig) *Bundler {
+	if backup.BundleThreshold == 0 && backup.ChunkThreshold == 0 {
+		return nil
+	}
+	bundler := NewBundler(uploader, archive, run, backup.BundleThreshold*1024, backup.BundleSize*1024*1024)
+	bundler.chunkThreshold = backup.ChunkThreshold * 1024 * 1024
+	bundler.chunkSize = int(backup.ChunkSize * 1024)
+	return bundler
+}
+
+/**
+ * Accepts checks if a file is small enough to be bundled.
+ * A nil bundler doesn't accept any file.
+ * @return bool
+ */
+func (b *Bundler) Accepts(file *File) bool {
+	if b == nil {
+		return false
+	}
+	stat, err := file.Stat()
+	return err == nil && stat.Size() < b.threshold
+}
+
+/**
+ * Add adds a file to the current bundle. Once the bundle reaches
+ * its size it is uploaded, and all files in it are recorded in
+ * the archive. Files with content that is already in the current
+ * bundle are not added again.
+ */
+func (b *Bundler) Add(file *File) error {
+	hash, err := file.Hash()
+	if err != nil {
+		return err
+	}
+
+	codec := b.uploader.compression.CodecFor(file.Filename())
+	description, err := b.uploader.describe(hash, file.Filename(), codec)
+	if err != nil {
+		return err
+	}
+
+	data := &bytes.Buffer{}
+	if err := b.uploader.encode(data, file.Filename(), codec); err != nil {
+		return fmt.Errorf("Unable to encode %s: %s", file.Filename(), err)
+	}
+	_, treeHash, err := copyWithTreeHash(ioutil.Discard, bytes.NewReader(data.Bytes()))
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	content, err := b.add(hash, description, codec, data.Bytes(), treeHash)
+	if err == nil {
+		content.files = append(content.files, file)
+	}
+	full := b.takeFull()
+	b.mu.Unlock()
+	if err != nil || full == nil {
+		return err
+	}
+	return b.upload(full)
+}
+
+/**
+ * AcceptsChunked checks if a file is large enough to be
+ * stored as chunks. A nil bundler doesn't accept any file.
+ * @return bool
+ */
+func (b *Bundler) AcceptsChunked(file *File) bool {
+	if b == nil || b.chunkThreshold == 0 {
+		return false
+	}
+	stat, err := file.Stat()
+	return err == nil && stat.Size() >= b.chunkThreshold
+}
+
+/**
+ * AddChunked splits a file into chunks and adds the chunks that
+ * are not stored yet to bundles. The file is recorded in the archive,
+ * along with its chunk manifest, once all its chunks are uploaded.
+ */
+func (b *Bundler) AddChunked(file *File) error {
+	if _, err := file.Hash(); err != nil {
+		return err
+	}
+
+	in, err := os.Open(file.Filename())
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	codec := b.uploader.compression.CodecFor(file.Filename())
+	chunked := &chunkedFile{file: file, waiting: 1}
+	chunker := NewChunker(in, b.chunkSize)
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		chunkHash := fmt.Sprintf("%x", sha1.Sum(data))
+		chunked.chunks = append(chunked.chunks, &Chunk{hash: chunkHash, length: int64(len(data))})
+		if _, err := b.archive.FindChunkAmazonId(chunkHash); err == nil {
+			continue
+		}
+
+		description, err := b.uploader.describe(chunkHash, "", codec)
+		if err != nil {
+			return err
+		}
+		encoded := &bytes.Buffer{}
+		if err := b.uploader.encodeFrom(encoded, bytes.NewReader(data), codec); err != nil {
+			return fmt.Errorf("Unable to encode chunk of %s: %s", file.Filename(), err)
+		}
+		_, treeHash, err := copyWithTreeHash(ioutil.Discard, bytes.NewReader(encoded.Bytes()))
+		if err != nil {
+			return err
+		}
+
+		b.mu.Lock()
+		content, err := b.add(chunkHash, description, codec, encoded.Bytes(), treeHash)
+		if err == nil {
+			content.chunked = append(content.chunked, chunked)
+			chunked.waiting++
+		}
+		full := b.takeFull()
+		b.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if full != nil {
+			if err := b.upload(full); err != nil {
+				return err
+			}
+		}
+	}
+
+	return b.release(chunked)
+}
+
+/**
+ * release marks a chunk of a chunked file as uploaded, and records
+ * the file in the archive once none of its chunks is waiting anymore
+ */
+func (b *Bundler) release(chunked *chunkedFile) error {
+	b.mu.Lock()
+	chunked.waiting--
+	done := chunked.waiting == 0
+	b.mu.Unlock()
+	if !done {
+		return nil
+	}
+
+	hash, _ := chunked.file.Hash()
+	if err := b.archive.AddChunks(hash, chunked.chunks); err != nil {
+		return err
+	}
+	upload := &UploadRecord{hash: hash, amazonId: chunkedArchiveId, uploaded: time.Now()}
+	if err := b.archive.AddUpload(upload); err != nil {
+		return err
+	}
+	log.Printf("Uploaded %s in %d chunks", chunked.file.Filename(), len(chunked.chunks))
+	addToArchive(b.archive, b.run, chunked.file, chunkedArchiveId)
+	return nil
+}
+
+/**
+ * add appends content to the current bundle, starting a new one
+ * if needed, and returns it. Content that is already in the current
+ * bundle or in a bundle being uploaded is not added again. Must be called with the lock held.
+ */
+func (b *Bundler) add(hash, description, codec string, data []byte, treeHash string) (*bundledContent, error) {
+	if b.current == nil {
+		tmp, err := ioutil.TempFile("", "gobackup-bundle")
+		if err != nil {
+			return nil, err
+		}
+		b.current = &bundle{tmp: tmp, hasher: sha1.New(), byHash: make(map[string]*bundledContent)}
+	}
+	current := b.current
+
+	if content, ok := current.byHash[hash]; ok {
+		return content, nil
+	}
+	if content, ok := b.uploading[hash]; ok {
+		return content, nil
+	}
+
+	header := &bytes.Buffer{}
+	header.WriteString(bundleMemberMagic)
+	binary.Write(header, binary.BigEndian, uint32(len(description)))
+	header.WriteString(description)
+	binary.Write(header, binary.BigEndian, uint64(len(data)))
+
+	out := io.MultiWriter(current.tmp, current.hasher)
+	_, err := out.Write(header.Bytes())
+	if err == nil {
+		_, err = out.Write(data)
+	}
+	if err != nil {
+		// the bundle is corrupt now, its files are uploaded by the next run
+		log.Printf("Discarding bundle of %d members: %s", len(current.members), err)
+		current.tmp.Close()
+		os.Remove(current.tmp.Name())
+		b.current = nil
+		return nil, err
+	}
+
+	upload := &UploadRecord{hash: hash}
+	b.uploader.setEncoding(upload, codec)
+	content := &bundledContent{
+		member: &BundleMember{
+			hash:     hash,
+			offset:   current.size + int64(header.Len()),
+			length:   int64(len(data)),
+			treeHash: treeHash,
+		},
+		upload: upload,
+	}
+	current.members = append(current.members, content)
+	current.byHash[hash] = content
+	current.size += int64(header.Len() + len(data))
+	return content, nil
+}
+
+/**
+ * takeFull returns the current bundle if it has reached its size,
+ * which is then no longer current. Must be called with the lock held.
+ */
+func (b *Bundler) takeFull() *bundle {
+	if b.current == nil || b.current.size < b.size {
+		return nil
+	}
+	return b.detach()
+}
+
+/**
+ * Flush uploads the current bundle, if any. Call it once all
+ * files are added. Flushing a nil bundler does nothing.
+ */
+func (b *Bundler) Flush() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	current := b.detach()
+	b.mu.Unlock()
+
+	if current == nil {
+		return nil
+	}
+	return b.upload(current)
+}
+
+/**
+ * upload uploads a bundle and records the bundle, the location of
+ * its members and the files with their content in the archive.
+ * The bundle itself is recorded under its own hash, its members
+ * under the amazon id of the bundle, without tree hash and size
+ * since they are not archives of their own.
+ */
+func (b *Bundler) upload(bundle *bundle) error {
+	defer os.Remove(bundle.tmp.Name())
+	err := bundle.tmp.Close()
+
+	var upload *UploadRecord
+	hash := fmt.Sprintf("%x", bundle.hasher.Sum(nil))
+	if err == nil {
+		upload, err = b.uploader.upload(b.uploader.vault, bundle.tmp.Name(), hash, bundleDescriptionPrefix+hash, nil)
+	}
+	if err != nil {
+		b.forget(bundle)
+		return fmt.Errorf("Upload of bundle of %d members failed: %s", len(bundle.members), err)
+	}
+	log.Printf("Uploaded bundle of %d members", len(bundle.members))
+	if err := b.archive.AddUpload(upload); err != nil {
+		log.Printf("Could not add upload of bundle to archive: %s", err)
+	}
+
+	var recorded []*bundledContent
+	for _, content := range bundle.members {
+		content.member.amazonId = upload.AmazonId()
+		if err := b.archive.AddBundleMember(content.member); err != nil {
+			log.Printf("Could not add content %s to bundle in archive: %s", content.member.Hash(), err)
+			continue
+		}
+
+		content.upload.amazonId = upload.AmazonId()
+		content.upload.uploaded = upload.Uploaded()
+		if err := b.archive.AddUpload(content.upload); err != nil {
+			log.Printf("Could not add upload of content %s to archive: %s", content.member.Hash(), err)
+			continue
+		}
+		recorded = append(recorded, content)
+	}
+
+	// once forgotten no more files are added to the content, it's in the archive now
+	b.forget(bundle)
+	for _, content := range recorded {
+		for _, file := range content.files {
+			log.Printf("Uploaded %s in bundle", file.Filename())
+			addToArchive(b.archive, b.run, file, upload.AmazonId())
+		}
+		for _, chunked := range content.chunked {
+			if err := b.release(chunked); err != nil {
+				log.Printf("Could not add chunks of %s to archive: %s", chunked.file.Filename(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+/**
+ * detach takes the current bundle, which is then no longer current.
+ * Its content is kept track of until it is uploaded, so the same
+ * content isn't bundled again in the meantime. Must be called with
+ * the lock held.
+ */
+func (b *Bundler) detach() *bundle {
+	current := b.current
+	b.current = nil
+	if current != nil {
+		for hash, content := range current.byHash {
+			b.uploading[hash] = content
+		}
+	}
+	return current
+}
+
+/**
+ * forget stops keeping track of the content of a bundle being uploaded
+ */
+func (b *Bundler) forget(bundle *bundle) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for hash := range bundle.byHash {
+		delete(b.uploading, hash)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+/**
+ * BundleMember is the content with a given hash stored
+ * as part of a bundle archive in Glacier
+ */
+type BundleMember struct {
+	hash     string
+	amazonId string
+	offset   int64
+	length   int64
+	treeHash string
+}
+
+func (b *BundleMember) Hash() string {
+	return b.hash
+}
+
+func (b *BundleMember) AmazonId() string {
+	return b.amazonId
+}
+
+/**
+ * Offset returns the position in bytes of the
+ * content from the start of the bundle archive
+ * @return int64
+ */
+func (b *BundleMember) Offset() int64 {
+	return b.offset
+}
+
+/**
+ * Length returns the number of bytes the
+ * content takes up in the bundle archive
+ * @return int64
+ */
+func (b *BundleMember) Length() int64 {
+	return b.length
+}
+
+/**
+ * TreeHash returns the hex encoded SHA256 tree
+ * hash of the content as stored in the bundle
+ * @return string
+ */
+func (b *BundleMember) TreeHash() string {
+	return b.treeHash
+}
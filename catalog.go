@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"github.com/rdwilliamson/aws/glacier"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+ * runRebuildCatalog rebuilds the archive of a single backup
+ * from the inventory of its vault
+ * @param args []string Command line arguments following `rebuild-catalog`
+ */
+func runRebuildCatalog(config *Config, args []string) {
+	flags := flag.NewFlagSet("rebuild-catalog", flag.ExitOnError)
+	name := flags.String("backup", "", "Name of the backup to rebuild the catalog of")
+	poll := flags.Duration("poll", 15*time.Minute, "Interval to check for a completed inventory job")
+	wait := flags.Bool("wait", true, "Wait for the inventory job to complete")
+	flags.Parse(args)
+
+	backup, err := config.FindBackup(*name)
+	if err != nil {
+		exitf(exitUsage, "%s", err)
+	}
+
+	archive, err := NewArchive(backup.Db)
+	if err != nil {
+		log.Fatalf("Error creating archive: %s", err)
+	}
+
+	backend, err := NewBackend(backup)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	inventory, err := fetchInventory(backend, backup.Vault, *poll, *wait)
+	if err == errInventoryPending {
+		exitf(exitPending, "%s", err)
+	}
+	if err != nil {
+		log.Fatalf("Unable to retrieve inventory: %s", err)
+	}
+
+	encrypter, err := newBackupEncrypter(backup, archive)
+	if err != nil {
+		log.Fatalf("Unable to set up encryption: %s", err)
+	}
+
+	added, err := rebuildCatalog(archive, inventory, encrypter)
+	if err != nil {
+		log.Fatalf("Unable to rebuild catalog: %s", err)
+	}
+	log.Printf("Added %d of %d archives from the inventory of %s to the catalog", added, len(inventory.ArchiveList), inventory.InventoryDate)
+}
+
+/**
+ * rebuildCatalog adds all archives in a vault inventory to the archive.
+ * The hash and path of each archive are taken from its description.
+ * Archives are added from old to new, so for every path the most recently
+ * uploaded archive is current and older ones are marked as deleted.
+ * Archives uploaded before their description contained the hash are
+ * checked against the file on disk. If that file is gone or changed
+ * the tree hash is used as hash instead.
+ * Descriptions of encrypted archives are decrypted with the encrypter,
+ * without it only their content is added. The codec of compressed
+ * archives is taken from their description as well. Bundle archives
+ * are added as content only, since the files and chunks in them are only
+ * described inside the bundle. Files stored as chunks can therefore only
+ * be recovered from a snapshot of the catalog.
+ * @return int The number of archives added
+ */
+func rebuildCatalog(archive *archive, inventory *glacier.Inventory, encrypter *Encrypter) (int, error) {
+	archives := make(byCreationDate, len(inventory.ArchiveList))
+	copy(archives, inventory.ArchiveList)
+	sort.Sort(archives)
+
+	added := 0
+	for _, a := range archives {
+		upload := &UploadRecord{
+			amazonId: a.ArchiveId,
+			treeHash: a.SHA256TreeHash,
+			size:     a.Size,
+			uploaded: a.CreationDate,
+		}
+
+		description := a.ArchiveDescription
+		if strings.HasPrefix(description, bundleDescriptionPrefix) {
+			// the files in a bundle are only described inside the bundle itself
+			upload.hash = strings.TrimPrefix(description, bundleDescriptionPrefix)
+			if err := archive.AddUpload(upload); err != nil {
+				return added, err
+			}
+			log.Printf("Archive %s is a bundle, adding it without the files in it", a.ArchiveId)
+			added++
+			continue
+		}
+		if isEncryptedDescription(description) {
+			description = decryptArchiveDescription(a, upload, encrypter)
+		}
+
+		codec, description := parseDescribedCodec(description)
+		upload.codec = codec
+
+		hash, path := parseArchiveDescription(description)
+		if hash == "" && upload.Encrypted() {
+			hash = treeHashPrefix + a.SHA256TreeHash
+		} else if hash == "" {
+			hash = hashLocalFile(path, a.Size, a.SHA256TreeHash)
+		}
+		upload.hash = hash
+
+		if err := archive.AddUpload(upload); err != nil {
+			return added, err
+		}
+
+		if path == "" {
+			log.Printf("No path known for archive %s, adding content only", a.ArchiveId)
+			added++
+			continue
+		}
+
+		err := archive.AddFile(&ArchivedFile{
+			filename: path,
+			hash:     hash,
+			amazonId: a.ArchiveId,
+		})
+		if err != nil {
+			return added, err
+		}
+		added++
+	}
+
+	return added, nil
+}
+
+/**
+ * decryptArchiveDescription records the encryption of an archive in
+ * upload and returns its plaintext description. Returns an empty
+ * description if the description can not be decrypted.
+ */
+func decryptArchiveDescription(a glacier.Archive, upload *UploadRecord, encrypter *Encrypter) string {
+	version, keyId, err := describedKeyId(a.ArchiveDescription)
+	if err != nil {
+		log.Printf("Invalid description of encrypted archive %s: %s", a.ArchiveId, err)
+		return ""
+	}
+	upload.keyId = keyId
+	upload.nonceScheme = nonceScheme
+	upload.encryptionVersion = version
+
+	if encrypter == nil {
+		log.Printf("Archive %s is encrypted with key %s, but no passphrase or key file is configured", a.ArchiveId, keyId)
+		return ""
+	}
+	description, err := encrypter.DecryptDescription(a.ArchiveDescription)
+	if err != nil {
+		log.Printf("Unable to decrypt description of archive %s: %s", a.ArchiveId, err)
+		return ""
+	}
+	return description
+}
+
+/**
+ * hashLocalFile returns the hash of the file at path if it still has the
+ * given size and tree hash, i.e. is the content of an archive. Otherwise
+ * the tree hash, prefixed with treeHashPrefix, is returned.
+ */
+func hashLocalFile(path string, size int64, treeHash string) string {
+	unknown := treeHashPrefix + treeHash
+
+	f, err := os.Open(path)
+	if err != nil {
+		return unknown
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); err != nil || info.Size() != size {
+		return unknown
+	}
+
+	th := glacier.NewTreeHash()
+	hasher := sha1.New()
+	if _, err := io.Copy(io.MultiWriter(th, hasher), f); err != nil {
+		return unknown
+	}
+	th.Close()
+
+	if fmt.Sprintf("%x", th.TreeHash()) != treeHash {
+		return unknown
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil))
+}
+
+/**
+ * byCreationDate sorts glacier archives from old to new
+ */
+type byCreationDate []glacier.Archive
+
+func (b byCreationDate) Len() int           { return len(b) }
+func (b byCreationDate) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byCreationDate) Less(i, j int) bool { return b[i].CreationDate.Before(b[j].CreationDate) }
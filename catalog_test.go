@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rdwilliamson/aws/glacier"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRebuildCatalog(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	f, err := os.Open("filesets/fileset1/file1.txt")
+	if err != nil {
+		t.Fatalf("Could not open test file: %s", err)
+	}
+	th := glacier.NewTreeHash()
+	size, _ := io.Copy(th, f)
+	th.Close()
+	f.Close()
+
+	now := time.Now()
+	inventory := &glacier.Inventory{
+		ArchiveList: []glacier.Archive{
+			glacier.Archive{
+				ArchiveId:          "a2",
+				ArchiveDescription: archiveDescription("80256f39a9d308650ac90d9be9a72a9562454574", "filesets/fileset1/file3.txt"),
+				CreationDate:       now,
+			},
+			glacier.Archive{
+				ArchiveId:          "a1",
+				ArchiveDescription: archiveDescription("1111111111111111111111111111111111111111", "filesets/fileset1/file3.txt"),
+				CreationDate:       now.Add(-time.Hour),
+			},
+			glacier.Archive{
+				ArchiveId:          "a3",
+				ArchiveDescription: "filesets/fileset1/file1.txt",
+				CreationDate:       now,
+				Size:               size,
+				SHA256TreeHash:     fmt.Sprintf("%x", th.TreeHash()),
+			},
+			glacier.Archive{
+				ArchiveId:          "a4",
+				ArchiveDescription: "filesets/fileset1/gone.txt",
+				CreationDate:       now,
+				Size:               10,
+				SHA256TreeHash:     "t4",
+			},
+		},
+	}
+
+	added, err := rebuildCatalog(archive, inventory, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error while rebuilding catalog: %s", err)
+	}
+	if added != 4 {
+		t.Errorf("Expected 4 archives to be added, got %d", added)
+	}
+
+	expected := map[string]string{
+		"filesets/fileset1/file3.txt": "80256f39a9d308650ac90d9be9a72a9562454574",
+		"filesets/fileset1/file1.txt": "32d10c7b8cf96570ca04ce37f2a19d84240d3a89",
+		"filesets/fileset1/gone.txt":  treeHashPrefix + "t4",
+	}
+	for filename, hash := range expected {
+		file, err := archive.FindFileByFilename(filename)
+		if err != nil {
+			t.Errorf("Should be able to find `%s` but got error: %s", filename, err)
+			continue
+		}
+		if file.Hash() != hash {
+			t.Errorf("Hash for `%s` was expected to be `%s`, got `%s`", filename, hash, file.Hash())
+		}
+	}
+
+	if _, err = archive.FindAmazonIdByHash("1111111111111111111111111111111111111111"); err != nil {
+		t.Errorf("Older version of `filesets/fileset1/file3.txt` should still be known")
+	}
+
+	files, err := archive.ListFiles()
+	if err != nil {
+		t.Errorf("Unexpected error while listing files: %s", err)
+	}
+	if len(files) != 3 {
+		t.Errorf("Expected 3 current files, got %d", len(files))
+	}
+}
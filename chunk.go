@@ -0,0 +1,26 @@
+package main
+
+/**
+ * Chunk is a part of content that is stored as chunks,
+ * as listed in the chunk manifest of the content
+ */
+type Chunk struct {
+	hash   string
+	length int64
+}
+
+/**
+ * Hash returns the hash of the content of the chunk
+ * @return string
+ */
+func (c *Chunk) Hash() string {
+	return c.hash
+}
+
+/**
+ * Length returns the size of the chunk in bytes
+ * @return int64
+ */
+func (c *Chunk) Length() int64 {
+	return c.length
+}
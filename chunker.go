@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// gearTable maps every byte to a fixed pseudo random
+// number, it is the same for every run and platform
+var gearTable [256]uint64
+
+func init() {
+	for i := range gearTable {
+		sum := sha256.Sum256([]byte{byte(i)})
+		gearTable[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+}
+
+/**
+ * Chunker splits content into chunks at positions determined by the
+ * content itself, using a rolling gear hash over the last 64 bytes.
+ * Changing a part of the content therefore only changes the chunks
+ * around it, all other chunks stay the same. Chunks are between a
+ * quarter and four times the average size.
+ */
+type Chunker struct {
+	r    *bufio.Reader
+	min  int
+	max  int
+	bits uint
+}
+
+/**
+ * NewChunker creates a new chunker instance
+ * @param avg int Average size of the chunks in bytes, a power of two
+ */
+func NewChunker(r io.Reader, avg int) *Chunker {
+	var bits uint
+	for 1<<(bits+1) <= avg {
+		bits++
+	}
+	return &Chunker{
+		r:    bufio.NewReaderSize(r, 1024*1024),
+		min:  avg / 4,
+		max:  avg * 4,
+		bits: bits,
+	}
+}
+
+/**
+ * Next returns the next chunk of the content,
+ * or io.EOF once all content has been returned
+ * @return []byte
+ */
+func (c *Chunker) Next() ([]byte, error) {
+	var chunk []byte
+	var hash uint64
+	for len(chunk) < c.max {
+		b, err := c.r.ReadByte()
+		if err == io.EOF && len(chunk) > 0 {
+			return chunk, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		chunk = append(chunk, b)
+		hash = (hash << 1) + gearTable[b]
+		if len(chunk) >= c.min && hash>>(64-c.bits) == 0 {
+			return chunk, nil
+		}
+	}
+	return chunk, nil
+}
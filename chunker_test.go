@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+/**
+ * chunkHashes splits data with a chunker and returns the hashes of the chunks
+ */
+func chunkHashes(t *testing.T, data []byte, avg int) [][sha1.Size]byte {
+	var hashes [][sha1.Size]byte
+	var joined []byte
+	chunker := NewChunker(bytes.NewReader(data), avg)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unable to chunk data: %s", err)
+		}
+		if len(chunk) > avg*4 {
+			t.Errorf("Expected chunks of at most %d bytes, got %d", avg*4, len(chunk))
+		}
+		hashes = append(hashes, sha1.Sum(chunk))
+		joined = append(joined, chunk...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Errorf("Expected chunks to make up the data")
+	}
+	return hashes
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	hashes := chunkHashes(t, data, 8*1024)
+	if len(hashes) < 64 || len(hashes) > 256 {
+		t.Errorf("Expected about 128 chunks of 8 KiB on average, got %d", len(hashes))
+	}
+
+	// inserting data only changes the chunks around it
+	changed := append(append(append([]byte{}, data[:500000]...), []byte("inserted")...), data[500000:]...)
+	known := make(map[[sha1.Size]byte]bool)
+	for _, hash := range hashes {
+		known[hash] = true
+	}
+	different := 0
+	for _, hash := range chunkHashes(t, changed, 8*1024) {
+		if !known[hash] {
+			different++
+		}
+	}
+	if different == 0 || different > 3 {
+		t.Errorf("Expected 1 to 3 chunks to change, got %d", different)
+	}
+
+	if hashes := chunkHashes(t, nil, 8*1024); len(hashes) != 0 {
+		t.Errorf("Expected no chunks for empty data, got %d", len(hashes))
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// compressionCodecs are the supported compression codecs
+var compressionCodecs = []string{"gzip"}
+
+// defaultCompressSkip are the extensions of files that are already
+// compressed, used when a backup doesn't configure its own list
+var defaultCompressSkip = []string{
+	"7z", "avi", "bz2", "flac", "gif", "gz", "jpeg", "jpg", "m4a", "mkv", "mov", "mp3",
+	"mp4", "ogg", "png", "rar", "tgz", "webm", "webp", "xz", "zip", "zst",
+}
+
+/**
+ * CompressionPolicy decides which files are compressed before they
+ * are uploaded, based on their extension
+ */
+type CompressionPolicy struct {
+	codec string
+	skip  map[string]bool
+}
+
+/**
+ * NewCompressionPolicy creates a policy that compresses all files
+ * with codec, except those with one of the skipped extensions
+ * @param skip []string Extensions of files not to compress, with or
+ *                      without the leading dot. Case insensitive.
+ */
+func NewCompressionPolicy(codec string, skip []string) (*CompressionPolicy, error) {
+	if !validCodec(codec) {
+		return nil, fmt.Errorf("Unknown compression `%s`", codec)
+	}
+
+	policy := &CompressionPolicy{codec: codec, skip: make(map[string]bool)}
+	for _, ext := range skip {
+		policy.skip[strings.ToLower(strings.TrimPrefix(ext, "."))] = true
+	}
+	return policy, nil
+}
+
+/**
+ * newBackupCompressionPolicy creates the compression policy configured
+ * for a backup. Returns nil if the backup isn't compressed.
+ */
+func newBackupCompressionPolicy(backup *BackupConfig) (*CompressionPolicy, error) {
+	if backup.Compression == "" {
+		return nil, nil
+	}
+	skip := backup.CompressSkip
+	if len(skip) == 0 {
+		skip = defaultCompressSkip
+	}
+	return NewCompressionPolicy(backup.Compression, skip)
+}
+
+/**
+ * CodecFor returns the codec to compress a file with,
+ * or an empty string if it shouldn't be compressed
+ * @return string
+ */
+func (p *CompressionPolicy) CodecFor(filename string) string {
+	if p == nil {
+		return ""
+	}
+	if p.skip[strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))] {
+		return ""
+	}
+	return p.codec
+}
+
+/**
+ * validCodec checks if a codec is supported
+ */
+func validCodec(codec string) bool {
+	for _, c := range compressionCodecs {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * compressReader returns a reader of the compressed content of src
+ */
+func compressReader(codec string, src io.Reader) (io.ReadCloser, error) {
+	if !validCodec(codec) {
+		return nil, fmt.Errorf("Unknown compression `%s`", codec)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, src)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+/**
+ * decompressReader returns a reader of the decompressed content of src
+ */
+func decompressReader(codec string, src io.Reader) (io.ReadCloser, error) {
+	if !validCodec(codec) {
+		return nil, fmt.Errorf("Unknown compression `%s`", codec)
+	}
+	return gzip.NewReader(src)
+}
+
+/**
+ * describeArchive returns the description of an archive compressed with
+ * codec, which is the plain description prefixed by the codec.
+ * Paths too long to fit are left out.
+ * i.e. codec `gzip`, hash `h12345` and path `/tmp/foo.txt` becomes gzip h12345 "/tmp/foo.txt"
+ */
+func describeArchive(hash, path, codec string) string {
+	if codec == "" {
+		return archiveDescription(hash, path)
+	}
+	description := codec + " " + archiveDescription(hash, path)
+	if len(description) > maxDescriptionLength {
+		return codec + " " + hash
+	}
+	return description
+}
+
+/**
+ * parseDescribedCodec splits the codec an archive is compressed
+ * with from its description. The codec is empty for archives that
+ * are not compressed.
+ */
+func parseDescribedCodec(description string) (codec, rest string) {
+	parts := strings.SplitN(description, " ", 2)
+	if len(parts) == 2 && validCodec(parts[0]) && isSha1(strings.SplitN(parts[1], " ", 2)[0]) {
+		return parts[0], parts[1]
+	}
+	return "", description
+}
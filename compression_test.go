@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCompressionPolicy(t *testing.T) {
+	if _, err := NewCompressionPolicy("zstd", nil); err == nil {
+		t.Errorf("Expected error for unknown codec")
+	}
+
+	policy, err := NewCompressionPolicy("gzip", []string{"jpg", ".MP4", "Zip"})
+	if err != nil {
+		t.Fatalf("Unable to create compression policy: %s", err)
+	}
+
+	tests := map[string]string{
+		"/data/report.csv":    "gzip",
+		"/data/app.log":       "gzip",
+		"/data/Makefile":      "gzip",
+		"/data/photo.jpg":     "",
+		"/data/PHOTO.JPG":     "",
+		"/data/movie.mp4":     "",
+		"/data/archive.zip":   "",
+		"/data/jpg/notes.txt": "gzip",
+	}
+	for filename, expected := range tests {
+		if actual := policy.CodecFor(filename); actual != expected {
+			t.Errorf("Expected codec `%s` for %s, got `%s`", expected, filename, actual)
+		}
+	}
+
+	var none *CompressionPolicy
+	if codec := none.CodecFor("/data/report.csv"); codec != "" {
+		t.Errorf("Expected no codec without a policy, got `%s`", codec)
+	}
+}
+
+func TestCompressAndDecompress(t *testing.T) {
+	plain := []byte(strings.Repeat("2015-05-22 12:00:00 INFO all is well\n", 1000))
+
+	compressed, err := compressReader("gzip", bytes.NewReader(plain))
+	if err != nil {
+		t.Fatalf("Unable to compress: %s", err)
+	}
+	data, err := ioutil.ReadAll(compressed)
+	if err != nil {
+		t.Fatalf("Unable to compress: %s", err)
+	}
+	if len(data) >= len(plain)/10 {
+		t.Errorf("Expected repetitive content to compress at least 10x, got %d bytes from %d", len(data), len(plain))
+	}
+
+	decompressed, err := decompressReader("gzip", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Unable to decompress: %s", err)
+	}
+	if actual, err := ioutil.ReadAll(decompressed); err != nil || !bytes.Equal(actual, plain) {
+		t.Errorf("Decompressed content does not match the original (%v)", err)
+	}
+}
+
+func TestDescribeArchive(t *testing.T) {
+	hash := "32d10c7b8cf96570ca04ce37f2a19d84240d3a89"
+	tests := []struct {
+		path, codec, description string
+	}{
+		{"/tmp/foo.txt", "", hash + ` "/tmp/foo.txt"`},
+		{"/tmp/foo.txt", "gzip", "gzip " + hash + ` "/tmp/foo.txt"`},
+		{"/tmp/" + strings.Repeat("a", 1000), "gzip", "gzip " + hash},
+	}
+
+	for _, test := range tests {
+		description := describeArchive(hash, test.path, test.codec)
+		if description != test.description {
+			t.Errorf("Description for `%s` with codec `%s` was expected to be `%s`, got `%s`", test.path, test.codec, test.description, description)
+		}
+
+		codec, rest := parseDescribedCodec(description)
+		if codec != test.codec || rest != archiveDescription(hash, test.path) && rest != hash {
+			t.Errorf("Description `%s` was expected to give codec `%s`, got `%s` and `%s`", description, test.codec, codec, rest)
+		}
+	}
+
+	// paths of archives uploaded by older versions are left alone
+	for _, description := range []string{"gzip", "gzip /tmp/foo.txt", "/tmp/foo.txt"} {
+		if codec, rest := parseDescribedCodec(description); codec != "" || rest != description {
+			t.Errorf("Description `%s` should not have a codec, got `%s`", description, codec)
+		}
+	}
+}
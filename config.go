@@ -5,6 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/rdwilliamson/aws"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 /**
@@ -15,23 +20,86 @@ type Config struct {
 	Threads struct {
 		Hash   int
 		Upload int
+		Parts  int
 	}
 	Aws struct {
 		Secret string
 		Access string
 	}
-	Backup map[string]*struct {
-		Region    MyAwsRegion
-		Path      string
-		Db        string
-		Exclude   []string
-		Include   []string
-		AwsAccess string `gcfg:"aws-access"`
-		AwsSecret string `gcfg:"aws-secret"`
-		Vault     string
-	}
+	Backup map[string]*BackupConfig
+}
+
+/**
+ * BackupConfig is the configuration of
+ * a single [backup "name"] section
+ */
+type BackupConfig struct {
+	Region     MyAwsRegion
+	Path       string
+	Db         string
+	Exclude    []string
+	Include    []string
+	AwsAccess  string `gcfg:"aws-access"`
+	AwsSecret  string `gcfg:"aws-secret"`
+	Vault      string
+	PartSize   int64 `gcfg:"part-size"`
+	Backend    string
+	Directory  string
+	Endpoint   string
+	Bucket     string
+	Timeout    int
+	Proxy      string
+	CaFile     string `gcfg:"ca-file"`
+	Passphrase string
+	KeyFile    string `gcfg:"key-file"`
+	// Compression is the codec to compress files with before
+	// uploading them, empty to not compress
+	Compression  string
+	CompressSkip []string `gcfg:"compress-skip"`
+	// BundleThreshold is the size in KiB below which files are packed
+	// into bundle archives instead of uploaded one by one, 0 to not bundle
+	BundleThreshold int64 `gcfg:"bundle-threshold"`
+	// BundleSize is the size in MiB a bundle archive is filled up to
+	BundleSize int64 `gcfg:"bundle-size"`
+	// ChunkThreshold is the size in MiB from which files are split into
+	// chunks that are deduplicated on their own, 0 to not chunk
+	ChunkThreshold int64 `gcfg:"chunk-threshold"`
+	// ChunkSize is the average size in KiB of the chunks
+	ChunkSize int64 `gcfg:"chunk-size"`
+	// Retention is only applied by `prune`, see RetentionPolicy for
+	// how the rules combine and what a rule set to 0 means.
+	// KeepDeleted is the number of days versions of deleted files are kept
+	KeepDeleted int `gcfg:"keep-deleted"`
+	// KeepVersions is the number of versions kept of existing files,
+	// including the current one
+	KeepVersions int `gcfg:"keep-versions"`
+	// KeepDaily, KeepWeekly and KeepMonthly are the number of days,
+	// weeks and months of which the last run is kept
+	KeepDaily   int `gcfg:"keep-daily"`
+	KeepWeekly  int `gcfg:"keep-weekly"`
+	KeepMonthly int `gcfg:"keep-monthly"`
 }
 
+// defaultPartSize is the multipart part size in MiB used
+// when a backup doesn't configure one
+const defaultPartSize = 64
+
+// minS3PartSize is the smallest part size in MiB S3 accepts,
+// rounded up to the next valid part size
+const minS3PartSize = 8
+
+// defaultBundleSize is the size in MiB bundle archives are
+// filled up to when a backup doesn't configure one
+const defaultBundleSize = 16
+
+// defaultChunkSize is the average size in KiB of chunks
+// when a backup doesn't configure one
+const defaultChunkSize = 1024
+
+// defaultPartThreads is the number of parts of a single
+// file uploaded in parallel when not configured
+const defaultPartThreads = 4
+
 /**
  * MyAwsRegion is a simple wrapper for aws.Region
  * Allowing us to add a custom unmarshal method
@@ -76,12 +144,28 @@ func ReadConfig(configDef string) (*Config, error) {
 		return nil, fmt.Errorf("Need at least one upload thread")
 	}
 
+	if cfg.Threads.Parts < 0 {
+		return nil, fmt.Errorf("Number of part threads can not be negative")
+	}
+
+	if cfg.Threads.Parts == 0 {
+		cfg.Threads.Parts = defaultPartThreads
+	}
+
 	if len(cfg.Backup) == 0 {
 		return nil, errors.New("No configurations given")
 	}
 
 	for key, backup := range cfg.Backup {
-		if backup.Region.Region == nil {
+		switch backup.Backend {
+		case "":
+			backup.Backend = "glacier"
+		case "glacier", "directory", "s3":
+		default:
+			return nil, fmt.Errorf("Unknown backend `%s` for config `%s`", backup.Backend, key)
+		}
+
+		if backup.Backend != "directory" && backup.Region.Region == nil {
 			return nil, fmt.Errorf("No region supplied for config `%s`", key)
 		}
 
@@ -97,6 +181,83 @@ func ReadConfig(configDef string) (*Config, error) {
 			return nil, fmt.Errorf("No vault supplied for config `%s`", key)
 		}
 
+		if backup.PartSize == 0 {
+			backup.PartSize = defaultPartSize
+		}
+
+		if !validPartSize(backup.PartSize) {
+			return nil, fmt.Errorf("Part size for config `%s` must be a power of two between 1 and 4096 (MiB)", key)
+		}
+
+		if backup.Endpoint != "" && !validEndpoint(backup.Endpoint) {
+			return nil, fmt.Errorf("Endpoint for config `%s` must be a scheme and host, i.e. https://glacier.example.com", key)
+		}
+
+		if backup.Timeout < 0 {
+			return nil, fmt.Errorf("Timeout for config `%s` can not be negative", key)
+		}
+
+		if backup.Compression != "" && !validCodec(backup.Compression) {
+			return nil, fmt.Errorf("Unknown compression `%s` for config `%s`, supported are: %s", backup.Compression, key, strings.Join(compressionCodecs, ", "))
+		}
+
+		if backup.BundleThreshold < 0 || backup.BundleSize < 0 {
+			return nil, fmt.Errorf("Bundle threshold and size for config `%s` can not be negative", key)
+		}
+
+		if backup.BundleSize == 0 {
+			backup.BundleSize = defaultBundleSize
+		}
+
+		if backup.ChunkThreshold < 0 {
+			return nil, fmt.Errorf("Chunk threshold for config `%s` can not be negative", key)
+		}
+
+		if backup.ChunkSize == 0 {
+			backup.ChunkSize = defaultChunkSize
+		}
+
+		if backup.ChunkSize < 0 || backup.ChunkSize&(backup.ChunkSize-1) != 0 {
+			return nil, fmt.Errorf("Chunk size for config `%s` must be a power of two (KiB)", key)
+		}
+
+		if _, err := compileGlobs(backup.Include); err != nil {
+			return nil, fmt.Errorf("Invalid include for config `%s`: %s", key, err)
+		}
+
+		if _, err := compileGlobs(backup.Exclude); err != nil {
+			return nil, fmt.Errorf("Invalid exclude for config `%s`: %s", key, err)
+		}
+
+		if backup.KeepDeleted < 0 || backup.KeepVersions < 0 || backup.KeepDaily < 0 || backup.KeepWeekly < 0 || backup.KeepMonthly < 0 {
+			return nil, fmt.Errorf("Retention for config `%s` can not be negative", key)
+		}
+
+		if backup.Passphrase != "" && backup.KeyFile != "" {
+			return nil, fmt.Errorf("Supply either a passphrase or a key file for config `%s`, not both", key)
+		}
+
+		if backup.Backend == "directory" {
+			if backup.Directory == "" {
+				return nil, fmt.Errorf("No directory supplied for config `%s`", key)
+			}
+			continue
+		}
+
+		if backup.Backend == "s3" {
+			if backup.Endpoint == "" {
+				return nil, fmt.Errorf("No endpoint supplied for config `%s`", key)
+			}
+
+			if backup.Bucket == "" {
+				return nil, fmt.Errorf("No bucket supplied for config `%s`", key)
+			}
+
+			if backup.PartSize < minS3PartSize {
+				return nil, fmt.Errorf("Part size for config `%s` must be at least %d MiB for the s3 backend", key, minS3PartSize)
+			}
+		}
+
 		if backup.AwsAccess != "" && backup.AwsSecret == "" {
 			return nil, fmt.Errorf("AWS Access code suplied, but no AWS Secret for config `%s`", key)
 		}
@@ -117,3 +278,103 @@ func ReadConfig(configDef string) (*Config, error) {
 
 	return &cfg, nil
 }
+
+/**
+ * validPartSize checks if a part size in MiB is accepted by Glacier,
+ * which requires a power of two between 1 MiB and 4 GiB
+ */
+func validPartSize(size int64) bool {
+	return size >= 1 && size <= 4096 && size&(size-1) == 0
+}
+
+/**
+ * validEndpoint checks if an endpoint consists of
+ * a http or https scheme and a host only
+ */
+func validEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && strings.Trim(u.Path, "/") == "" && u.RawQuery == ""
+}
+
+/**
+ * FindBackup returns the configuration of the backup with the given name.
+ * The name may be omitted when only a single backup is configured.
+ * @return error Returns error if there is no such backup
+ */
+func (c *Config) FindBackup(name string) (*BackupConfig, error) {
+	if name == "" {
+		if len(c.Backup) != 1 {
+			return nil, errors.New("Multiple backups configured, please specify which one to use")
+		}
+		for _, backup := range c.Backup {
+			return backup, nil
+		}
+	}
+
+	backup, ok := c.Backup[name]
+	if !ok {
+		return nil, fmt.Errorf("No backup `%s` configured", name)
+	}
+	return backup, nil
+}
+
+/**
+ * SelectBackups returns the sorted names of the given backups,
+ * or of all configured backups if no names are given
+ * @param names []string Names of backups
+ * @return ([]string, error) Error if any of the backups isn't configured
+ */
+func (c *Config) SelectBackups(names []string) ([]string, error) {
+	if len(names) == 0 {
+		for name := range c.Backup {
+			names = append(names, name)
+		}
+	}
+
+	var selected []string
+	for _, name := range names {
+		if _, ok := c.Backup[name]; !ok {
+			return nil, fmt.Errorf("No backup `%s` configured", name)
+		}
+		selected = append(selected, name)
+	}
+	sort.Strings(selected)
+	return selected, nil
+}
+
+/**
+ * Check looks for problems ReadConfig can't find, like paths
+ * that don't exist on this machine
+ * @return []error The problems found
+ */
+func (c *Config) Check() []error {
+	names, _ := c.SelectBackups(nil)
+
+	var problems []error
+	for _, name := range names {
+		backup := c.Backup[name]
+		if info, err := os.Stat(backup.Path); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Errorf("Path `%s` of config `%s` is not a directory", backup.Path, name))
+		}
+		if info, err := os.Stat(filepath.Dir(backup.Db)); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Errorf("Directory of db `%s` of config `%s` doesn't exist", backup.Db, name))
+		}
+		if backup.Backend == "directory" {
+			if info, err := os.Stat(backup.Directory); err != nil || !info.IsDir() {
+				problems = append(problems, fmt.Errorf("Directory `%s` of config `%s` doesn't exist", backup.Directory, name))
+			}
+		}
+		for _, file := range []string{backup.KeyFile, backup.CaFile} {
+			if file == "" {
+				continue
+			}
+			if _, err := os.Stat(file); err != nil {
+				problems = append(problems, fmt.Errorf("Unable to read `%s` of config `%s`: %s", file, name, err))
+			}
+		}
+	}
+	return problems
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestBaseConfig(t *testing.T) {
@@ -328,3 +333,613 @@ func compareInclusions(test, compare []string) bool {
 	}
 	return true
 }
+
+func TestPartSizeDefaults(t *testing.T) {
+	configDef := `
+    [threads]
+    hash = 10
+    upload = 2
+
+    [aws]
+    access = 123abcAccess
+    secret = 123abcSecret
+
+    [backup "test"]
+    vault = test
+    region = eu-west-1
+    path = /tmp/
+    db = tmp.db
+`
+	config, err := ReadConfig(configDef)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if config.Threads.Parts != defaultPartThreads {
+		t.Errorf("Invalid number of part threads `%d`, expected `%d`", config.Threads.Parts, defaultPartThreads)
+	}
+
+	if config.Backup["test"].PartSize != defaultPartSize {
+		t.Errorf("Invalid part size `%d`, expected `%d`", config.Backup["test"].PartSize, defaultPartSize)
+	}
+}
+
+func TestPartSize(t *testing.T) {
+	configDef := `
+    [threads]
+    hash = 10
+    upload = 2
+    parts = 8
+
+    [aws]
+    access = 123abcAccess
+    secret = 123abcSecret
+
+    [backup "test"]
+    vault = test
+    region = eu-west-1
+    path = /tmp/
+    db = tmp.db
+    part-size = 256
+`
+	config, err := ReadConfig(configDef)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if config.Threads.Parts != 8 {
+		t.Errorf("Invalid number of part threads `%d`, expected `%d`", config.Threads.Parts, 8)
+	}
+
+	if config.Backup["test"].PartSize != 256 {
+		t.Errorf("Invalid part size `%d`, expected `%d`", config.Backup["test"].PartSize, 256)
+	}
+}
+
+func TestInvalidPartSize(t *testing.T) {
+	configDef := `
+    [threads]
+    hash = 10
+    upload = 2
+
+    [aws]
+    access = 123abcAccess
+    secret = 123abcSecret
+
+    [backup "test"]
+    vault = test
+    region = eu-west-1
+    path = /tmp/
+    db = tmp.db
+    part-size = 100
+`
+	if _, err := ReadConfig(configDef); err == nil || err.Error() != "Part size for config `test` must be a power of two between 1 and 4096 (MiB)" {
+		t.Error("Expected error about invalid part size in `test` backup")
+	}
+}
+
+func TestFindBackup(t *testing.T) {
+	configDef := `
+    [threads]
+    hash = 10
+    upload = 2
+
+    [aws]
+    access = 123abcAccess
+    secret = 123abcSecret
+
+    [backup "photos"]
+    vault = photos
+    region = eu-west-1
+    path = /photos/
+    db = photos.db
+
+    [backup "music"]
+    vault = music
+    region = eu-west-1
+    path = /music/
+    db = music.db
+`
+	config, err := ReadConfig(configDef)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	backup, err := config.FindBackup("music")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	} else if backup.Vault != "music" {
+		t.Errorf("Invalid vault `%s`, expected `%s`", backup.Vault, "music")
+	}
+
+	if _, err := config.FindBackup(""); err == nil || err.Error() != "Multiple backups configured, please specify which one to use" {
+		t.Error("Expected error about multiple backups")
+	}
+
+	if _, err := config.FindBackup("videos"); err == nil || err.Error() != "No backup `videos` configured" {
+		t.Error("Expected error about unknown backup `videos`")
+	}
+
+	delete(config.Backup, "music")
+	backup, err = config.FindBackup("")
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	} else if backup.Vault != "photos" {
+		t.Errorf("Invalid vault `%s`, expected `%s`", backup.Vault, "photos")
+	}
+}
+
+func TestDirectoryBackend(t *testing.T) {
+	configDef := `
+    [threads]
+    hash = 10
+    upload = 2
+
+    [backup "test"]
+    vault = test
+    path = /tmp/
+    db = tmp.db
+    backend = directory
+    directory = /mnt/backup
+`
+	config, err := ReadConfig(configDef)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if backup := config.Backup["test"]; backup.Backend != "directory" || backup.Directory != "/mnt/backup" {
+		t.Errorf("Expected directory backend in /mnt/backup, got `%s` in `%s`", backup.Backend, backup.Directory)
+	}
+}
+
+func TestInvalidBackend(t *testing.T) {
+	tests := map[string]string{
+		"backend = tape":      "Unknown backend `tape` for config `test`",
+		"backend = directory": "No directory supplied for config `test`",
+	}
+
+	for backend, expected := range tests {
+		configDef := `
+    [threads]
+    hash = 10
+    upload = 2
+
+    [backup "test"]
+    vault = test
+    path = /tmp/
+    db = tmp.db
+    ` + backend + `
+`
+		if _, err := ReadConfig(configDef); err == nil || err.Error() != expected {
+			t.Errorf("Expected error `%s` for `%s`, got %v", expected, backend, err)
+		}
+	}
+}
+
+func TestDefaultBackend(t *testing.T) {
+	configDef := `
+    [threads]
+    hash = 10
+    upload = 2
+
+    [aws]
+    access = 123abcAccess
+    secret = 123abcSecret
+
+    [backup "test"]
+    vault = test
+    region = eu-west-1
+    path = /tmp/
+    db = tmp.db
+`
+	config, err := ReadConfig(configDef)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if backend := config.Backup["test"].Backend; backend != "glacier" {
+		t.Errorf("Expected glacier backend by default, got `%s`", backend)
+	}
+}
+
+func TestS3Backend(t *testing.T) {
+	base := `
+    [threads]
+    hash = 10
+    upload = 2
+
+    [aws]
+    access = 123abcAccess
+    secret = 123abcSecret
+
+    [backup "test"]
+    vault = test
+    region = us-east-1
+    path = /tmp/
+    db = tmp.db
+    backend = s3
+`
+	tests := map[string]string{
+		"":                                 "No endpoint supplied for config `test`",
+		"endpoint = http://localhost:9000": "No bucket supplied for config `test`",
+		"endpoint = http://localhost:9000\nbucket = backups\npart-size = 4": "Part size for config `test` must be at least 8 MiB for the s3 backend",
+	}
+	for extra, expected := range tests {
+		if _, err := ReadConfig(base + extra + "\n"); err == nil || err.Error() != expected {
+			t.Errorf("Expected error `%s`, got %v", expected, err)
+		}
+	}
+
+	config, err := ReadConfig(base + "endpoint = http://localhost:9000\nbucket = backups\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if backup := config.Backup["test"]; backup.Endpoint != "http://localhost:9000" || backup.Bucket != "backups" || backup.PartSize != defaultPartSize {
+		t.Errorf("Expected s3 backend at http://localhost:9000 in bucket `backups`")
+	}
+}
+
+func TestEndpointAndHttpClient(t *testing.T) {
+	base := `
+    [threads]
+    hash = 10
+    upload = 2
+
+    [aws]
+    access = 123abcAccess
+    secret = 123abcSecret
+
+    [backup "test"]
+    vault = test
+    region = us-east-1
+    path = /tmp/
+    db = tmp.db
+`
+	tests := map[string]string{
+		"endpoint = localhost:8080":                      "Endpoint for config `test` must be a scheme and host, i.e. https://glacier.example.com",
+		"endpoint = ftp://localhost":                     "Endpoint for config `test` must be a scheme and host, i.e. https://glacier.example.com",
+		"endpoint = http://localhost/glacier":            "Endpoint for config `test` must be a scheme and host, i.e. https://glacier.example.com",
+		"endpoint = http://localhost:8080\ntimeout = -1": "Timeout for config `test` can not be negative",
+	}
+	for extra, expected := range tests {
+		if _, err := ReadConfig(base + extra + "\n"); err == nil || err.Error() != expected {
+			t.Errorf("Expected error `%s`, got %v", expected, err)
+		}
+	}
+
+	config, err := ReadConfig(base + "endpoint = http://localhost:8080/\ntimeout = 30\nproxy = http://proxy:3128\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	backup := config.Backup["test"]
+	client, err := newHttpClient(backup)
+	if err != nil {
+		t.Fatalf("Unexpected error while creating http client: %s", err)
+	}
+	if client == nil || client.Timeout != 30*time.Second {
+		t.Errorf("Expected http client with a timeout of 30 seconds")
+	}
+
+	backup.CaFile = "filesets/fileset1/file1.txt"
+	if _, err := newHttpClient(backup); err == nil {
+		t.Errorf("Expected error for CA file without certificates")
+	}
+
+	if client, _ := newHttpClient(&BackupConfig{}); client != nil {
+		t.Errorf("Expected no http client when nothing is configured")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	base := `
+    [threads]
+    hash = 10
+    upload = 2
+
+    [aws]
+    access = 123abcAccess
+    secret = 123abcSecret
+
+    [backup "test"]
+    vault = test
+    region = us-east-1
+    path = /tmp/
+    db = tmp.db
+`
+	if _, err := ReadConfig(base + "passphrase = secret\nkey-file = /etc/gobackup.key\n"); err == nil || err.Error() != "Supply either a passphrase or a key file for config `test`, not both" {
+		t.Errorf("Expected error for both a passphrase and a key file, got %v", err)
+	}
+
+	config, err := ReadConfig(base + "passphrase = correct horse battery staple\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if passphrase := config.Backup["test"].Passphrase; passphrase != "correct horse battery staple" {
+		t.Errorf("Expected passphrase `correct horse battery staple`, got `%s`", passphrase)
+	}
+
+	config, err = ReadConfig(base + "key-file = /etc/gobackup.key\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if keyFile := config.Backup["test"].KeyFile; keyFile != "/etc/gobackup.key" {
+		t.Errorf("Expected key file `/etc/gobackup.key`, got `%s`", keyFile)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	base := `
+    [threads]
+    hash = 10
+    upload = 2
+
+    [aws]
+    access = 123abcAccess
+    secret = 123abcSecret
+
+    [backup "test"]
+    vault = test
+    region = us-east-1
+    path = /tmp/
+    db = tmp.db
+`
+	if _, err := ReadConfig(base + "compression = zstd\n"); err == nil || err.Error() != "Unknown compression `zstd` for config `test`, supported are: gzip" {
+		t.Errorf("Expected error for unknown compression, got %v", err)
+	}
+
+	config, err := ReadConfig(base + "compression = gzip\ncompress-skip = jpg\ncompress-skip = mp4\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	policy, err := newBackupCompressionPolicy(config.Backup["test"])
+	if err != nil {
+		t.Fatalf("Unable to create compression policy: %s", err)
+	}
+	if policy.CodecFor("movie.mp4") != "" || policy.CodecFor("archive.zip") != "gzip" {
+		t.Errorf("Expected only the configured extensions to be skipped")
+	}
+
+	config, _ = ReadConfig(base + "compression = gzip\n")
+	policy, _ = newBackupCompressionPolicy(config.Backup["test"])
+	if policy.CodecFor("archive.zip") != "" || policy.CodecFor("report.csv") != "gzip" {
+		t.Errorf("Expected the default extensions to be skipped")
+	}
+
+	config, _ = ReadConfig(base)
+	if policy, err := newBackupCompressionPolicy(config.Backup["test"]); policy != nil || err != nil {
+		t.Errorf("Expected no compression by default")
+	}
+}
+
+func TestBundling(t *testing.T) {
+	base := `
+    [threads]
+    hash = 10
+    upload = 2
+
+    [aws]
+    access = 123abcAccess
+    secret = 123abcSecret
+
+    [backup "test"]
+    vault = test
+    region = us-east-1
+    path = /tmp/
+    db = tmp.db
+`
+	if _, err := ReadConfig(base + "bundle-threshold = -1\n"); err == nil || err.Error() != "Bundle threshold and size for config `test` can not be negative" {
+		t.Errorf("Expected error for negative bundle threshold, got %v", err)
+	}
+
+	config, err := ReadConfig(base + "bundle-threshold = 64\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if backup := config.Backup["test"]; backup.BundleThreshold != 64 || backup.BundleSize != defaultBundleSize {
+		t.Errorf("Expected threshold 64 and default bundle size, got %d and %d", backup.BundleThreshold, backup.BundleSize)
+	}
+
+	config, _ = ReadConfig(base + "bundle-threshold = 64\nbundle-size = 128\n")
+	if size := config.Backup["test"].BundleSize; size != 128 {
+		t.Errorf("Expected bundle size 128, got %d", size)
+	}
+}
+
+func TestChunking(t *testing.T) {
+	base := `
+    [threads]
+    hash = 10
+    upload = 2
+
+    [aws]
+    access = 123abcAccess
+    secret = 123abcSecret
+
+    [backup "test"]
+    vault = test
+    region = us-east-1
+    path = /tmp/
+    db = tmp.db
+`
+	if _, err := ReadConfig(base + "chunk-threshold = -1\n"); err == nil || err.Error() != "Chunk threshold for config `test` can not be negative" {
+		t.Errorf("Expected error for negative chunk threshold, got %v", err)
+	}
+
+	if _, err := ReadConfig(base + "chunk-threshold = 100\nchunk-size = 1000\n"); err == nil || err.Error() != "Chunk size for config `test` must be a power of two (KiB)" {
+		t.Errorf("Expected error for chunk size that isn't a power of two, got %v", err)
+	}
+
+	config, err := ReadConfig(base + "chunk-threshold = 100\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if backup := config.Backup["test"]; backup.ChunkThreshold != 100 || backup.ChunkSize != defaultChunkSize {
+		t.Errorf("Expected threshold 100 and default chunk size, got %d and %d", backup.ChunkThreshold, backup.ChunkSize)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	base := `
+    [threads]
+    hash = 10
+    upload = 2
+
+    [aws]
+    access = 123abcAccess
+    secret = 123abcSecret
+
+    [backup "test"]
+    vault = test
+    region = us-east-1
+    path = /tmp/
+    db = tmp.db
+`
+	if _, err := ReadConfig(base + "keep-versions = -1\n"); err == nil || err.Error() != "Retention for config `test` can not be negative" {
+		t.Errorf("Expected error for negative retention, got %v", err)
+	}
+
+	config, err := ReadConfig(base)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if policy := newBackupRetentionPolicy(config.Backup["test"]); policy != nil {
+		t.Errorf("Expected no retention policy without retention settings")
+	}
+
+	config, err = ReadConfig(base + "keep-deleted = 30\nkeep-versions = 3\nkeep-daily = 7\nkeep-weekly = 4\nkeep-monthly = 12\n")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	policy := newBackupRetentionPolicy(config.Backup["test"])
+	expected := NewRetentionPolicy(30*24*time.Hour, 3, 7, 4, 12)
+	if policy == nil || *policy != *expected {
+		t.Errorf("Expected retention policy %v, got %v", expected, policy)
+	}
+}
+
+func TestSelectBackups(t *testing.T) {
+	configDef := `
+    [threads]
+    hash = 10
+    upload = 2
+
+    [aws]
+    access = 123abcAccess
+    secret = 123abcSecret
+
+    [backup "photos"]
+    vault = photos
+    region = eu-west-1
+    path = /photos/
+    db = photos.db
+
+    [backup "music"]
+    vault = music
+    region = eu-west-1
+    path = /music/
+    db = music.db
+`
+	config, err := ReadConfig(configDef)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	names, err := config.SelectBackups(nil)
+	if err != nil || len(names) != 2 || names[0] != "music" || names[1] != "photos" {
+		t.Errorf("Expected all backups in order, got %v (%v)", names, err)
+	}
+
+	names, err = config.SelectBackups([]string{"photos"})
+	if err != nil || len(names) != 1 || names[0] != "photos" {
+		t.Errorf("Expected only photos, got %v (%v)", names, err)
+	}
+
+	if _, err := config.SelectBackups([]string{"photos", "videos"}); err == nil || err.Error() != "No backup `videos` configured" {
+		t.Errorf("Expected error about unknown backup `videos`, got %v", err)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	root, err := ioutil.TempDir("", "gobackup-config")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	configDef := fmt.Sprintf(`
+    [threads]
+    hash = 10
+    upload = 2
+
+    [aws]
+    access = 123abcAccess
+    secret = 123abcSecret
+
+    [backup "good"]
+    vault = good
+    region = eu-west-1
+    path = %[1]s
+    db = %[1]s/good.db
+
+    [backup "bad"]
+    vault = bad
+    region = eu-west-1
+    path = %[1]s/missing
+    db = %[1]s/missing/bad.db
+    key-file = %[1]s/missing.key
+`, root)
+	config, err := ReadConfig(configDef)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	problems := config.Check()
+	expected := []string{
+		"Path `" + root + "/missing` of config `bad` is not a directory",
+		"Directory of db `" + root + "/missing/bad.db` of config `bad` doesn't exist",
+		"Unable to read `" + root + "/missing.key` of config `bad`: stat " + root + "/missing.key: no such file or directory",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %v", len(expected), problems)
+	}
+	for i, problem := range problems {
+		if problem.Error() != expected[i] {
+			t.Errorf("Expected problem `%s`, got `%s`", expected[i], problem)
+		}
+	}
+
+	delete(config.Backup, "bad")
+	if problems := config.Check(); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+}
+
+func TestInvalidPatterns(t *testing.T) {
+	base := `
+    [threads]
+    hash = 10
+    upload = 2
+
+    [aws]
+    access = 123abcAccess
+    secret = 123abcSecret
+
+    [backup "test"]
+    vault = test
+    region = us-east-1
+    path = /tmp/
+    db = tmp.db
+`
+	if _, err := ReadConfig(base + "exclude = [z-a].txt\n"); err == nil || !strings.HasPrefix(err.Error(), "Invalid exclude for config `test`: Pattern `[z-a].txt` is invalid") {
+		t.Errorf("Expected error for invalid exclude, got %v", err)
+	}
+
+	if _, err := ReadConfig(base + "include = /\n"); err == nil || err.Error() != "Invalid include for config `test`: Pattern `/` matches nothing" {
+		t.Errorf("Expected error for include matching nothing, got %v", err)
+	}
+
+	if _, err := ReadConfig(base + "include = photos/**/*.jpg\nexclude = node_modules/\n"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/rdwilliamson/aws/glacier"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * directoryBackend stores archives in a directory, i.e. on a mounted
+ * disk. Every vault is a subdirectory holding the archives, the parts
+ * of unfinished multipart uploads and the jobs. Since archives are
+ * available right away, jobs complete as soon as they are initiated.
+ */
+type directoryBackend struct {
+	root string
+}
+
+/**
+ * NewDirectoryBackend creates a backend storing archives in root
+ * @param root string Existing directory to store the vaults in
+ */
+func NewDirectoryBackend(root string) *directoryBackend {
+	return &directoryBackend{root: root}
+}
+
+func (d *directoryBackend) EnsureVault(vault string) error {
+	// don't fill the mount point when the disk isn't mounted
+	info, err := os.Stat(d.root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("`%s` is not a directory", d.root)
+	}
+
+	for _, dir := range []string{"archives", "multipart", "jobs"} {
+		if err := os.MkdirAll(filepath.Join(d.root, vault, dir), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * UploadArchive stores an archive in the vault directory. The hashes
+ * are calculated while copying it anyway, so known hashes are ignored.
+ */
+func (d *directoryBackend) UploadArchive(vault string, archive io.ReadSeeker, description string, hashes *ArchiveHashes) (string, error) {
+	id, err := newId()
+	if err != nil {
+		return "", err
+	}
+
+	tmp := d.archivePath(vault, ".upload-"+id)
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	size, treeHash, err := copyWithTreeHash(out, archive)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return id, d.addArchive(vault, tmp, glacier.Archive{
+		ArchiveId:          id,
+		ArchiveDescription: description,
+		CreationDate:       time.Now().UTC(),
+		Size:               size,
+		SHA256TreeHash:     treeHash,
+	})
+}
+
+func (d *directoryBackend) DeleteArchive(vault, archiveId string) error {
+	if err := os.Remove(d.archivePath(vault, archiveId)); err != nil {
+		return err
+	}
+	return os.Remove(d.archivePath(vault, archiveId) + ".json")
+}
+
+func (d *directoryBackend) InitiateMultipart(vault string, partSize int64, description string) (string, error) {
+	id, err := newId()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Mkdir(d.multipartPath(vault, id), 0755); err != nil {
+		return "", err
+	}
+
+	return id, writeJson(filepath.Join(d.multipartPath(vault, id), "upload.json"), glacier.Multipart{
+		ArchiveDescription: description,
+		CreationDate:       time.Now().UTC(),
+		MultipartUploadId:  id,
+		PartSizeInBytes:    partSize,
+	})
+}
+
+func (d *directoryBackend) UploadMultipart(vault, uploadId string, start int64, body io.ReadSeeker) error {
+	dir := d.multipartPath(vault, uploadId)
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+
+	out, err := ioutil.TempFile(dir, ".part-")
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	_, err = io.Copy(out, body)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, strconv.FormatInt(start, 10)))
+}
+
+func (d *directoryBackend) CompleteMultipart(vault, uploadId, treeHash string, size int64) (string, error) {
+	parts, err := d.listParts(vault, uploadId)
+	if err != nil {
+		return "", err
+	}
+
+	var upload glacier.Multipart
+	if err := readJson(filepath.Join(d.multipartPath(vault, uploadId), "upload.json"), &upload); err != nil {
+		return "", err
+	}
+
+	tmp := d.archivePath(vault, ".upload-"+uploadId)
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+
+	th := glacier.NewTreeHash()
+	var written int64
+	for _, start := range parts {
+		if start != written {
+			out.Close()
+			return "", fmt.Errorf("Part at offset %d of upload %s is missing", written, uploadId)
+		}
+		n, err := copyFrom(io.MultiWriter(out, th), filepath.Join(d.multipartPath(vault, uploadId), strconv.FormatInt(start, 10)))
+		if err != nil {
+			out.Close()
+			return "", err
+		}
+		written += n
+	}
+	th.Close()
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	if written != size {
+		return "", fmt.Errorf("Size of upload %s is %d bytes, expected %d", uploadId, written, size)
+	}
+	if actual := fmt.Sprintf("%x", th.TreeHash()); actual != treeHash {
+		return "", fmt.Errorf("Tree hash of upload %s is `%s`, expected `%s`", uploadId, actual, treeHash)
+	}
+
+	id, err := newId()
+	if err != nil {
+		return "", err
+	}
+	err = d.addArchive(vault, tmp, glacier.Archive{
+		ArchiveId:          id,
+		ArchiveDescription: upload.ArchiveDescription,
+		CreationDate:       time.Now().UTC(),
+		Size:               size,
+		SHA256TreeHash:     treeHash,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id, os.RemoveAll(d.multipartPath(vault, uploadId))
+}
+
+func (d *directoryBackend) AbortMultipart(vault, uploadId string) error {
+	if _, err := os.Stat(d.multipartPath(vault, uploadId)); err != nil {
+		return err
+	}
+	return os.RemoveAll(d.multipartPath(vault, uploadId))
+}
+
+func (d *directoryBackend) ListMultipartUploads(vault string) ([]glacier.Multipart, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(d.root, vault, "multipart"))
+	if err != nil {
+		return nil, err
+	}
+
+	var uploads []glacier.Multipart
+	for _, dir := range dirs {
+		var upload glacier.Multipart
+		if err := readJson(filepath.Join(d.multipartPath(vault, dir.Name()), "upload.json"), &upload); err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, nil
+}
+
+func (d *directoryBackend) ListMultipartParts(vault, uploadId string) (map[int64]string, error) {
+	starts, err := d.listParts(vault, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make(map[int64]string)
+	for _, start := range starts {
+		th := glacier.NewTreeHash()
+		if _, err := copyFrom(th, filepath.Join(d.multipartPath(vault, uploadId), strconv.FormatInt(start, 10))); err != nil {
+			return nil, err
+		}
+		th.Close()
+		parts[start] = fmt.Sprintf("%x", th.TreeHash())
+	}
+	return parts, nil
+}
+
+func (d *directoryBackend) InitiateRetrievalJob(vault, archiveId, description string) (string, error) {
+	var archive glacier.Archive
+	if err := readJson(d.archivePath(vault, archiveId)+".json", &archive); err != nil {
+		return "", err
+	}
+
+	return d.addJob(vault, glacier.Job{
+		Action:             "ArchiveRetrieval",
+		ArchiveId:          archiveId,
+		ArchiveSizeInBytes: archive.Size,
+		JobDescription:     description,
+		SHA256TreeHash:     archive.SHA256TreeHash,
+	})
+}
+
+func (d *directoryBackend) InitiateInventoryJob(vault, description string) (string, error) {
+	return d.addJob(vault, glacier.Job{
+		Action:         "InventoryRetrieval",
+		JobDescription: description,
+	})
+}
+
+func (d *directoryBackend) DescribeJob(vault, jobId string) (*glacier.Job, error) {
+	job := &glacier.Job{}
+	if err := readJson(d.jobPath(vault, jobId), job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (d *directoryBackend) ListJobs(vault string) ([]glacier.Job, error) {
+	files, err := ioutil.ReadDir(filepath.Join(d.root, vault, "jobs"))
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []glacier.Job
+	for _, file := range files {
+		job, err := d.DescribeJob(vault, strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+	return jobs, nil
+}
+
+func (d *directoryBackend) GetRetrievalJob(vault, jobId string, start, end int64) (io.ReadCloser, string, error) {
+	job, err := d.DescribeJob(vault, jobId)
+	if err != nil {
+		return nil, "", err
+	}
+	if job.Action != "ArchiveRetrieval" {
+		return nil, "", fmt.Errorf("Job %s is not an archive retrieval", jobId)
+	}
+
+	f, err := os.Open(d.archivePath(vault, job.ArchiveId))
+	if err != nil {
+		return nil, "", err
+	}
+	return sectionReadCloser{io.NewSectionReader(f, start, end-start+1), f}, "", nil
+}
+
+func (d *directoryBackend) GetInventoryJob(vault, jobId string) (*glacier.Inventory, error) {
+	job, err := d.DescribeJob(vault, jobId)
+	if err != nil {
+		return nil, err
+	}
+	if job.Action != "InventoryRetrieval" {
+		return nil, fmt.Errorf("Job %s is not an inventory retrieval", jobId)
+	}
+
+	files, err := filepath.Glob(d.archivePath(vault, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	// the archives are listed now, not when the job was initiated
+	inventory := &glacier.Inventory{InventoryDate: time.Now().UTC()}
+	for _, file := range files {
+		var archive glacier.Archive
+		if err := readJson(file, &archive); err != nil {
+			return nil, err
+		}
+		inventory.ArchiveList = append(inventory.ArchiveList, archive)
+	}
+	return inventory, nil
+}
+
+/**
+ * addArchive moves a completely written archive into place
+ * and records its metadata
+ */
+func (d *directoryBackend) addArchive(vault, tmp string, archive glacier.Archive) error {
+	if err := writeJson(d.archivePath(vault, archive.ArchiveId)+".json", archive); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.archivePath(vault, archive.ArchiveId))
+}
+
+/**
+ * addJob records a job, which completes right away
+ */
+func (d *directoryBackend) addJob(vault string, job glacier.Job) (string, error) {
+	id, err := newId()
+	if err != nil {
+		return "", err
+	}
+
+	job.JobId = id
+	job.CreationDate = time.Now().UTC()
+	job.CompletionDate = job.CreationDate
+	job.Completed = true
+	job.StatusCode = "Succeeded"
+	return id, writeJson(d.jobPath(vault, id), job)
+}
+
+/**
+ * listParts returns the offsets of the received parts of
+ * a multipart upload in ascending order
+ */
+func (d *directoryBackend) listParts(vault, uploadId string) ([]int64, error) {
+	files, err := ioutil.ReadDir(d.multipartPath(vault, uploadId))
+	if err != nil {
+		return nil, err
+	}
+
+	var starts []int64
+	for _, file := range files {
+		start, err := strconv.ParseInt(file.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		starts = append(starts, start)
+	}
+	sort.Sort(int64Slice(starts))
+	return starts, nil
+}
+
+func (d *directoryBackend) archivePath(vault, archiveId string) string {
+	return filepath.Join(d.root, vault, "archives", archiveId)
+}
+
+func (d *directoryBackend) multipartPath(vault, uploadId string) string {
+	return filepath.Join(d.root, vault, "multipart", uploadId)
+}
+
+func (d *directoryBackend) jobPath(vault, jobId string) string {
+	return filepath.Join(d.root, vault, "jobs", jobId+".json")
+}
+
+/**
+ * sectionReadCloser reads a section of a file and closes the file
+ */
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+/**
+ * newId returns a random hex encoded id
+ */
+func newId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", id), nil
+}
+
+/**
+ * copyWithTreeHash copies src to dst
+ * @return int64 The number of bytes copied
+ * @return string The hex encoded tree hash of the copied bytes
+ */
+func copyWithTreeHash(dst io.Writer, src io.Reader) (int64, string, error) {
+	th := glacier.NewTreeHash()
+	n, err := copyToTreeHash(io.MultiWriter(dst, th), src)
+	if err != nil {
+		return n, "", err
+	}
+	th.Close()
+	return n, fmt.Sprintf("%x", th.TreeHash()), nil
+}
+
+/**
+ * copyFrom copies the contents of the file at path
+ * to dst, which may include a tree hash
+ */
+func copyFrom(dst io.Writer, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return copyToTreeHash(dst, f)
+}
+
+func writeJson(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func readJson(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestDirectoryBackendArchives(t *testing.T) {
+	root, err := ioutil.TempDir("", "gobackup-backend")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	backend := NewDirectoryBackend(root)
+	if err := backend.EnsureVault("test"); err != nil {
+		t.Fatalf("Vault should have been created, but got error: %s", err)
+	}
+
+	data := []byte("Hello, world!")
+	archiveId, err := backend.UploadArchive("test", bytes.NewReader(data), "hello", nil)
+	if err != nil {
+		t.Fatalf("Archive should have been uploaded, but got error: %s", err)
+	}
+
+	jobId, err := backend.InitiateRetrievalJob("test", archiveId, "restore")
+	if err != nil {
+		t.Fatalf("Retrieval job should have been initiated, but got error: %s", err)
+	}
+
+	job, err := backend.DescribeJob("test", jobId)
+	if err != nil {
+		t.Fatalf("Unexpected error while describing job: %s", err)
+	}
+	if !job.Completed || job.StatusCode != "Succeeded" || job.ArchiveSizeInBytes != int64(len(data)) {
+		t.Errorf("Expected a completed retrieval job of %d bytes", len(data))
+	}
+
+	body, _, err := backend.GetRetrievalJob("test", jobId, 7, 11)
+	if err != nil {
+		t.Fatalf("Unexpected error while getting job output: %s", err)
+	}
+	output, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(output) != "world" {
+		t.Errorf("Expected `world`, got `%s`", output)
+	}
+
+	jobId, err = backend.InitiateInventoryJob("test", "inventory")
+	if err != nil {
+		t.Fatalf("Inventory job should have been initiated, but got error: %s", err)
+	}
+	inventory, err := backend.GetInventoryJob("test", jobId)
+	if err != nil {
+		t.Fatalf("Unexpected error while getting inventory: %s", err)
+	}
+	if len(inventory.ArchiveList) != 1 || inventory.ArchiveList[0].ArchiveId != archiveId || inventory.ArchiveList[0].ArchiveDescription != "hello" || inventory.ArchiveList[0].SHA256TreeHash != job.SHA256TreeHash {
+		t.Errorf("Expected archive %s in inventory", archiveId)
+	}
+
+	jobs, err := backend.ListJobs("test")
+	if err != nil || len(jobs) != 2 {
+		t.Errorf("Expected 2 jobs")
+	}
+
+	if err := backend.DeleteArchive("test", archiveId); err != nil {
+		t.Errorf("Archive should have been deleted, but got error: %s", err)
+	}
+	inventory, _ = backend.GetInventoryJob("test", jobId)
+	if len(inventory.ArchiveList) != 0 {
+		t.Errorf("Expected no archives in inventory after deleting archive")
+	}
+}
+
+func TestDirectoryBackendMultipart(t *testing.T) {
+	root, err := ioutil.TempDir("", "gobackup-backend")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	backend := NewDirectoryBackend(root)
+	backend.EnsureVault("test")
+
+	partSize := int64(1024 * 1024)
+	data := make([]byte, 2*partSize+12345)
+	rand.Read(data)
+
+	uploadId, err := backend.InitiateMultipart("test", partSize, "multi")
+	if err != nil {
+		t.Fatalf("Multipart upload should have been initiated, but got error: %s", err)
+	}
+
+	for start := int64(0); start < int64(len(data)); start += partSize {
+		end := start + partSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		if err := backend.UploadMultipart("test", uploadId, start, bytes.NewReader(data[start:end])); err != nil {
+			t.Fatalf("Part should have been uploaded, but got error: %s", err)
+		}
+	}
+
+	uploads, err := backend.ListMultipartUploads("test")
+	if err != nil || len(uploads) != 1 || uploads[0].MultipartUploadId != uploadId || uploads[0].PartSizeInBytes != partSize {
+		t.Errorf("Expected multipart upload %s to be listed", uploadId)
+	}
+
+	parts, err := backend.ListMultipartParts("test", uploadId)
+	if err != nil || len(parts) != 3 {
+		t.Errorf("Expected 3 parts to be listed")
+	}
+
+	_, treeHash, _ := copyWithTreeHash(ioutil.Discard, bytes.NewReader(data))
+	if _, err := backend.CompleteMultipart("test", uploadId, treeHash, int64(len(data))+1); err == nil {
+		t.Errorf("Expected error when completing upload with the wrong size")
+	}
+
+	archiveId, err := backend.CompleteMultipart("test", uploadId, treeHash, int64(len(data)))
+	if err != nil {
+		t.Fatalf("Multipart upload should have been completed, but got error: %s", err)
+	}
+
+	jobId, _ := backend.InitiateRetrievalJob("test", archiveId, "restore")
+	body, _, err := backend.GetRetrievalJob("test", jobId, 0, int64(len(data))-1)
+	if err != nil {
+		t.Fatalf("Unexpected error while getting job output: %s", err)
+	}
+	output, _ := ioutil.ReadAll(body)
+	body.Close()
+	if !bytes.Equal(output, data) {
+		t.Errorf("Retrieved archive is not the same as the one that was uploaded")
+	}
+
+	if uploads, _ := backend.ListMultipartUploads("test"); len(uploads) != 0 {
+		t.Errorf("Expected no multipart uploads after completing the upload")
+	}
+}
+
+func TestDirectoryBackendMissingRoot(t *testing.T) {
+	backend := NewDirectoryBackend("/nonexistent/gobackup")
+	if err := backend.EnsureVault("test"); err == nil {
+		t.Errorf("Expected error when the root directory doesn't exist")
+	}
+}
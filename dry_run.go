@@ -0,0 +1,270 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Glacier prices in us-east-1 used to estimate what a backup costs
+const (
+	// glacierStoragePrice is the price in USD per GiB per month
+	glacierStoragePrice = 0.0036
+	// standardStoragePrice is the price in USD per GiB per month of
+	// the metadata Glacier keeps in S3 standard storage
+	standardStoragePrice = 0.023
+	// glacierRequestPrice is the price in USD of a single upload request
+	glacierRequestPrice = 0.03 / 1000
+	// archiveOverhead and archiveMetadata are the bytes Glacier charges
+	// for every archive on top of its content, at Glacier and
+	// S3 standard prices respectively
+	archiveOverhead = 32 * 1024
+	archiveMetadata = 8 * 1024
+)
+
+/**
+ * DryRunFile is a file a backup would act on
+ */
+type DryRunFile struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size,omitempty"`
+}
+
+/**
+ * DryRunReport lists what a backup would do, along with an estimate
+ * of the requests it makes and what storing its uploads costs
+ */
+type DryRunReport struct {
+	Backup         string        `json:"backup"`
+	Hashed         []*DryRunFile `json:"hashed"`
+	Uploaded       []*DryRunFile `json:"uploaded"`
+	Duplicates     []*DryRunFile `json:"duplicates"`
+	Deleted        []*DryRunFile `json:"deleted"`
+	Unchanged      int           `json:"unchanged"`
+	HashedBytes    int64         `json:"hashed_bytes"`
+	UploadedBytes  int64         `json:"uploaded_bytes"`
+	DuplicateBytes int64         `json:"duplicate_bytes"`
+	Archives       int           `json:"archives"`
+	Requests       int64         `json:"requests"`
+	RequestCost    float64       `json:"request_cost"`
+	StorageCost    float64       `json:"monthly_storage_cost"`
+}
+
+/**
+ * dryRun keeps track of what a backup would do while its files are hashed
+ */
+type dryRun struct {
+	mu       sync.Mutex
+	report   *DryRunReport
+	seen     map[string]bool
+	partSize int64
+	bundler  *Bundler
+	// bytes of the bundle being filled
+	bundled int64
+}
+
+/**
+ * DryRun reports what backing up the files of a backup would do,
+ * without writing to the archive or contacting the backend.
+ * Uploads are estimated at their uncompressed size.
+ * @param name string Name of the backup
+ * @param threads int Number of threads hashing files
+ * @param rehash bool Hash files even if they appear unmodified since the last run
+ * @return (*DryRunReport, error)
+ */
+func DryRun(name string, backup *BackupConfig, threads int, rehash bool) (*DryRunReport, error) {
+	archive, err := NewReadOnlyArchive(backup.Db)
+	if os.IsNotExist(err) {
+		// a new backup starts out with an empty archive
+		archive, err = NewArchive(":memory:")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error opening archive: %s", err)
+	}
+
+	d := &dryRun{
+		report:   &DryRunReport{Backup: name},
+		seen:     make(map[string]bool),
+		partSize: backup.PartSize * 1024 * 1024,
+		bundler:  newBackupBundler(nil, nil, nil, backup),
+	}
+
+	files, err := archive.ListFiles()
+	if err != nil {
+		return nil, fmt.Errorf("Error listing files: %s", err)
+	}
+	deleted := make(map[string]bool)
+	for _, file := range files {
+		info, err := os.Stat(file.Filename())
+		if (err != nil || info.IsDir()) && !deleted[file.Filename()] {
+			deleted[file.Filename()] = true
+			d.report.Deleted = append(d.report.Deleted, &DryRunFile{Filename: file.Filename()})
+		}
+	}
+
+	filesChan := make(chan *File, 100)
+	hashers := &sync.WaitGroup{}
+	for i := 0; i < threads; i++ {
+		hashers.Add(1)
+		go d.hash(archive, rehash, filesChan, hashers)
+	}
+	ListFiles(backup.Path, backup.Include, backup.Exclude, filesChan)
+	hashers.Wait()
+
+	if d.bundled > 0 {
+		d.addArchive(d.bundled)
+	}
+	d.report.RequestCost = float64(d.report.Requests) * glacierRequestPrice
+	d.report.StorageCost = float64(d.report.UploadedBytes+int64(d.report.Archives)*archiveOverhead)/(1<<30)*glacierStoragePrice +
+		float64(int64(d.report.Archives)*archiveMetadata)/(1<<30)*standardStoragePrice
+
+	for _, list := range [][]*DryRunFile{d.report.Hashed, d.report.Uploaded, d.report.Duplicates, d.report.Deleted} {
+		sort.Sort(dryRunFiles(list))
+	}
+
+	return d.report, nil
+}
+
+/**
+ * hash sorts the files it receives the same way Hash does
+ */
+func (d *dryRun) hash(archive *archive, rehash bool, files chan *File, hashers *sync.WaitGroup) {
+	defer hashers.Done()
+	for file := range files {
+		if !rehash {
+			useRecordedHash(archive, file)
+		}
+		hashed := file.hash == ""
+		hash, err := file.Hash()
+		if err != nil {
+			log.Printf("Could not calculate hash for %s: %s", file.Filename(), err)
+			continue
+		}
+		stat, err := file.Stat()
+		if err != nil {
+			log.Printf("Could not stat %s: %s", file.Filename(), err)
+			continue
+		}
+		entry := &DryRunFile{Filename: file.Filename(), Size: stat.Size()}
+
+		unchanged := false
+		if archived, err := archive.FindFileByFilename(file.Filename()); err == nil && archived.Hash() == hash {
+			unchanged = true
+		}
+		_, err = archive.FindAmazonIdByHash(hash)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Could not look up hash for %s: %s", file.Filename(), err)
+			continue
+		}
+		stored := err == nil
+
+		d.mu.Lock()
+		if hashed {
+			d.report.Hashed = append(d.report.Hashed, entry)
+			d.report.HashedBytes += entry.Size
+		}
+		switch {
+		case unchanged:
+			d.report.Unchanged++
+		case stored || d.seen[hash]:
+			d.report.Duplicates = append(d.report.Duplicates, entry)
+			d.report.DuplicateBytes += entry.Size
+		default:
+			d.seen[hash] = true
+			d.report.Uploaded = append(d.report.Uploaded, entry)
+			d.report.UploadedBytes += entry.Size
+			d.addUpload(file, entry.Size)
+		}
+		d.mu.Unlock()
+	}
+}
+
+/**
+ * addUpload counts the archives and requests uploading a file takes,
+ * assuming bundles and chunked files are filled up completely
+ */
+func (d *dryRun) addUpload(file *File, size int64) {
+	if !d.bundler.Accepts(file) && !d.bundler.AcceptsChunked(file) {
+		d.addArchive(size)
+		return
+	}
+	d.bundled += size
+	if d.bundler.size == 0 {
+		d.addArchive(d.bundled)
+		d.bundled = 0
+		return
+	}
+	for d.bundled >= d.bundler.size {
+		d.addArchive(d.bundler.size)
+		d.bundled -= d.bundler.size
+	}
+}
+
+/**
+ * addArchive counts an archive of the given size, uploaded
+ * in parts if it's larger than the part size
+ */
+func (d *dryRun) addArchive(size int64) {
+	d.report.Archives++
+	if size <= d.partSize {
+		d.report.Requests++
+		return
+	}
+	// initiate, upload the parts and complete
+	d.report.Requests += (size+d.partSize-1)/d.partSize + 2
+}
+
+/**
+ * writeDryRunReports writes the reports as JSON to a file,
+ * or to stdout if the filename is -
+ */
+func writeDryRunReports(reports []*DryRunReport, filename string) error {
+	data, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if filename == "-" {
+		_, err = fmt.Fprintf(os.Stdout, "%s\n", data)
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
+
+/**
+ * printDryRunReport prints what a backup would do, one file per line
+ */
+func printDryRunReport(report *DryRunReport) {
+	lists := []struct {
+		action string
+		files  []*DryRunFile
+	}{
+		{"hash", report.Hashed},
+		{"upload", report.Uploaded},
+		{"duplicate", report.Duplicates},
+		{"delete", report.Deleted},
+	}
+	for _, list := range lists {
+		for _, file := range list.files {
+			fmt.Printf("%s\t%s\t%s\t%d\n", report.Backup, list.action, file.Filename, file.Size)
+		}
+	}
+	fmt.Printf("Backup `%s` would hash %d files (%d bytes), upload %d files (%d bytes) in %d archives, skip %d duplicates (%d bytes) and %d unchanged files, and mark %d files deleted\n",
+		report.Backup, len(report.Hashed), report.HashedBytes, len(report.Uploaded), report.UploadedBytes, report.Archives,
+		len(report.Duplicates), report.DuplicateBytes, report.Unchanged, len(report.Deleted))
+	fmt.Printf("Estimated cost: %d requests for $%.4f, storage $%.4f per month\n", report.Requests, report.RequestCost, report.StorageCost)
+}
+
+/**
+ * dryRunFiles sorts files by filename
+ */
+type dryRunFiles []*DryRunFile
+
+func (f dryRunFiles) Len() int           { return len(f) }
+func (f dryRunFiles) Less(i, j int) bool { return f[i].Filename < f[j].Filename }
+func (f dryRunFiles) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDryRunOfNewBackup(t *testing.T) {
+	_, backup, _, server, root := newFakeGlacierBackup(t)
+	defer os.RemoveAll(root)
+	defer server.Close()
+
+	report, err := DryRun("test", backup, 2, false)
+	if err != nil {
+		t.Fatalf("Dry run failed: %s", err)
+	}
+	if len(report.Hashed) != 4 || len(report.Uploaded) != 4 || len(report.Duplicates) != 0 || len(report.Deleted) != 0 {
+		t.Errorf("Expected all 4 files to be hashed and uploaded, got %+v", report)
+	}
+	if report.UploadedBytes != 79 || report.Archives != 4 || report.Requests != 4 {
+		t.Errorf("Expected 79 bytes in 4 archives with 4 requests, got %d bytes in %d archives with %d requests", report.UploadedBytes, report.Archives, report.Requests)
+	}
+	if report.RequestCost <= 0 || report.StorageCost <= 0 {
+		t.Errorf("Expected an estimated cost, got %f and %f", report.RequestCost, report.StorageCost)
+	}
+	if _, err := os.Stat(backup.Db); !os.IsNotExist(err) {
+		t.Errorf("Expected the dry run not to create the archive")
+	}
+
+	// all small files fit in a single bundle
+	backup.BundleThreshold = 1
+	backup.BundleSize = 1
+	report, err = DryRun("test", backup, 2, false)
+	if err != nil {
+		t.Fatalf("Dry run failed: %s", err)
+	}
+	if report.Archives != 1 || report.Requests != 1 {
+		t.Errorf("Expected 1 archive with 1 request, got %d archives with %d requests", report.Archives, report.Requests)
+	}
+}
+
+func TestDryRunOfExistingBackup(t *testing.T) {
+	config, backup, fake, server, root := newFakeGlacierBackup(t)
+	defer os.RemoveAll(root)
+	defer server.Close()
+
+	if err := runBackup(config, backup, false); err != nil {
+		t.Fatalf("Backup failed: %s", err)
+	}
+
+	data := backup.Path
+	ioutil.WriteFile(filepath.Join(data, "file1.txt"), []byte("The content of file1 has changed\n"), 0644)
+	os.Remove(filepath.Join(data, "sub", "file2.txt"))
+	copyFile(filepath.Join(data, "file3.txt"), filepath.Join(data, "sub", "copy-of-file3.txt"))
+
+	db, _ := ioutil.ReadFile(backup.Db)
+	fake.setFailWhen(func(operation string, r *http.Request) bool {
+		t.Errorf("Expected the dry run not to contact Glacier, got %s", operation)
+		return true
+	})
+
+	report, err := DryRun("test", backup, 2, false)
+	if err != nil {
+		t.Fatalf("Dry run failed: %s", err)
+	}
+
+	lists := map[string][]*DryRunFile{
+		"hashed":     report.Hashed,
+		"uploaded":   report.Uploaded,
+		"duplicates": report.Duplicates,
+		"deleted":    report.Deleted,
+	}
+	for list, files := range map[string][]string{
+		"hashed":     {"file1.txt", "sub/copy-of-file3.txt"},
+		"uploaded":   {"file1.txt"},
+		"duplicates": {"sub/copy-of-file3.txt"},
+		"deleted":    {"sub/file2.txt"},
+	} {
+		if len(lists[list]) != len(files) {
+			t.Errorf("Expected %d %s files, got %d", len(files), list, len(lists[list]))
+			continue
+		}
+		for i, filename := range files {
+			if lists[list][i].Filename != filepath.Join(data, filename) {
+				t.Errorf("Expected %s in %s files, got %s", filename, list, lists[list][i].Filename)
+			}
+		}
+	}
+	if report.Unchanged != 2 || report.UploadedBytes != 33 || report.DuplicateBytes != 26 {
+		t.Errorf("Expected 2 unchanged files, 33 uploaded and 26 duplicate bytes, got %d, %d and %d", report.Unchanged, report.UploadedBytes, report.DuplicateBytes)
+	}
+
+	if after, _ := ioutil.ReadFile(backup.Db); !bytes.Equal(db, after) {
+		t.Errorf("Expected the dry run not to change the archive")
+	}
+
+	output := filepath.Join(root, "report.json")
+	if err := writeDryRunReports([]*DryRunReport{report}, output); err != nil {
+		t.Fatalf("Unable to write report: %s", err)
+	}
+	var reports []*DryRunReport
+	content, _ := ioutil.ReadFile(output)
+	if err := json.Unmarshal(content, &reports); err != nil || len(reports) != 1 || len(reports[0].Uploaded) != 1 {
+		t.Errorf("Expected the JSON report to hold the report, got %s (%v)", content, err)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// encryptionVersion is the version of the format of encrypted archives.
+// Version 0 means an archive is not encrypted.
+const encryptionVersion = 1
+
+// nonceScheme describes how the nonces of the chunks of an archive are
+// built: a random 8 byte prefix per archive followed by a 4 byte counter
+const nonceScheme = "random64-counter32"
+
+// encryptionChunkSize is the number of plaintext bytes sealed per chunk
+const encryptionChunkSize = 64 * 1024
+
+// encryptionMagic starts every encrypted archive
+const encryptionMagic = "GBAE"
+
+// kdfIterations is the number of PBKDF2 iterations used to
+// derive a key from a passphrase
+const kdfIterations = 100000
+
+// encryptedDescriptionPrefix starts the descriptions of encrypted archives,
+// the rest of the description is the encrypted plaintext description
+const encryptedDescriptionPrefix = "gobackup-encrypted "
+
+const (
+	keyIdSize       = 8
+	saltSize        = 16
+	noncePrefixSize = 8
+	headerSize      = len(encryptionMagic) + 1 + keyIdSize + saltSize + noncePrefixSize
+)
+
+var errTruncated = errors.New("Encrypted archive is truncated")
+
+/**
+ * Encrypter encrypts archives before they are uploaded and decrypts
+ * them when they are restored, using AES-256-GCM on chunks of the archive.
+ * The key is either derived from a passphrase or read from a key file.
+ * Every archive starts with a header holding the format version, the id
+ * of the key and the salt it was derived with, so archives encrypted with
+ * an older salt can still be decrypted with the same passphrase.
+ */
+type Encrypter struct {
+	passphrase string
+	key        *encryptionKey
+	derived    map[string]*encryptionKey
+	mu         sync.Mutex
+}
+
+type encryptionKey struct {
+	id   string
+	salt []byte
+	aead cipher.AEAD
+}
+
+/**
+ * NewPassphraseEncrypter creates an encrypter with
+ * a key derived from a passphrase and salt
+ */
+func NewPassphraseEncrypter(passphrase string, salt []byte) (*Encrypter, error) {
+	if passphrase == "" {
+		return nil, errors.New("Passphrase can not be empty")
+	}
+	if len(salt) != saltSize {
+		return nil, fmt.Errorf("Salt must be %d bytes", saltSize)
+	}
+
+	key, err := newEncryptionKey(pbkdf2(sha256.New, []byte(passphrase), salt, kdfIterations, 32), salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encrypter{
+		passphrase: passphrase,
+		key:        key,
+		derived:    map[string]*encryptionKey{hex.EncodeToString(salt): key},
+	}, nil
+}
+
+/**
+ * NewKeyFileEncrypter creates an encrypter with the key in a file.
+ * The file contains 32 random bytes, either raw or hex encoded.
+ */
+func NewKeyFileEncrypter(path string) (*Encrypter, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := data
+	if decoded, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		raw = decoded
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("Key file `%s` must contain 32 bytes, raw or hex encoded", path)
+	}
+
+	key, err := newEncryptionKey(raw, make([]byte, saltSize))
+	if err != nil {
+		return nil, err
+	}
+	return &Encrypter{key: key}, nil
+}
+
+/**
+ * newBackupEncrypter creates the encrypter configured for a backup.
+ * The salt for a passphrase is kept in the archive.
+ * Returns nil if the backup is not encrypted.
+ */
+func newBackupEncrypter(backup *BackupConfig, archive *archive) (*Encrypter, error) {
+	if backup.KeyFile != "" {
+		return NewKeyFileEncrypter(backup.KeyFile)
+	}
+	if backup.Passphrase == "" {
+		return nil, nil
+	}
+
+	salt, err := archive.EncryptionSalt()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get encryption salt: %s", err)
+	}
+	return NewPassphraseEncrypter(backup.Passphrase, salt)
+}
+
+func newEncryptionKey(raw, salt []byte) (*encryptionKey, error) {
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, raw)
+	mac.Write([]byte("gobackup key id"))
+
+	return &encryptionKey{
+		id:   hex.EncodeToString(mac.Sum(nil)[:keyIdSize]),
+		salt: salt,
+		aead: aead,
+	}, nil
+}
+
+/**
+ * KeyId returns the id of the key used for encrypting,
+ * which identifies the key without revealing it
+ * @return string
+ */
+func (e *Encrypter) KeyId() string {
+	return e.key.id
+}
+
+/**
+ * Encrypt encrypts everything read from src and writes it to dst.
+ * The archive is split in chunks that are sealed separately, each
+ * chunk authenticating the header and whether it's the last chunk,
+ * so chunks can't be reordered, dropped or swapped between archives.
+ */
+func (e *Encrypter) Encrypt(dst io.Writer, src io.Reader) error {
+	header := make([]byte, 0, headerSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, encryptionVersion)
+	id, _ := hex.DecodeString(e.key.id)
+	header = append(header, id...)
+	header = append(header, e.key.salt...)
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	header = append(header, prefix...)
+
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	buf := make([]byte, encryptionChunkSize)
+	var sealed []byte
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(src, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// the last chunk is never full, so the reader can tell it's the last
+		last := n < encryptionChunkSize
+
+		sealed = e.key.aead.Seal(sealed[:0], chunkNonce(prefix, counter), buf[:n], chunkData(header, last))
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+/**
+ * Decrypt decrypts an archive read from src and writes the plaintext to dst.
+ * Fails if the archive was encrypted with a different key or has been
+ * tampered with. Since chunks are written as soon as they are verified,
+ * dst may hold part of the plaintext when the archive turns out to be
+ * truncated or corrupt.
+ */
+func (e *Encrypter) Decrypt(dst io.Writer, src io.Reader) error {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return errTruncated
+	}
+	key, prefix, err := e.parseHeader(header)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, encryptionChunkSize+key.aead.Overhead())
+	var plain []byte
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(src, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				return errTruncated
+			}
+			return err
+		}
+		last := n < len(buf)
+
+		plain, err = key.aead.Open(plain[:0], chunkNonce(prefix, counter), buf[:n], chunkData(header, last))
+		if err != nil {
+			return fmt.Errorf("Chunk %d of encrypted archive is corrupt", counter)
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			if n, _ := src.Read(buf[:1]); n > 0 {
+				return errors.New("Encrypted archive has data following the last chunk")
+			}
+			return nil
+		}
+	}
+}
+
+/**
+ * parseHeader checks the header of an encrypted archive and
+ * returns the key it was encrypted with and its nonce prefix
+ */
+func (e *Encrypter) parseHeader(header []byte) (*encryptionKey, []byte, error) {
+	version, keyId, salt, err := parseEncryptionHeader(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version != encryptionVersion {
+		return nil, nil, fmt.Errorf("Unsupported encryption format version %d", version)
+	}
+
+	key, err := e.findKey(keyId, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, header[headerSize-noncePrefixSize:], nil
+}
+
+/**
+ * findKey returns the key with the given id. For a passphrase
+ * the key is derived again if it was derived with another salt.
+ */
+func (e *Encrypter) findKey(keyId string, salt []byte) (*encryptionKey, error) {
+	if keyId == e.key.id {
+		return e.key, nil
+	}
+	if e.passphrase == "" {
+		return nil, fmt.Errorf("Archive was encrypted with key %s, but the configured key is %s", keyId, e.key.id)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	key, ok := e.derived[hex.EncodeToString(salt)]
+	if !ok {
+		var err error
+		key, err = newEncryptionKey(pbkdf2(sha256.New, []byte(e.passphrase), salt, kdfIterations, 32), salt)
+		if err != nil {
+			return nil, err
+		}
+		e.derived[hex.EncodeToString(salt)] = key
+	}
+
+	if key.id != keyId {
+		return nil, fmt.Errorf("Archive was encrypted with key %s, which is not derived from the configured passphrase", keyId)
+	}
+	return key, nil
+}
+
+/**
+ * parseEncryptionHeader returns the format version, key id and
+ * salt from the header of an encrypted archive
+ */
+func parseEncryptionHeader(header []byte) (int, string, []byte, error) {
+	if len(header) < headerSize || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return 0, "", nil, errors.New("Archive is not encrypted by gobackup")
+	}
+	header = header[len(encryptionMagic):]
+	return int(header[0]), hex.EncodeToString(header[1 : 1+keyIdSize]), header[1+keyIdSize : 1+keyIdSize+saltSize], nil
+}
+
+/**
+ * EncryptDescription returns the description of an encrypted archive.
+ * The plaintext description holds the hash and path of the content,
+ * so it is encrypted as well. If the encrypted description is too long
+ * for Glacier the path is left out.
+ * @param codec string Codec the content is compressed with, if any
+ */
+func (e *Encrypter) EncryptDescription(hash, path, codec string) (string, error) {
+	for _, plain := range []string{describeArchive(hash, path, codec), strings.TrimSpace(codec + " " + hash)} {
+		var sealed bytes.Buffer
+		if err := e.Encrypt(&sealed, strings.NewReader(plain)); err != nil {
+			return "", err
+		}
+		description := encryptedDescriptionPrefix + base64.StdEncoding.EncodeToString(sealed.Bytes())
+		if len(description) <= maxDescriptionLength {
+			return description, nil
+		}
+	}
+	return "", errors.New("Hash is too long to describe an encrypted archive")
+}
+
+/**
+ * DecryptDescription returns the plaintext description of an encrypted archive
+ */
+func (e *Encrypter) DecryptDescription(description string) (string, error) {
+	sealed, err := decodeDescription(description)
+	if err != nil {
+		return "", err
+	}
+
+	var plain bytes.Buffer
+	if err := e.Decrypt(&plain, bytes.NewReader(sealed)); err != nil {
+		return "", err
+	}
+	return plain.String(), nil
+}
+
+/**
+ * isEncryptedDescription checks if a description is of an encrypted archive
+ */
+func isEncryptedDescription(description string) bool {
+	return strings.HasPrefix(description, encryptedDescriptionPrefix)
+}
+
+/**
+ * describedKeyId returns the format version and key id of an encrypted
+ * archive from its description, which doesn't need the key
+ */
+func describedKeyId(description string) (int, string, error) {
+	sealed, err := decodeDescription(description)
+	if err != nil {
+		return 0, "", err
+	}
+	version, keyId, _, err := parseEncryptionHeader(sealed)
+	return version, keyId, err
+}
+
+func decodeDescription(description string) ([]byte, error) {
+	if !isEncryptedDescription(description) {
+		return nil, errors.New("Description is not encrypted")
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimPrefix(description, encryptedDescriptionPrefix))
+}
+
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, noncePrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	return nonce
+}
+
+func chunkData(header []byte, last bool) []byte {
+	data := make([]byte, len(header)+1)
+	copy(data, header)
+	if last {
+		data[len(header)] = 1
+	}
+	return data
+}
+
+/**
+ * pbkdf2 derives a key of keyLen bytes from a password and salt
+ * as described in RFC 2898, using HMAC with the given hash
+ */
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(h, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestEncrypter(t *testing.T, passphrase string) *Encrypter {
+	encrypter, err := NewPassphraseEncrypter(passphrase, []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("Unable to create encrypter: %s", err)
+	}
+	return encrypter
+}
+
+func TestEncryptAndDecrypt(t *testing.T) {
+	encrypter := newTestEncrypter(t, "secret")
+
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, encryptionChunkSize + 1, 3*encryptionChunkSize + 5} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		var sealed bytes.Buffer
+		if err := encrypter.Encrypt(&sealed, bytes.NewReader(plain)); err != nil {
+			t.Fatalf("Unable to encrypt %d bytes: %s", size, err)
+		}
+		// a few random bytes can occur in the ciphertext by chance
+		if size >= 16 && bytes.Contains(sealed.Bytes(), plain) {
+			t.Errorf("Encrypted %d bytes contain the plaintext", size)
+		}
+
+		var decrypted bytes.Buffer
+		if err := encrypter.Decrypt(&decrypted, bytes.NewReader(sealed.Bytes())); err != nil {
+			t.Errorf("Unable to decrypt %d bytes: %s", size, err)
+		} else if !bytes.Equal(decrypted.Bytes(), plain) {
+			t.Errorf("Decryption of %d bytes does not match the plaintext", size)
+		}
+	}
+}
+
+func TestDecryptTamperedArchive(t *testing.T) {
+	encrypter := newTestEncrypter(t, "secret")
+
+	plain := make([]byte, 2*encryptionChunkSize+100)
+	rand.Read(plain)
+	var buf bytes.Buffer
+	encrypter.Encrypt(&buf, bytes.NewReader(plain))
+	sealed := buf.Bytes()
+	chunk := encryptionChunkSize + 16
+
+	flipped := append([]byte{}, sealed...)
+	flipped[headerSize+chunk+10] ^= 1
+	swapped := append([]byte{}, sealed[:headerSize]...)
+	swapped = append(swapped, sealed[headerSize+chunk:headerSize+2*chunk]...)
+	swapped = append(swapped, sealed[headerSize:headerSize+chunk]...)
+	swapped = append(swapped, sealed[headerSize+2*chunk:]...)
+
+	tests := map[string][]byte{
+		"flipped bit":     flipped,
+		"swapped chunks":  swapped,
+		"dropped chunk":   sealed[:headerSize+2*chunk],
+		"truncated chunk": sealed[:len(sealed)-1],
+		"trailing data":   append(append([]byte{}, sealed...), 0),
+		"short header":    sealed[:headerSize-1],
+	}
+	for name, archive := range tests {
+		if err := encrypter.Decrypt(ioutil.Discard, bytes.NewReader(archive)); err == nil {
+			t.Errorf("Expected decryption of archive with %s to fail", name)
+		}
+	}
+}
+
+func TestDecryptWithOtherKey(t *testing.T) {
+	var sealed bytes.Buffer
+	newTestEncrypter(t, "secret").Encrypt(&sealed, strings.NewReader("plaintext"))
+
+	err := newTestEncrypter(t, "other").Decrypt(ioutil.Discard, bytes.NewReader(sealed.Bytes()))
+	if err == nil || !strings.Contains(err.Error(), "not derived from the configured passphrase") {
+		t.Errorf("Expected decryption with another passphrase to fail, got %v", err)
+	}
+
+	// archives encrypted with an older salt are decrypted with the same passphrase
+	other, _ := NewPassphraseEncrypter("secret", []byte("fedcba9876543210"))
+	if other.KeyId() == newTestEncrypter(t, "secret").KeyId() {
+		t.Errorf("Keys derived with different salts should differ")
+	}
+	var plain bytes.Buffer
+	if err := other.Decrypt(&plain, bytes.NewReader(sealed.Bytes())); err != nil || plain.String() != "plaintext" {
+		t.Errorf("Expected archive with another salt to be decrypted, got `%s` (%v)", plain.String(), err)
+	}
+}
+
+func TestKeyFileEncrypter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gobackup-key")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	raw := filepath.Join(dir, "raw.key")
+	ioutil.WriteFile(raw, key, 0600)
+	encoded := filepath.Join(dir, "hex.key")
+	ioutil.WriteFile(encoded, []byte(hex.EncodeToString(key)+"\n"), 0600)
+	short := filepath.Join(dir, "short.key")
+	ioutil.WriteFile(short, key[:16], 0600)
+
+	fromRaw, err := NewKeyFileEncrypter(raw)
+	if err != nil {
+		t.Fatalf("Unable to read raw key file: %s", err)
+	}
+	fromHex, err := NewKeyFileEncrypter(encoded)
+	if err != nil {
+		t.Fatalf("Unable to read hex encoded key file: %s", err)
+	}
+	if fromRaw.KeyId() != fromHex.KeyId() {
+		t.Errorf("Raw and hex encoded key files should hold the same key")
+	}
+
+	if _, err := NewKeyFileEncrypter(short); err == nil {
+		t.Errorf("Expected key file with 16 bytes to be rejected")
+	}
+
+	var sealed bytes.Buffer
+	fromRaw.Encrypt(&sealed, strings.NewReader("plaintext"))
+	if err := newTestEncrypter(t, "secret").Decrypt(ioutil.Discard, bytes.NewReader(sealed.Bytes())); err == nil {
+		t.Errorf("Expected decryption with a passphrase of an archive encrypted with a key file to fail")
+	}
+	var plain bytes.Buffer
+	if err := fromHex.Decrypt(&plain, bytes.NewReader(sealed.Bytes())); err != nil || plain.String() != "plaintext" {
+		t.Errorf("Expected archive to be decrypted with the same key, got `%s` (%v)", plain.String(), err)
+	}
+}
+
+func TestEncryptDescription(t *testing.T) {
+	encrypter := newTestEncrypter(t, "secret")
+	hash := "7e240de74fb1ed08fa08d38063f6a6a91462a815"
+
+	tests := map[string]string{
+		"/tmp/foo.txt":                      archiveDescription(hash, "/tmp/foo.txt"),
+		"/tmp/" + strings.Repeat("a", 1000): hash,
+	}
+	for path, expected := range tests {
+		description, err := encrypter.EncryptDescription(hash, path, "")
+		if err != nil {
+			t.Fatalf("Unable to encrypt description: %s", err)
+		}
+		if len(description) > maxDescriptionLength || strings.Contains(description, hash) || strings.Contains(description, "tmp") {
+			t.Errorf("Encrypted description `%s` is too long or contains the plaintext", description)
+		}
+		if !isEncryptedDescription(description) {
+			t.Errorf("Description `%s` should be recognised as encrypted", description)
+		}
+
+		if version, keyId, err := describedKeyId(description); err != nil || version != encryptionVersion || keyId != encrypter.KeyId() {
+			t.Errorf("Expected version %d and key %s in description, got %d and %s (%v)", encryptionVersion, encrypter.KeyId(), version, keyId, err)
+		}
+
+		if actual, err := encrypter.DecryptDescription(description); err != nil || actual != expected {
+			t.Errorf("Expected description `%s`, got `%s` (%v)", expected, actual, err)
+		}
+	}
+}
+
+func TestPbkdf2(t *testing.T) {
+	// test vectors from RFC 7914
+	tests := []struct {
+		password, salt string
+		iterations     int
+		expected       string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+
+	for _, test := range tests {
+		if actual := hex.EncodeToString(pbkdf2(sha256.New, []byte(test.password), []byte(test.salt), test.iterations, 64)); actual != test.expected {
+			t.Errorf("Expected derived key %s for `%s`, got %s", test.expected, test.password, actual)
+		}
+	}
+}
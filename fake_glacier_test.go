@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/rdwilliamson/aws"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * fakeGlacier is an in-memory stand-in for the Glacier REST API, covering
+ * the vault, archive, multipart, job and inventory calls the vendored client
+ * makes. Tree hashes sent by the client are verified like Glacier does.
+ * Failures can be injected per operation and every request can be delayed.
+ */
+type fakeGlacier struct {
+	// latency delays every request before it's handled
+	latency time.Duration
+	// jobDuration is how long jobs take to complete
+	jobDuration time.Duration
+	// pageSize is the number of jobs and multipart uploads per page
+	pageSize int
+	// failures is the number of upcoming requests per operation
+	// to fail with an internal server error
+	failures map[string]int
+	// failWhen fails every request it returns true for
+	failWhen func(operation string, r *http.Request) bool
+	// requests counts the handled requests per operation
+	requests map[string]int
+	vaults   map[string]*fakeVault
+	lastId   int
+	mu       sync.Mutex
+}
+
+type fakeVault struct {
+	created  time.Time
+	archives map[string]*fakeArchive
+	uploads  map[string]*fakeUpload
+	jobs     map[string]*fakeJob
+}
+
+type fakeArchive struct {
+	description string
+	data        []byte
+	treeHash    string
+	created     time.Time
+}
+
+type fakeUpload struct {
+	description string
+	partSize    int64
+	parts       map[int64][]byte
+	created     time.Time
+}
+
+type fakeJob struct {
+	action      string
+	archiveId   string
+	description string
+	created     time.Time
+	// archive is the retrieved archive, inventory the
+	// archives in the vault when the job was initiated
+	archive   *fakeArchive
+	inventory map[string]*fakeArchive
+}
+
+func newFakeGlacier() *fakeGlacier {
+	return &fakeGlacier{
+		pageSize: 1000,
+		failures: make(map[string]int),
+		requests: make(map[string]int),
+		vaults:   make(map[string]*fakeVault),
+	}
+}
+
+/**
+ * newTestGlacierBackend starts a fake Glacier and returns a
+ * backend connected to it. Close the server when done.
+ */
+func newTestGlacierBackend() (*glacierBackend, *fakeGlacier, *httptest.Server) {
+	fake := newFakeGlacier()
+	server := httptest.NewServer(fake)
+	backend, _ := NewGlacierBackend("secret", "access", aws.USEast1, server.URL, nil)
+	return backend, fake, server
+}
+
+/**
+ * failNext makes the next n requests of an operation fail
+ */
+func (f *fakeGlacier) failNext(operation string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[operation] = n
+}
+
+/**
+ * setFailWhen makes every request fail that fail returns true for,
+ * nil stops failing requests
+ */
+func (f *fakeGlacier) setFailWhen(fail func(operation string, r *http.Request) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failWhen = fail
+}
+
+/**
+ * count returns the number of requests of an operation handled so far
+ */
+func (f *fakeGlacier) count(operation string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[operation]
+}
+
+/**
+ * vault returns the vault with the given name, or nil if it doesn't exist
+ */
+func (f *fakeGlacier) vault(name string) *fakeVault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.vaults[name]
+}
+
+func (f *fakeGlacier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(f.latency)
+	body, _ := ioutil.ReadAll(r.Body)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		f.error(w, http.StatusForbidden, "MissingAuthenticationTokenException", "Missing or invalid credentials")
+		return
+	}
+	if hash := r.Header.Get("x-amz-content-sha256"); hash != "" && hash != fmt.Sprintf("%x", sha256.Sum256(body)) {
+		f.error(w, http.StatusBadRequest, "InvalidParameterValueException", "Content hash does not match the body")
+		return
+	}
+
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/-/vaults"), "/")
+	operation := operationName(r.Method, path)
+	f.requests[operation]++
+	if f.failures[operation] > 0 || (f.failWhen != nil && f.failWhen(operation, r)) {
+		if f.failures[operation] > 0 {
+			f.failures[operation]--
+		}
+		f.error(w, http.StatusInternalServerError, "ServiceUnavailableException", "Injected failure of "+operation)
+		return
+	}
+
+	switch operation {
+	case "ListVaults":
+		f.listVaults(w)
+		return
+	case "CreateVault":
+		if f.vaults[path[1]] == nil {
+			f.vaults[path[1]] = &fakeVault{
+				created:  time.Now(),
+				archives: make(map[string]*fakeArchive),
+				uploads:  make(map[string]*fakeUpload),
+				jobs:     make(map[string]*fakeJob),
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+	case "Unknown":
+		f.error(w, http.StatusNotFound, "ResourceNotFoundException", "Unknown resource "+r.URL.Path)
+		return
+	}
+
+	vault := f.vaults[path[1]]
+	if vault == nil {
+		f.error(w, http.StatusNotFound, "ResourceNotFoundException", "Vault not found: "+path[1])
+		return
+	}
+
+	switch operation {
+	case "UploadArchive":
+		f.uploadArchive(w, r, vault, path[1], body)
+	case "DeleteArchive":
+		if vault.archives[path[3]] == nil {
+			f.error(w, http.StatusNotFound, "ResourceNotFoundException", "Archive not found: "+path[3])
+			return
+		}
+		delete(vault.archives, path[3])
+		w.WriteHeader(http.StatusNoContent)
+	case "InitiateMultipart":
+		partSize, _ := strconv.ParseInt(r.Header.Get("x-amz-part-size"), 10, 64)
+		uploadId := f.newId()
+		vault.uploads[uploadId] = &fakeUpload{
+			description: r.Header.Get("x-amz-archive-description"),
+			partSize:    partSize,
+			parts:       make(map[int64][]byte),
+			created:     time.Now(),
+		}
+		w.Header().Set("x-amz-multipart-upload-id", uploadId)
+		w.WriteHeader(http.StatusCreated)
+	case "ListMultipartUploads":
+		f.listMultipartUploads(w, r, vault, path[1])
+	case "UploadMultipart", "CompleteMultipart", "AbortMultipart", "ListMultipartParts":
+		upload := vault.uploads[path[3]]
+		if upload == nil {
+			f.error(w, http.StatusNotFound, "ResourceNotFoundException", "Multipart upload not found: "+path[3])
+			return
+		}
+		f.multipart(w, r, operation, vault, path[1], path[3], upload, body)
+	case "InitiateJob":
+		f.initiateJob(w, vault, body)
+	case "ListJobs":
+		f.listJobs(w, r, vault, path[1])
+	case "DescribeJob", "GetJobOutput":
+		job := vault.jobs[path[3]]
+		if job == nil {
+			f.error(w, http.StatusNotFound, "ResourceNotFoundException", "Job not found: "+path[3])
+			return
+		}
+		if operation == "DescribeJob" {
+			f.json(w, http.StatusOK, f.describeJob(path[1], path[3], job))
+			return
+		}
+		f.jobOutput(w, r, path[1], job)
+	}
+}
+
+/**
+ * operationName maps a request to the name of the Glacier operation,
+ * path being the url path following /-/vaults split by slashes
+ */
+func operationName(method string, path []string) string {
+	var operations map[string]string
+	switch {
+	case len(path) == 1 && path[0] == "":
+		operations = map[string]string{"GET": "ListVaults"}
+	case len(path) == 2:
+		operations = map[string]string{"PUT": "CreateVault"}
+	case len(path) == 3 && path[2] == "archives":
+		operations = map[string]string{"POST": "UploadArchive"}
+	case len(path) == 4 && path[2] == "archives":
+		operations = map[string]string{"DELETE": "DeleteArchive"}
+	case len(path) == 3 && path[2] == "multipart-uploads":
+		operations = map[string]string{"POST": "InitiateMultipart", "GET": "ListMultipartUploads"}
+	case len(path) == 4 && path[2] == "multipart-uploads":
+		operations = map[string]string{"PUT": "UploadMultipart", "POST": "CompleteMultipart", "DELETE": "AbortMultipart", "GET": "ListMultipartParts"}
+	case len(path) == 3 && path[2] == "jobs":
+		operations = map[string]string{"POST": "InitiateJob", "GET": "ListJobs"}
+	case len(path) == 4 && path[2] == "jobs":
+		operations = map[string]string{"GET": "DescribeJob"}
+	case len(path) == 5 && path[2] == "jobs" && path[4] == "output":
+		operations = map[string]string{"GET": "GetJobOutput"}
+	}
+
+	if operation, ok := operations[method]; ok {
+		return operation
+	}
+	return "Unknown"
+}
+
+func (f *fakeGlacier) listVaults(w http.ResponseWriter) {
+	type vault struct {
+		CreationDate string
+		VaultName    string
+	}
+	result := struct {
+		Marker    *string
+		VaultList []vault
+	}{VaultList: []vault{}}
+	for name, v := range f.vaults {
+		result.VaultList = append(result.VaultList, vault{v.created.UTC().Format(time.RFC3339), name})
+	}
+	f.json(w, http.StatusOK, result)
+}
+
+func (f *fakeGlacier) uploadArchive(w http.ResponseWriter, r *http.Request, vault *fakeVault, name string, body []byte) {
+	treeHash := fakeTreeHash(body)
+	if r.Header.Get("x-amz-sha256-tree-hash") != treeHash {
+		f.error(w, http.StatusBadRequest, "InvalidParameterValueException", "Tree hash does not match the archive")
+		return
+	}
+
+	archiveId := f.newId()
+	vault.archives[archiveId] = &fakeArchive{
+		description: r.Header.Get("x-amz-archive-description"),
+		data:        body,
+		treeHash:    treeHash,
+		created:     time.Now(),
+	}
+	w.Header().Set("Location", "/-/vaults/"+name+"/archives/"+archiveId)
+	w.Header().Set("x-amz-sha256-tree-hash", treeHash)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeGlacier) multipart(w http.ResponseWriter, r *http.Request, operation string, vault *fakeVault, name, uploadId string, upload *fakeUpload, body []byte) {
+	switch operation {
+	case "UploadMultipart":
+		var start, end int64
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/*", &start, &end); err != nil || end-start+1 != int64(len(body)) {
+			f.error(w, http.StatusBadRequest, "InvalidParameterValueException", "Invalid content range")
+			return
+		}
+		if start%upload.partSize != 0 || int64(len(body)) > upload.partSize {
+			f.error(w, http.StatusBadRequest, "InvalidParameterValueException", "Range does not match the part size")
+			return
+		}
+		if r.Header.Get("x-amz-sha256-tree-hash") != fakeTreeHash(body) {
+			f.error(w, http.StatusBadRequest, "InvalidParameterValueException", "Tree hash does not match the part")
+			return
+		}
+		upload.parts[start] = body
+		w.WriteHeader(http.StatusNoContent)
+
+	case "CompleteMultipart":
+		var data []byte
+		for _, start := range upload.sortedParts() {
+			if start != int64(len(data)) {
+				f.error(w, http.StatusBadRequest, "InvalidParameterValueException", "Missing part at "+strconv.FormatInt(int64(len(data)), 10))
+				return
+			}
+			data = append(data, upload.parts[start]...)
+		}
+		treeHash := fakeTreeHash(data)
+		if r.Header.Get("x-amz-archive-size") != strconv.Itoa(len(data)) || r.Header.Get("x-amz-sha256-tree-hash") != treeHash {
+			f.error(w, http.StatusBadRequest, "InvalidParameterValueException", "Size or tree hash does not match the uploaded parts")
+			return
+		}
+
+		archiveId := f.newId()
+		vault.archives[archiveId] = &fakeArchive{
+			description: upload.description,
+			data:        data,
+			treeHash:    treeHash,
+			created:     time.Now(),
+		}
+		delete(vault.uploads, uploadId)
+		w.Header().Set("Location", "/-/vaults/"+name+"/archives/"+archiveId)
+		w.Header().Set("x-amz-archive-id", archiveId)
+		w.Header().Set("x-amz-sha256-tree-hash", treeHash)
+		w.WriteHeader(http.StatusCreated)
+
+	case "AbortMultipart":
+		delete(vault.uploads, uploadId)
+		w.WriteHeader(http.StatusNoContent)
+
+	case "ListMultipartParts":
+		type part struct {
+			RangeInBytes   string
+			SHA256TreeHash string
+		}
+		result := struct {
+			ArchiveDescription string
+			CreationDate       string
+			Marker             *string
+			MultipartUploadId  string
+			PartSizeInBytes    int64
+			Parts              []part
+			VaultARN           string
+		}{
+			ArchiveDescription: upload.description,
+			CreationDate:       upload.created.UTC().Format(time.RFC3339),
+			MultipartUploadId:  uploadId,
+			PartSizeInBytes:    upload.partSize,
+			Parts:              []part{},
+			VaultARN:           vaultARN(name),
+		}
+		for _, start := range upload.sortedParts() {
+			data := upload.parts[start]
+			result.Parts = append(result.Parts, part{
+				fmt.Sprintf("%d-%d", start, start+int64(len(data))-1),
+				fakeTreeHash(data),
+			})
+		}
+		f.json(w, http.StatusOK, result)
+	}
+}
+
+func (f *fakeGlacier) listMultipartUploads(w http.ResponseWriter, r *http.Request, vault *fakeVault, name string) {
+	type upload struct {
+		ArchiveDescription string
+		CreationDate       string
+		MultipartUploadId  string
+		PartSizeInBytes    int64
+		VaultARN           string
+	}
+	var ids []string
+	for id := range vault.uploads {
+		ids = append(ids, id)
+	}
+	page, marker := f.page(ids, r.Header.Get("marker"))
+
+	result := struct {
+		Marker      *string
+		UploadsList []upload
+	}{Marker: marker, UploadsList: []upload{}}
+	for _, id := range page {
+		u := vault.uploads[id]
+		result.UploadsList = append(result.UploadsList, upload{u.description, u.created.UTC().Format(time.RFC3339), id, u.partSize, vaultARN(name)})
+	}
+	f.json(w, http.StatusOK, result)
+}
+
+func (f *fakeGlacier) initiateJob(w http.ResponseWriter, vault *fakeVault, body []byte) {
+	var request struct {
+		Type        string
+		ArchiveId   string
+		Description string
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		f.error(w, http.StatusBadRequest, "InvalidParameterValueException", "Invalid job parameters")
+		return
+	}
+
+	job := &fakeJob{
+		archiveId:   request.ArchiveId,
+		description: request.Description,
+		created:     time.Now(),
+	}
+	switch request.Type {
+	case "archive-retrieval":
+		job.action = "ArchiveRetrieval"
+		job.archive = vault.archives[request.ArchiveId]
+		if job.archive == nil {
+			f.error(w, http.StatusNotFound, "ResourceNotFoundException", "Archive not found: "+request.ArchiveId)
+			return
+		}
+	case "inventory-retrieval":
+		job.action = "InventoryRetrieval"
+		job.inventory = make(map[string]*fakeArchive)
+		for id, archive := range vault.archives {
+			job.inventory[id] = archive
+		}
+	default:
+		f.error(w, http.StatusBadRequest, "InvalidParameterValueException", "Invalid job type "+request.Type)
+		return
+	}
+
+	jobId := f.newId()
+	vault.jobs[jobId] = job
+	w.Header().Set("x-amz-job-id", jobId)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (f *fakeGlacier) listJobs(w http.ResponseWriter, r *http.Request, vault *fakeVault, name string) {
+	var ids []string
+	for id := range vault.jobs {
+		ids = append(ids, id)
+	}
+	page, marker := f.page(ids, r.URL.Query().Get("marker"))
+
+	result := struct {
+		Marker  *string
+		JobList []interface{}
+	}{Marker: marker, JobList: []interface{}{}}
+	for _, id := range page {
+		result.JobList = append(result.JobList, f.describeJob(name, id, vault.jobs[id]))
+	}
+	f.json(w, http.StatusOK, result)
+}
+
+func (f *fakeGlacier) describeJob(name, jobId string, job *fakeJob) interface{} {
+	completed := time.Since(job.created) >= f.jobDuration
+	result := map[string]interface{}{
+		"Action":         job.action,
+		"Completed":      completed,
+		"CreationDate":   job.created.UTC().Format(time.RFC3339),
+		"JobDescription": job.description,
+		"JobId":          jobId,
+		"StatusCode":     "InProgress",
+		"VaultARN":       vaultARN(name),
+	}
+	if job.archive != nil {
+		result["ArchiveId"] = job.archiveId
+		result["ArchiveSizeInBytes"] = len(job.archive.data)
+		result["SHA256TreeHash"] = job.archive.treeHash
+	}
+	if completed {
+		result["CompletionDate"] = job.created.Add(f.jobDuration).UTC().Format(time.RFC3339)
+		result["StatusCode"] = "Succeeded"
+	}
+	return result
+}
+
+func (f *fakeGlacier) jobOutput(w http.ResponseWriter, r *http.Request, name string, job *fakeJob) {
+	if time.Since(job.created) < f.jobDuration {
+		f.error(w, http.StatusBadRequest, "InvalidParameterValueException", "The job is not currently available for download")
+		return
+	}
+
+	if job.archive == nil {
+		type archive struct {
+			ArchiveId          string
+			ArchiveDescription string
+			CreationDate       string
+			Size               int
+			SHA256TreeHash     string
+		}
+		result := struct {
+			VaultARN      string
+			InventoryDate string
+			ArchiveList   []archive
+		}{
+			VaultARN:      vaultARN(name),
+			InventoryDate: job.created.UTC().Format(time.RFC3339),
+			ArchiveList:   []archive{},
+		}
+		for id, a := range job.inventory {
+			result.ArchiveList = append(result.ArchiveList, archive{id, a.description, a.created.UTC().Format(time.RFC3339), len(a.data), a.treeHash})
+		}
+		f.json(w, http.StatusOK, result)
+		return
+	}
+
+	data := job.archive.data
+	status := http.StatusOK
+	if header := r.Header.Get("Range"); header != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(header, "bytes=%d-%d", &start, &end); err != nil || start > end || end >= len(data) {
+			f.error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidParameterValueException", "Invalid range "+header)
+			return
+		}
+		// Glacier only returns the tree hash of tree hash aligned ranges
+		if start%(1024*1024) == 0 && ((end+1)%(1024*1024) == 0 || end == len(data)-1) {
+			w.Header().Set("x-amz-sha256-tree-hash", fakeTreeHash(data[start:end+1]))
+		}
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	} else {
+		w.Header().Set("x-amz-sha256-tree-hash", job.archive.treeHash)
+	}
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+/**
+ * page returns the ids following marker, sorted and limited to the
+ * page size, along with the marker of the next page if there is one
+ */
+func (f *fakeGlacier) page(ids []string, marker string) ([]string, *string) {
+	sort.Strings(ids)
+	start := sort.SearchStrings(ids, marker)
+	if start+f.pageSize >= len(ids) {
+		return ids[start:], nil
+	}
+	next := ids[start+f.pageSize]
+	return ids[start : start+f.pageSize], &next
+}
+
+func (f *fakeGlacier) newId() string {
+	f.lastId++
+	return fmt.Sprintf("fake-%06d", f.lastId)
+}
+
+func (f *fakeGlacier) json(w http.ResponseWriter, status int, v interface{}) {
+	data, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func (f *fakeGlacier) error(w http.ResponseWriter, status int, code, message string) {
+	f.json(w, status, map[string]string{"code": code, "message": message, "type": "Client"})
+}
+
+func (u *fakeUpload) sortedParts() []int64 {
+	var starts int64Slice
+	for start := range u.parts {
+		starts = append(starts, start)
+	}
+	sort.Sort(starts)
+	return starts
+}
+
+func vaultARN(name string) string {
+	return "arn:aws:glacier:us-east-1:012345678901:vaults/" + name
+}
+
+func fakeTreeHash(data []byte) string {
+	_, treeHash, _ := copyWithTreeHash(ioutil.Discard, bytes.NewReader(data))
+	return treeHash
+}
@@ -14,6 +14,9 @@ import (
 type File struct {
 	filename string
 	hash     string
+	// archiveHashes are nil if the hash was taken from the archive
+	archiveHashes *ArchiveHashes
+	stat          *FileStat
 }
 
 /**
@@ -44,18 +47,65 @@ func (f *File) Hash() (string, error) {
 	if f.hash != "" {
 		return f.hash, nil
 	}
+	if err := f.hashContent(); err != nil {
+		return "", err
+	}
+	return f.hash, nil
+}
+
+/**
+ * ArchiveHashes calculates the hashes Glacier needs to store
+ * the file as an archive and caches them. They are calculated
+ * along with the SHA1-hash, so usually they are cached already.
+ * @return *ArchiveHashes
+ */
+func (f *File) ArchiveHashes() (*ArchiveHashes, error) {
+	if f.archiveHashes != nil {
+		return f.archiveHashes, nil
+	}
+	if err := f.hashContent(); err != nil {
+		return nil, err
+	}
+	return f.archiveHashes, nil
+}
+
+/**
+ * hashContent calculates both the SHA1-hash
+ * and the archive hashes of the file in a single read
+ */
+func (f *File) hashContent() error {
 	rawReader, err := os.Open(f.filename)
-	defer rawReader.Close()
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer rawReader.Close()
 
-	reader := bufio.NewReaderSize(rawReader, 1024*1024)
 	hasher := sha1.New()
-	_, err = io.Copy(hasher, reader)
+	archiveHasher := newArchiveHasher()
+	_, err = copyToTreeHash(io.MultiWriter(hasher, archiveHasher), bufio.NewReaderSize(rawReader, 1024*1024))
 	if err != nil {
-		return "", err
+		return err
 	}
-	f.hash = string(fmt.Sprintf("%x", hasher.Sum(nil)))
-	return f.hash, nil
+
+	f.hash = fmt.Sprintf("%x", hasher.Sum(nil))
+	f.archiveHashes = archiveHasher.Sum()
+	return nil
+}
+
+/**
+ * Stat returns the size, modification time, inode and
+ * device of the file and caches them. Any consecutive
+ * call of Stat will return the cached value.
+ * @return *FileStat
+ */
+func (f *File) Stat() (*FileStat, error) {
+	if f.stat != nil {
+		return f.stat, nil
+	}
+	info, err := os.Stat(f.filename)
+	if err != nil {
+		return nil, err
+	}
+	f.stat = newFileStat(info)
+	return f.stat, nil
 }
@@ -1,11 +1,133 @@
 package main
 
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+/**
+ * filechecker verifies the files in an archive against the filesystem
+ */
 type filechecker struct {
-	archive *archive
+	archive    *archive
+	sampleRate float64
+	threads    int
+	random     *rand.Rand
+}
+
+/**
+ * CheckReport lists the problems found by a filechecker
+ */
+type CheckReport struct {
+	Checked  int
+	Changed  []*ArchivedFile
+	Missing  []*ArchivedFile
+	NoUpload []*ArchivedFile
+}
+
+/**
+ * HasProblems checks if any problems were found
+ * @return bool
+ */
+func (c *CheckReport) HasProblems() bool {
+	return len(c.Changed) > 0 || len(c.Missing) > 0 || len(c.NoUpload) > 0
 }
 
-func NewFileChecker(archive *archive) (*filechecker, error) {
+/**
+ * NewFileChecker creates a new filechecker instance
+ * @param sampleRate float64 Fraction of the files to check, between 0 (exclusive) and 1
+ * @param threads int Number of files to hash in parallel
+ */
+func NewFileChecker(archive *archive, sampleRate float64, threads int) (*filechecker, error) {
+	if sampleRate <= 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("Sample rate must be larger than 0 and at most 1, got %g", sampleRate)
+	}
+
+	if threads < 1 {
+		return nil, fmt.Errorf("Need at least one thread")
+	}
+
 	return &filechecker{
-		archive: archive,
+		archive:    archive,
+		sampleRate: sampleRate,
+		threads:    threads,
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
 	}, nil
 }
+
+/**
+ * Check re-hashes a random sample of the files in the archive and reports
+ * files whose content changed without being uploaded again and files that
+ * disappeared from disk. All files in the archive that have no upload are
+ * reported as well, regardless of the sample rate.
+ */
+func (f *filechecker) Check() (*CheckReport, error) {
+	files, err := f.archive.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	noUpload, err := f.archive.ListFilesWithoutUpload()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CheckReport{NoUpload: noUpload}
+
+	sample := make(chan *ArchivedFile, 100)
+	var mu sync.Mutex
+	var checkers sync.WaitGroup
+	for i := 0; i < f.threads; i++ {
+		checkers.Add(1)
+		go func() {
+			defer checkers.Done()
+			for file := range sample {
+				missing, changed := f.checkFile(file)
+				mu.Lock()
+				report.Checked++
+				if missing {
+					report.Missing = append(report.Missing, file)
+				}
+				if changed {
+					report.Changed = append(report.Changed, file)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, file := range files {
+		if f.sampleRate < 1 && f.random.Float64() >= f.sampleRate {
+			continue
+		}
+		sample <- file
+	}
+	close(sample)
+	checkers.Wait()
+
+	return report, nil
+}
+
+/**
+ * checkFile compares the file on disk with the archive
+ * @return bool missing True if the file no longer exists
+ * @return bool changed True if the content of the file differs from the archive
+ */
+func (f *filechecker) checkFile(file *ArchivedFile) (missing, changed bool) {
+	info, err := os.Stat(file.Filename())
+	if err != nil || info.IsDir() {
+		return true, false
+	}
+
+	hash, err := NewFile(file.Filename()).Hash()
+	if err != nil {
+		log.Printf("Could not calculate hash for %s: %s", file.Filename(), err)
+		return false, false
+	}
+
+	return false, hash != file.Hash()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFileChecker(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	files := []*ArchivedFile{
+		&ArchivedFile{filename: "filesets/fileset1/file1.txt", hash: "32d10c7b8cf96570ca04ce37f2a19d84240d3a89", amazonId: "a1"},
+		&ArchivedFile{filename: "filesets/fileset1/file3.txt", hash: "h12345", amazonId: "a2"},
+		&ArchivedFile{filename: "filesets/fileset1/gone.txt", hash: "h54321", amazonId: "a3"},
+	}
+	for _, file := range files {
+		if err = archive.AddFile(file); err != nil {
+			t.Errorf("File should have been added, but got error: %s", err)
+		}
+	}
+
+	if err = archive.DeleteUpload("a1"); err != nil {
+		t.Errorf("Unexpected error while deleting upload: %s", err)
+	}
+
+	checker, err := NewFileChecker(archive, 1, 2)
+	if err != nil {
+		t.Fatalf("Unable to create file checker: %s", err)
+	}
+
+	report, err := checker.Check()
+	if err != nil {
+		t.Fatalf("Unexpected error while checking files: %s", err)
+	}
+
+	if !report.HasProblems() {
+		t.Errorf("Expected problems to be found")
+	}
+
+	if report.Checked != 2 {
+		t.Errorf("Expected 2 files to be checked, got %d", report.Checked)
+	}
+
+	if len(report.Changed) != 1 || report.Changed[0].Filename() != "filesets/fileset1/file3.txt" {
+		t.Errorf("Expected `filesets/fileset1/file3.txt` to be reported as changed")
+	}
+
+	if len(report.Missing) != 1 || report.Missing[0].Filename() != "filesets/fileset1/gone.txt" {
+		t.Errorf("Expected `filesets/fileset1/gone.txt` to be reported as missing")
+	}
+
+	if len(report.NoUpload) != 1 || report.NoUpload[0].Filename() != "filesets/fileset1/file1.txt" {
+		t.Errorf("Expected `filesets/fileset1/file1.txt` to be reported as not uploaded")
+	}
+}
+
+func TestFileCheckerInvalidSampleRate(t *testing.T) {
+	for _, rate := range []float64{0, -1, 1.5} {
+		if _, err := NewFileChecker(nil, rate, 1); err == nil {
+			t.Errorf("Expected error for sample rate %g", rate)
+		}
+	}
+}
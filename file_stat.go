@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+/**
+ * FileStat holds the metadata of a file used to tell whether
+ * it may have changed since it was last hashed
+ */
+type FileStat struct {
+	size   int64
+	mtime  int64
+	inode  uint64
+	device uint64
+}
+
+/**
+ * newFileStat creates a FileStat from the result of os.Stat
+ * @param info os.FileInfo
+ */
+func newFileStat(info os.FileInfo) *FileStat {
+	inode, device := fileId(info)
+	return &FileStat{
+		size:   info.Size(),
+		mtime:  info.ModTime().UnixNano(),
+		inode:  inode,
+		device: device,
+	}
+}
+
+func (s *FileStat) Size() int64 {
+	return s.size
+}
+
+func (s *FileStat) ModTime() time.Time {
+	return time.Unix(0, s.mtime)
+}
+
+func (s *FileStat) Inode() uint64 {
+	return s.inode
+}
+
+func (s *FileStat) Device() uint64 {
+	return s.device
+}
+
+/**
+ * Equal checks if two stats describe the same, unmodified file
+ * @return bool
+ */
+func (s *FileStat) Equal(other *FileStat) bool {
+	return s != nil && other != nil && *s == *other
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
 	"testing"
 )
 
@@ -22,3 +26,48 @@ func TestHashFile(t *testing.T) {
 		}
 	}
 }
+
+func TestStatFile(t *testing.T) {
+	file := NewFile("filesets/fileset1/file1.txt")
+	stat, err := file.Stat()
+	if err != nil {
+		t.Fatalf("Unexpected error when getting stat for `%s`: %s", file.Filename(), err)
+	}
+
+	info, _ := os.Stat(file.Filename())
+	if stat.Size() != info.Size() || !stat.ModTime().Equal(info.ModTime()) {
+		t.Errorf("Stat for `%s` doesn't match size and modification time of the file", file.Filename())
+	}
+
+	if !stat.Equal(newFileStat(info)) {
+		t.Errorf("Stat for `%s` should equal the stat of the same unmodified file", file.Filename())
+	}
+
+	other, _ := NewFile("filesets/fileset1/file3.txt").Stat()
+	if stat.Equal(other) {
+		t.Errorf("Stats of different files should not be equal")
+	}
+}
+
+func TestArchiveHashesOfFile(t *testing.T) {
+	file := NewFile("filesets/fileset1/file1.txt")
+	if _, err := file.Hash(); err != nil {
+		t.Fatalf("Unexpected error when calculating hash for `%s`: %s", file.Filename(), err)
+	}
+	if file.archiveHashes == nil {
+		t.Errorf("Expected the archive hashes to be calculated along with the hash")
+	}
+
+	data, _ := ioutil.ReadFile(file.Filename())
+	expected, _ := hashArchive(bytes.NewReader(data))
+	if hashes, err := file.ArchiveHashes(); err != nil || !reflect.DeepEqual(hashes, expected) {
+		t.Errorf("Archive hashes for `%s` don't match those of its content (%v)", file.Filename(), err)
+	}
+
+	// the hash may be taken from the archive without reading the file
+	recorded := NewFile("filesets/fileset1/file1.txt")
+	recorded.hash = "32d10c7b8cf96570ca04ce37f2a19d84240d3a89"
+	if hashes, err := recorded.ArchiveHashes(); err != nil || !reflect.DeepEqual(hashes, expected) {
+		t.Errorf("Expected archive hashes to be calculated when only the hash is known (%v)", err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+/**
+ * FileVersion is content a file had during a range of runs
+ */
+type FileVersion struct {
+	filename string
+	hash     string
+	amazonId string
+	firstRun int64
+	lastRun  int64
+	// size is the size of the content, 0 if it
+	// was recorded before sizes were kept
+	size int64
+}
+
+func (f *FileVersion) Filename() string {
+	return f.filename
+}
+
+func (f *FileVersion) Hash() string {
+	return f.hash
+}
+
+/**
+ * AmazonId returns the archive the content is stored in,
+ * or an empty string if it's not stored in Glacier
+ * @return string
+ */
+func (f *FileVersion) AmazonId() string {
+	return f.amazonId
+}
+
+func (f *FileVersion) FirstRun() int64 {
+	return f.firstRun
+}
+
+func (f *FileVersion) LastRun() int64 {
+	return f.lastRun
+}
+
+/**
+ * Size returns the size of the content in bytes,
+ * or 0 if it's unknown
+ * @return int64
+ */
+func (f *FileVersion) Size() int64 {
+	return f.size
+}
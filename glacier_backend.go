@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rdwilliamson/aws"
+	"github.com/rdwilliamson/aws/glacier"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+/**
+ * glacierBackend stores archives in AWS Glacier
+ */
+type glacierBackend struct {
+	*glacier.Connection
+}
+
+/**
+ * NewGlacierBackend creates a backend for AWS Glacier in the given region
+ * @param endpoint string Scheme and host to send requests to instead of
+ *                        the Glacier endpoint of the region, i.e. an emulator
+ *                        or a proxy. Requests are still signed for the region.
+ * @param client *http.Client Client to perform requests with, or nil to use
+ *                            http.DefaultClient
+ */
+func NewGlacierBackend(awsSecret, awsAccess string, awsRegion *aws.Region, endpoint string, client *http.Client) (*glacierBackend, error) {
+	conn := glacier.NewConnection(awsSecret, awsAccess, awsRegion)
+	conn.Client = client
+
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		// the connection sends all requests to the Glacier host of the region
+		region := *awsRegion
+		region.Glacier = u.Host
+		conn.Signature.Region = &region
+
+		// and always uses https
+		if u.Scheme == "http" {
+			conn.Client = withScheme(client, "http")
+		}
+	}
+
+	return &glacierBackend{conn}, nil
+}
+
+func (g *glacierBackend) EnsureVault(vault string) error {
+	marker := ""
+	for {
+		vaults, next, err := g.Connection.ListVaults(marker, 0)
+		if err != nil {
+			return err
+		}
+		for _, v := range vaults {
+			if v.VaultName == vault {
+				return nil
+			}
+		}
+		if next == "" {
+			break
+		}
+		marker = next
+	}
+
+	return g.Connection.CreateVault(vault)
+}
+
+/**
+ * UploadArchive uploads an archive in a single request. When its
+ * hashes are known the archive is only read while sending it.
+ */
+func (g *glacierBackend) UploadArchive(vault string, archive io.ReadSeeker, description string, hashes *ArchiveHashes) (string, error) {
+	if hashes == nil {
+		return g.Connection.UploadArchive(vault, archive, description)
+	}
+
+	// the request must not close the archive, it may be retried
+	request, err := http.NewRequest("POST", "https://"+g.Signature.Region.Glacier+"/-/vaults/"+vault+"/archives", ioutil.NopCloser(archive))
+	if err != nil {
+		return "", err
+	}
+	request.ContentLength = hashes.Size()
+	request.Header.Add("x-amz-glacier-version", "2012-06-01")
+	request.Header.Add("x-amz-archive-description", description)
+	request.Header.Add("x-amz-sha256-tree-hash", hashes.TreeHash())
+	request.Header.Add("x-amz-content-sha256", hashes.Sha256())
+	if err := g.Signature.Sign(request, aws.HashedPayload(hashes.sha256)); err != nil {
+		return "", err
+	}
+
+	client := g.Connection.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		return "", aws.ParseError(response)
+	}
+	io.Copy(ioutil.Discard, response.Body)
+
+	_, location := path.Split(response.Header.Get("Location"))
+	return location, nil
+}
+
+func (g *glacierBackend) ListMultipartUploads(vault string) ([]glacier.Multipart, error) {
+	var uploads []glacier.Multipart
+	marker := ""
+	for {
+		list, next, err := g.Connection.ListMultipartUploads(vault, marker, 0)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, list...)
+		if next == "" {
+			return uploads, nil
+		}
+		marker = next
+	}
+}
+
+func (g *glacierBackend) ListMultipartParts(vault, uploadId string) (map[int64]string, error) {
+	parts := make(map[int64]string)
+	marker := ""
+	for {
+		list, err := g.Connection.ListMultipartParts(vault, uploadId, marker, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range list.Parts {
+			start, err := strconv.ParseInt(strings.SplitN(part.RangeInBytes, "-", 2)[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid range `%s` for part of upload %s", part.RangeInBytes, uploadId)
+			}
+			parts[start] = part.SHA256TreeHash
+		}
+		if list.Marker == "" {
+			return parts, nil
+		}
+		marker = list.Marker
+	}
+}
+
+func (g *glacierBackend) InitiateRetrievalJob(vault, archiveId, description string) (string, error) {
+	return g.Connection.InitiateRetrievalJob(vault, archiveId, "", description)
+}
+
+func (g *glacierBackend) InitiateInventoryJob(vault, description string) (string, error) {
+	return g.Connection.InitiateInventoryJob(vault, "", description)
+}
+
+func (g *glacierBackend) ListJobs(vault string) ([]glacier.Job, error) {
+	var jobs []glacier.Job
+	marker := ""
+	for {
+		list, next, err := g.Connection.ListJobs(vault, "", "", marker, 0)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, list...)
+		if next == "" {
+			return jobs, nil
+		}
+		marker = next
+	}
+}
+
+/**
+ * schemeTransport sends requests using a different scheme
+ */
+type schemeTransport struct {
+	scheme string
+	base   http.RoundTripper
+}
+
+func (s *schemeTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	changed := *request
+	u := *request.URL
+	u.Scheme = s.scheme
+	changed.URL = &u
+	return s.base.RoundTrip(&changed)
+}
+
+/**
+ * withScheme returns a copy of client that sends all requests
+ * using the given scheme
+ */
+func withScheme(client *http.Client, scheme string) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	changed := *client
+	changed.Transport = &schemeTransport{scheme: scheme, base: base}
+	return &changed
+}
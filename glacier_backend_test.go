@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"github.com/rdwilliamson/aws"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlacierBackendEndpoint(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Authorization"), "/us-east-1/glacier/aws4_request") {
+			t.Errorf("Expected request to be signed for glacier in us-east-1, got `%s`", r.Header.Get("Authorization"))
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+
+		switch r.Method {
+		case "GET":
+			w.Write([]byte(`{"Marker":null,"VaultList":[{"CreationDate":"2015-05-22T12:00:00Z","VaultName":"test"}]}`))
+		case "PUT":
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Timeout: time.Minute}
+	backend, err := NewGlacierBackend("secret", "access", aws.USEast1, server.URL, client)
+	if err != nil {
+		t.Fatalf("Unable to create backend: %s", err)
+	}
+
+	if err := backend.EnsureVault("test"); err != nil {
+		t.Errorf("Vault should exist, but got error: %s", err)
+	}
+	if err := backend.EnsureVault("other"); err != nil {
+		t.Errorf("Vault should have been created, but got error: %s", err)
+	}
+
+	expected := []string{"GET /-/vaults", "GET /-/vaults", "PUT /-/vaults/other"}
+	if strings.Join(requests, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Expected requests %v, got %v", expected, requests)
+	}
+
+	if aws.USEast1.Glacier != "glacier.us-east-1.amazonaws.com" {
+		t.Errorf("The endpoint of the region should not be changed")
+	}
+	if client.Transport != nil {
+		t.Errorf("The supplied client should not be changed")
+	}
+}
+
+func TestGlacierBackendWithFakeGlacier(t *testing.T) {
+	backend, fake, server := newTestGlacierBackend()
+	defer server.Close()
+	fake.pageSize = 2
+
+	if err := backend.EnsureVault("test"); err != nil {
+		t.Fatalf("Unable to create vault: %s", err)
+	}
+
+	var archiveIds []string
+	for _, content := range []string{"first", "second", "third"} {
+		archiveId, err := backend.UploadArchive("test", bytes.NewReader([]byte(content)), content, nil)
+		if err != nil {
+			t.Fatalf("Unable to upload archive: %s", err)
+		}
+		archiveIds = append(archiveIds, archiveId)
+	}
+	if err := backend.DeleteArchive("test", archiveIds[1]); err != nil {
+		t.Errorf("Unable to delete archive: %s", err)
+	}
+	if err := backend.DeleteArchive("test", archiveIds[1]); err == nil {
+		t.Errorf("Deleting an archive twice should fail")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := backend.InitiateMultipart("test", 1024*1024, "upload"); err != nil {
+			t.Fatalf("Unable to initiate multipart upload: %s", err)
+		}
+	}
+	if uploads, err := backend.ListMultipartUploads("test"); err != nil || len(uploads) != 3 {
+		t.Errorf("Expected 3 multipart uploads on 2 pages, got %d (%v)", len(uploads), err)
+	}
+
+	jobId, err := backend.InitiateInventoryJob("test", "inventory")
+	if err != nil {
+		t.Fatalf("Unable to initiate inventory job: %s", err)
+	}
+	for _, archiveId := range []string{archiveIds[0], archiveIds[2]} {
+		if _, err := backend.InitiateRetrievalJob("test", archiveId, "retrieval"); err != nil {
+			t.Fatalf("Unable to initiate retrieval job: %s", err)
+		}
+	}
+	if jobs, err := backend.ListJobs("test"); err != nil || len(jobs) != 3 {
+		t.Errorf("Expected 3 jobs on 2 pages, got %d (%v)", len(jobs), err)
+	}
+
+	inventory, err := backend.GetInventoryJob("test", jobId)
+	if err != nil {
+		t.Fatalf("Unable to get inventory: %s", err)
+	}
+	if len(inventory.ArchiveList) != 2 {
+		t.Errorf("Expected 2 archives in the inventory, got %d", len(inventory.ArchiveList))
+	}
+	for _, a := range inventory.ArchiveList {
+		if a.ArchiveId == archiveIds[1] {
+			t.Errorf("Deleted archive should not be in the inventory")
+		}
+	}
+
+	fake.failNext("UploadArchive", 1)
+	if _, err := backend.UploadArchive("test", bytes.NewReader([]byte("fourth")), "fourth", nil); err == nil {
+		t.Errorf("Injected failure should fail the upload")
+	}
+	if _, err := backend.UploadArchive("test", bytes.NewReader([]byte("fourth")), "fourth", nil); err != nil {
+		t.Errorf("Upload after the injected failure should succeed, got: %s", err)
+	}
+}
+
+func TestGlacierBackendUploadWithHashes(t *testing.T) {
+	backend, fake, server := newTestGlacierBackend()
+	defer server.Close()
+	backend.EnsureVault("test")
+
+	data := []byte("content hashed up front")
+	hashes, _ := hashArchive(bytes.NewReader(data))
+	archiveId, err := backend.UploadArchive("test", bytes.NewReader(data), "hashed", hashes)
+	if err != nil {
+		t.Fatalf("Unable to upload archive with known hashes: %s", err)
+	}
+	if a := fake.vault("test").archives[archiveId]; a == nil || !bytes.Equal(a.data, data) {
+		t.Errorf("Expected the archive to be stored")
+	}
+
+	other, _ := hashArchive(bytes.NewReader([]byte("content hashed up frnot")))
+	if _, err := backend.UploadArchive("test", bytes.NewReader(data), "hashed", other); err == nil {
+		t.Errorf("Expected upload with hashes of other content to fail")
+	}
+}
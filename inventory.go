@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/rdwilliamson/aws/glacier"
+	"log"
+	"time"
+)
+
+// errInventoryPending is returned by fetchInventory when
+// not waiting and the inventory job has not completed yet
+var errInventoryPending = errors.New("Inventory job has not completed yet, try again later")
+
+/**
+ * fetchInventory retrieves the inventory of a vault. Since inventory
+ * jobs take hours, an inventory job that was started earlier (i.e. by
+ * a previous run) is used when there is one. Otherwise a new job is
+ * initiated.
+ * @param poll time.Duration Interval to check if the job has completed
+ * @param wait bool Wait for the job to complete. If false and the job has not
+ *                  completed yet errInventoryPending is returned.
+ */
+func fetchInventory(backend Backend, vault string, poll time.Duration, wait bool) (*glacier.Inventory, error) {
+	jobId, err := findInventoryJob(backend, vault)
+	if err != nil {
+		return nil, err
+	}
+
+	if jobId == "" {
+		jobId, err = backend.InitiateInventoryJob(vault, "gobackup inventory")
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Initiated inventory job %s for vault `%s`", jobId, vault)
+	}
+
+	for {
+		job, err := backend.DescribeJob(vault, jobId)
+		if err != nil {
+			return nil, err
+		}
+
+		if job.Completed {
+			if job.StatusCode != "Succeeded" {
+				return nil, errors.New("Inventory job failed: " + job.StatusMessage)
+			}
+			return backend.GetInventoryJob(vault, jobId)
+		}
+
+		if !wait {
+			return nil, errInventoryPending
+		}
+		log.Printf("Waiting for inventory of vault `%s`", vault)
+		time.Sleep(poll)
+	}
+}
+
+/**
+ * findInventoryJob returns the id of the inventory job of a vault that
+ * is still in progress, or otherwise the one that completed last.
+ * Returns an empty string if there is no usable inventory job.
+ */
+func findInventoryJob(backend Backend, vault string) (string, error) {
+	jobs, err := backend.ListJobs(vault)
+	if err != nil {
+		return "", err
+	}
+
+	var found *glacier.Job
+	for i, job := range jobs {
+		if job.Action != "InventoryRetrieval" || (job.Completed && job.StatusCode != "Succeeded") {
+			continue
+		}
+		if !job.Completed {
+			return job.JobId, nil
+		}
+		if found == nil || job.CompletionDate.After(found.CompletionDate) {
+			found = &jobs[i]
+		}
+	}
+
+	if found == nil {
+		return "", nil
+	}
+	return found.JobId, nil
+}
+
+/**
+ * runInventory lists the archives in the inventory of the vault of a
+ * single backup. Exits with exitPending if not waiting and the
+ * inventory job hasn't completed yet.
+ * @param args []string Command line arguments following `inventory`
+ */
+func runInventory(config *Config, args []string) {
+	flags := flag.NewFlagSet("inventory", flag.ExitOnError)
+	name := flags.String("backup", "", "Name of the backup to list the vault of")
+	poll := flags.Duration("poll", 15*time.Minute, "Interval to check for a completed inventory job")
+	wait := flags.Bool("wait", true, "Wait for the inventory job to complete")
+	flags.Parse(args)
+
+	backup, err := config.FindBackup(*name)
+	if err != nil {
+		exitf(exitUsage, "%s", err)
+	}
+
+	backend, err := NewBackend(backup)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	inventory, err := fetchInventory(backend, backup.Vault, *poll, *wait)
+	if err == errInventoryPending {
+		exitf(exitPending, "%s", err)
+	}
+	if err != nil {
+		log.Fatalf("Unable to retrieve inventory: %s", err)
+	}
+
+	for _, archive := range inventory.ArchiveList {
+		fmt.Printf("%s\t%d\t%s\t%s\n", archive.ArchiveId, archive.Size, archive.CreationDate.Format(time.RFC3339), archive.ArchiveDescription)
+	}
+	log.Printf("%d archives in the inventory of %s", len(inventory.ArchiveList), inventory.InventoryDate)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -11,10 +13,12 @@ import (
 /**
  * ListFiles lists all files in a given path recursively.
  * It omits directories and empty files. When passed a slice of includes,
- * filenames must match one of the includes to be returned.
- * When passed a slice of excludes filenames must
- * not match any of the excludes, otherwise they won't be return.
+ * files must match one of the includes, or be in a directory that does,
+ * to be returned. When passed a slice of excludes files must not match
+ * any of the excludes, otherwise they won't be returned. Directories
+ * that match an exclude are not walked into at all.
  * If a filename matches both include and exclude, it will be excluded.
+ * Patterns are gitignore style globs, see compileGlobs.
  * This function closes the channel when it's done looping all files.
  * @param path string The path to scan
  * @param include []string Slice of include patterns
@@ -22,12 +26,20 @@ import (
  * @param out <-chan *File
  */
 func ListFiles(path string, include, exclude []string, out chan<- *File) {
-	inRegex, exRegex := regexify(include), regexify(exclude)
+	inGlobs, err := compileGlobs(include)
+	if err != nil {
+		log.Printf("Ignoring invalid include: %s", err)
+	}
+	exGlobs, err := compileGlobs(exclude)
+	if err != nil {
+		log.Printf("Ignoring invalid exclude: %s", err)
+	}
+	root := path
 
 	go func() {
-		filepath.Walk(path, func(path string, info os.FileInfo, err error) (outErr error) {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) (outErr error) {
 			if err != nil {
-				if info.IsDir() {
+				if info != nil && info.IsDir() {
 					log.Printf("Error reading directory %s: %s. Skipping.", path, err)
 					return filepath.SkipDir
 				} else {
@@ -36,19 +48,29 @@ func ListFiles(path string, include, exclude []string, out chan<- *File) {
 				}
 			}
 
-			if info.IsDir() || info.Size() == 0 {
+			rel, err := filepath.Rel(root, path)
+			if err != nil || rel == "." {
+				return
+			}
+			rel = filepath.ToSlash(rel)
+
+			if exGlobs.Match(rel, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
 				return
 			}
 
-			if inRegex != nil && !inRegex.Match([]byte(path)) {
+			if info.IsDir() || info.Size() == 0 {
 				return
 			}
 
-			if exRegex != nil && exRegex.Match([]byte(path)) {
+			if len(include) > 0 && !inGlobs.MatchOrParent(rel) {
 				return
 			}
 
 			file := NewFile(path)
+			file.stat = newFileStat(info)
 			out <- file
 			return
 		})
@@ -57,32 +79,183 @@ func ListFiles(path string, include, exclude []string, out chan<- *File) {
 }
 
 /**
- * regexify changes a list of human readable patterns to
- * a regular expression. The regular expression is case insensitive
- * to make up for different capitalisation in filenames.
- * i.e. ["*.jpg", "*.png"] becomes ^.*\.jpg$|^.*\.png$
+ * glob is a single compiled include or exclude pattern
+ */
+type glob struct {
+	re      *regexp.Regexp
+	dirOnly bool
+}
+
+/**
+ * globs is a list of compiled include or exclude patterns
+ */
+type globs []*glob
+
+/**
+ * compileGlobs compiles gitignore style patterns. Matching is case
+ * insensitive to make up for different capitalisation in filenames.
+ *  - `*` matches anything but a /, `?` a single character but a /
+ *  - `[abc]`, `[a-z]` and `[!abc]` match a single character of a class
+ *  - `**` matches any number of directories, i.e. `logs/**` matches everything
+ *    in logs, and `**` followed by a / at the start or in the middle of a
+ *    pattern matches zero or more directories
+ *  - a pattern ending in a / only matches directories, i.e. `node_modules/`
+ *  - a pattern containing a / elsewhere is anchored to the backup path,
+ *    i.e. `/build` or `docs/*.md`, others match at any depth, i.e. `*.jpg`
+ *  - a \ escapes the character following it
+ * Invalid patterns are left out of the result.
  * @param patterns []string Input patterns
- * @return
+ * @return (globs, error) The compiled patterns, nil if there are none, and the first invalid pattern
+ */
+func compileGlobs(patterns []string) (globs, error) {
+	var compiled globs
+	var invalid error
+	for _, pattern := range patterns {
+		g, err := compileGlob(pattern)
+		if err != nil {
+			if invalid == nil {
+				invalid = err
+			}
+			continue
+		}
+		compiled = append(compiled, g)
+	}
+	return compiled, invalid
+}
+
+/**
+ * compileGlob compiles a single gitignore style pattern
  */
-func regexify(patterns []string) *regexp.Regexp {
-	var str string
-	if len(patterns) == 0 {
-		return nil
+func compileGlob(pattern string) (*glob, error) {
+	g := &glob{}
+	p := pattern
+	if strings.HasSuffix(p, "/") {
+		g.dirOnly = true
+		p = strings.TrimSuffix(p, "/")
 	}
 
-	// first copy patterns so we don't change
-	// them outside our function
-	p := make([]string, len(patterns))
-	copy(p, patterns)
+	prefix := "^(?:.*/)?"
+	if strings.Contains(p, "/") {
+		prefix = "^"
+		p = strings.TrimPrefix(p, "/")
+	}
+	if p == "" {
+		return nil, fmt.Errorf("Pattern `%s` matches nothing", pattern)
+	}
 
-	// now loop over the patterns and turn them into a
-	// (sub) regular expressions
-	for i := range p {
-		p[i] = strings.Replace(p[i], ".", "\\.", -1)
-		p[i] = strings.Replace(p[i], "*", ".*", -1)
+	re, err := regexp.Compile("(?i)" + prefix + globToRegexp(p) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("Pattern `%s` is invalid: %s", pattern, err)
 	}
+	g.re = re
+	return g, nil
+}
 
-	// now glue the regular expression parts together
-	str = "(?i)^" + strings.Join(p, "|") + "$"
-	return regexp.MustCompile(str)
+/**
+ * globToRegexp translates a glob to a regular expression
+ * i.e. `photos/*.jpg` becomes `photos/[^/]*\.jpg`
+ */
+func globToRegexp(glob string) string {
+	var re bytes.Buffer
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if (i == 1 || glob[i-2] == '/') && i+1 < len(glob) && glob[i+1] == '/' {
+					// zero or more directories
+					i++
+					re.WriteString("(?:.*/)?")
+				} else {
+					re.WriteString(".*")
+				}
+			} else {
+				re.WriteString("[^/]*")
+			}
+		case '?':
+			re.WriteString("[^/]")
+		case '[':
+			end := classEnd(glob, i)
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : end]
+			re.WriteString("[")
+			if class[0] == '!' || class[0] == '^' {
+				re.WriteString("^/")
+				class = class[1:]
+			}
+			if class[0] == ']' {
+				re.WriteString(`\]`)
+				class = class[1:]
+			}
+			re.WriteString(strings.Replace(class, `\`, `\\`, -1))
+			re.WriteString("]")
+			i = end
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			re.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return re.String()
+}
+
+/**
+ * classEnd returns the position of the ] closing the character
+ * class starting at start, or -1 if the class isn't closed
+ */
+func classEnd(glob string, start int) int {
+	i := start + 1
+	if i < len(glob) && (glob[i] == '!' || glob[i] == '^') {
+		i++
+	}
+	// a ] right at the start is part of the class
+	if i < len(glob) && glob[i] == ']' {
+		i++
+	}
+	for ; i < len(glob); i++ {
+		if glob[i] == ']' {
+			return i
+		}
+	}
+	return -1
+}
+
+/**
+ * Match checks if any of the patterns matches a path
+ * @param rel string Path relative to the backup path, separated by /
+ * @param isDir bool Whether the path is a directory
+ * @return bool
+ */
+func (g globs) Match(rel string, isDir bool) bool {
+	for _, glob := range g {
+		if (isDir || !glob.dirOnly) && glob.re.MatchString(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * MatchOrParent checks if any of the patterns matches a file
+ * or one of the directories it is in
+ * @param rel string Path of the file relative to the backup path, separated by /
+ * @return bool
+ */
+func (g globs) MatchOrParent(rel string) bool {
+	if g.Match(rel, false) {
+		return true
+	}
+	for dir := rel; strings.Contains(dir, "/"); {
+		dir = dir[:strings.LastIndex(dir, "/")]
+		if g.Match(dir, true) {
+			return true
+		}
+	}
+	return false
 }
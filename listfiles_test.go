@@ -1,6 +1,11 @@
 package main
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestListAllFiles(t *testing.T) {
 	expected := []*File{
@@ -82,3 +87,89 @@ func findInFiles(file *File, expected []*File) bool {
 	}
 	return false
 }
+
+func TestGlobs(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		match   bool
+	}{
+		{"*.txt", "a.txt", false, true},
+		{"*.txt", "sub/a.txt", false, true},
+		{"*.txt", "a.txt.bak", false, false},
+		{"*.TXT", "a.txt", false, true},
+		{"/a.txt", "a.txt", false, true},
+		{"/a.txt", "sub/a.txt", false, false},
+		{"sub/*.txt", "sub/a.txt", false, true},
+		{"sub/*.txt", "sub/deeper/a.txt", false, false},
+		{"sub/*.txt", "other/sub/a.txt", false, false},
+		{"sub/**", "sub/deeper/a.txt", false, true},
+		{"**/cache", "cache", true, true},
+		{"**/cache", "a/b/cache", true, true},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"a/**/b", "x/a/b", false, false},
+		{"file?.txt", "file1.txt", false, true},
+		{"file?.txt", "file10.txt", false, false},
+		{"file[12].txt", "file2.txt", false, true},
+		{"file[12].txt", "file3.txt", false, false},
+		{"file[!12].txt", "file3.txt", false, true},
+		{"file[!12].txt", "file1.txt", false, false},
+		{"file[a-c].txt", "fileb.txt", false, true},
+		{"file[]].txt", "file].txt", false, true},
+		{"file[!]].txt", "file].txt", false, false},
+		{"node_modules/", "node_modules", true, true},
+		{"node_modules/", "node_modules", false, false},
+		{"a+b(c).txt", "a+b(c).txt", false, true},
+		{"a+b(c).txt", "aab(c).txt", false, false},
+		{"\\*.txt", "*.txt", false, true},
+		{"\\*.txt", "a.txt", false, false},
+		{"[abc", "[abc", false, true},
+	}
+	for _, test := range tests {
+		g, err := compileGlobs([]string{test.pattern})
+		if err != nil {
+			t.Errorf("Unexpected error for pattern `%s`: %s", test.pattern, err)
+			continue
+		}
+		if match := g.Match(test.path, test.isDir); match != test.match {
+			t.Errorf("Expected pattern `%s` matching `%s` to be %v, got %v", test.pattern, test.path, test.match, match)
+		}
+	}
+
+	for _, pattern := range []string{"[z-a]", "/"} {
+		if _, err := compileGlobs([]string{"*.txt", pattern}); err == nil {
+			t.Errorf("Expected error for pattern `%s`", pattern)
+		}
+	}
+}
+
+func TestListFilesPrunesExcludedDirectories(t *testing.T) {
+	root, err := ioutil.TempDir("", "gobackup-listfiles")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, name := range []string{"keep/a.txt", "node_modules/pkg/index.js", "build/out.bin", "sub/build/x.txt"} {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0755)
+		ioutil.WriteFile(filepath.Join(root, name), []byte(name), 0644)
+	}
+
+	// files in node_modules only match the directory, so they are skipped by not walking into it
+	c := make(chan *File)
+	ListFiles(root, []string{}, []string{"node_modules/", "/build"}, c)
+	checkFiles(t, c, []*File{
+		NewFile(filepath.Join(root, "keep/a.txt")),
+		NewFile(filepath.Join(root, "sub/build/x.txt")),
+	})
+
+	// files in an included directory are included
+	c = make(chan *File)
+	ListFiles(root, []string{"keep/", "index.*"}, []string{}, c)
+	checkFiles(t, c, []*File{
+		NewFile(filepath.Join(root, "keep/a.txt")),
+		NewFile(filepath.Join(root, "node_modules/pkg/index.js")),
+	})
+}
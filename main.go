@@ -1,103 +1,651 @@
 package main
 
 import (
+	"database/sql"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"runtime"
+	"sort"
 	"sync"
+	"time"
 )
 
-var wg sync.WaitGroup
+// snapshotsToKeep is the number of snapshots of the
+// archive that are kept in the index vault
+const snapshotsToKeep = 3
+
+// Exit codes of the commands, so scripts can tell why a command failed
+const (
+	exitOk = 0
+	// exitFailure means the command failed
+	exitFailure = 1
+	// exitUsage means the command line is invalid,
+	// the same code flag.ExitOnError exits with
+	exitUsage = 2
+	// exitConfig means the config file can't be read or is invalid
+	exitConfig = 3
+	// exitProblems means the command completed, but found problems
+	exitProblems = 4
+	// exitPending means a Glacier job hasn't completed yet, try again later
+	exitPending = 5
+)
+
+/**
+ * command is a subcommand of gobackup
+ */
+type command struct {
+	usage       string
+	description string
+	run         func(config *Config, args []string)
+}
+
+var commands = map[string]*command{
+	"backup":          {"backup [flags] [name...]", "Back up all or the named backups", runBackups},
+	"restore":         {"restore [flags] [path...]", "Restore files of a backup", runRestore},
+	"list":            {"list [flags] [path...]", "List the files in the catalog of a backup", runList},
+	"find":            {"find [flags] [glob...]", "Find files in the catalog of a backup by name or hash", runFind},
+	"history":         {"history [flags] [file...]", "List the runs of a backup, or the versions of files", runHistory},
+	"verify":          {"verify [flags]", "Check the files of a backup against its catalog", runVerify},
+	"verify-remote":   {"verify-remote [flags]", "Compare the catalog of a backup with the inventory of its vault", runVerifyRemote},
+	"inventory":       {"inventory [flags]", "List the archives in the vault of a backup", runInventory},
+	"prune":           {"prune [flags]", "Delete archives no longer retained by the retention policy", runPrune},
+	"status":          {"status [name...]", "Show the state of all or the named backups", runStatus},
+	"rebuild-catalog": {"rebuild-catalog [flags]", "Rebuild the catalog of a backup from its vault", runRebuildCatalog},
+	// config check is run before the config is read
+	"config": {"config check", "Check the config file", nil},
+}
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	log.Printf("Using %d cores\n", runtime.NumCPU())
 	configFile := flag.String("config", "gobackup.ini", "Path to config file")
+	flag.Usage = usage
 	flag.Parse()
 
+	// without a command all backups are run, as before there were commands
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"backup"}
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		log.Printf("Unknown command `%s`", args[0])
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	if cmd.run == nil {
+		runConfig(*configFile, args[1:])
+		return
+	}
+
 	configDef, err := ioutil.ReadFile(*configFile)
 	if err != nil {
-		log.Fatalf("Error reading config file: %s", err)
+		exitf(exitConfig, "Error reading config file: %s", err)
 	}
 
 	config, err := ReadConfig(string(configDef))
 	if err != nil {
-		log.Fatalf("Error parsing config: %s", err)
+		exitf(exitConfig, "Error parsing config: %s", err)
 	}
 
+	cmd.run(config, args[1:])
+}
+
+/**
+ * usage prints how to use gobackup and its commands
+ */
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [-config file] [command] [flags] [arguments]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-28s %s\n", commands[name].usage, commands[name].description)
+	}
+	fmt.Fprintf(os.Stderr, "\nWithout a command all backups are backed up.\nRun a command with -h to see its flags.\n\nGlobal flags:\n")
+	flag.PrintDefaults()
+}
+
+/**
+ * exitf logs a message and exits with the given exit code
+ */
+func exitf(code int, format string, v ...interface{}) {
+	log.Printf(format, v...)
+	os.Exit(code)
+}
+
+/**
+ * runBackups runs all configured backups, or the ones named
+ * on the command line, and exits with exitFailure if any fails
+ * @param args []string Command line arguments following `backup`
+ */
+func runBackups(config *Config, args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	rehash := flags.Bool("rehash", false, "Hash all files, even those whose size, modification time, inode and device didn't change")
+	dryRun := flags.Bool("dry-run", false, "Only report what would be backed up, without touching the archive or the vault")
+	output := flags.String("json", "", "With -dry-run, also write the report as JSON to this file, - for stdout")
+	flags.Parse(args)
+
+	names, err := config.SelectBackups(flags.Args())
+	if err != nil {
+		exitf(exitUsage, "%s", err)
+	}
+
+	log.Printf("Using %d cores\n", runtime.NumCPU())
 	if config.Threads.Hash > runtime.NumCPU() {
 		log.Printf("You want to use %d threads for hashing, but you only have %d cores available.", config.Threads.Hash, runtime.NumCPU())
 		log.Printf("Even though this will work just fine, using %d hash threads is likely to give better throughput.", runtime.NumCPU())
 		log.Printf("Note that for typical hard disks hashing is I/O bound, not CPU bound.")
 	}
 
-	for _, backup := range config.Backup {
-		uploader, err := NewUploader(backup.AwsSecret, backup.AwsAccess, backup.Region.Region, backup.Vault)
-		if err != nil {
-			log.Printf("Error creating uploader: %s", err)
-			continue
-		}
-
-		archive, err := NewArchive(backup.Db)
-		if err != nil {
-			log.Printf("Error creating archive: %s", err)
-			continue
+	if *dryRun {
+		var reports []*DryRunReport
+		for _, name := range names {
+			report, err := DryRun(name, config.Backup[name], config.Threads.Hash, *rehash)
+			if err != nil {
+				exitf(exitFailure, "Dry run of backup `%s` failed: %s", name, err)
+			}
+			if *output != "-" {
+				printDryRunReport(report)
+			}
+			reports = append(reports, report)
 		}
-
-		files, err := archive.ListFiles()
-		for _, file := range files {
-			info, err := os.Stat(file.Filename())
-			if err != nil || info.IsDir() {
-				archive.DeleteFile(file.Hash(), file.Filename())
+		if *output != "" {
+			if err := writeDryRunReports(reports, *output); err != nil {
+				exitf(exitFailure, "Unable to write report: %s", err)
 			}
 		}
+		return
+	}
 
-		_, err = NewFileChecker(archive)
-		if err != nil {
-			log.Printf("Unable to start file checker: %s", err)
+	failed := false
+	for _, name := range names {
+		if err := runBackup(config, config.Backup[name], *rehash); err != nil {
+			log.Printf("Backup `%s` failed: %s", name, err)
+			failed = true
 		}
+	}
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
+
+/**
+ * runBackup backs up all new and changed files of a single backup
+ * and uploads a snapshot of its archive to the index vault afterwards
+ * @param rehash bool Hash files even if they appear unmodified since the last run
+ */
+func runBackup(config *Config, backup *BackupConfig, rehash bool) error {
+	archive, err := NewArchive(backup.Db)
+	if err != nil {
+		return fmt.Errorf("Error creating archive: %s", err)
+	}
+
+	backend, err := NewBackend(backup)
+	if err != nil {
+		return err
+	}
+
+	uploader, err := newBackupUploader(config, backup, backend, archive)
+	if err != nil {
+		return err
+	}
+
+	if err := uploader.ReconcileMultipartUploads(); err != nil {
+		log.Printf("Unable to reconcile unfinished uploads: %s", err)
+	}
+
+	run, err := archive.StartRun()
+	if err != nil {
+		return fmt.Errorf("Unable to start run: %s", err)
+	}
 
-		filesChan := make(chan *File, 100)
-		uploadsChan := make(chan *File, 100)
-		for i := 0; i < config.Threads.Hash; i++ {
-			wg.Add(1)
-			go Hash(filesChan, uploadsChan)
+	files, err := archive.ListFiles()
+	for _, file := range files {
+		info, err := os.Stat(file.Filename())
+		if err != nil || info.IsDir() {
+			archive.DeleteFile(file.Hash(), file.Filename())
 		}
-		for i := 0; i < config.Threads.Upload; i++ {
-			wg.Add(1)
-			go Upload(uploader, uploadsChan)
+	}
+
+	filesChan := make(chan *File, 100)
+	uploadsChan := make(chan *File, 100)
+	pending := newPendingUploads()
+	hashers := &sync.WaitGroup{}
+	for i := 0; i < config.Threads.Hash; i++ {
+		hashers.Add(1)
+		go Hash(archive, run, rehash, pending, filesChan, uploadsChan, hashers)
+	}
+	go func() {
+		hashers.Wait()
+		close(uploadsChan)
+	}()
+	bundler := newBackupBundler(uploader, archive, run, backup)
+	uploaders := &sync.WaitGroup{}
+	for i := 0; i < config.Threads.Upload; i++ {
+		uploaders.Add(1)
+		go Upload(uploader, bundler, archive, run, uploadsChan, uploaders)
+	}
+	ListFiles(backup.Path, backup.Include, backup.Exclude, filesChan)
+	uploaders.Wait()
+	if err := bundler.Flush(); err != nil {
+		log.Printf("Could not upload bundle: %s", err)
+	}
+	pending.recordDuplicates(archive, run)
+
+	if err := archive.FinishRun(run); err != nil {
+		log.Printf("Unable to record end of run: %s", err)
+	}
+
+	return uploadSnapshot(archive, uploader)
+}
+
+/**
+ * uploadSnapshot uploads a consistent copy of the archive to the
+ * index vault, so the archive can be recovered if it gets lost.
+ * The amazon id of the snapshot is recorded in the archive.
+ */
+func uploadSnapshot(archive *archive, uploader *Uploader) error {
+	tmp, err := ioutil.TempFile("", "gobackup-snapshot")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := archive.Snapshot(tmp.Name()); err != nil {
+		return fmt.Errorf("Unable to snapshot archive: %s", err)
+	}
+
+	snapshot := NewFile(tmp.Name())
+	amazonId, err := uploader.UploadSnapshot(snapshot)
+	if err != nil {
+		return fmt.Errorf("Unable to upload snapshot of archive: %s", err)
+	}
+
+	if err := archive.AddSnapshot(amazonId, time.Now()); err != nil {
+		return fmt.Errorf("Unable to record snapshot of archive: %s", err)
+	}
+	log.Printf("Uploaded snapshot of archive to index vault")
+
+	pruneSnapshots(archive, uploader)
+	return nil
+}
+
+/**
+ * pruneSnapshots deletes all but the snapshotsToKeep latest snapshots
+ * of the archive from the index vault. Snapshots that could not be
+ * deleted are tried again after the next snapshot.
+ */
+func pruneSnapshots(archive *archive, uploader *Uploader) {
+	amazonIds, err := archive.ListOldSnapshots(snapshotsToKeep)
+	if err != nil {
+		log.Printf("Unable to list old snapshots of archive: %s", err)
+		return
+	}
+
+	for _, amazonId := range amazonIds {
+		if err := uploader.DeleteSnapshot(amazonId); err != nil {
+			log.Printf("Unable to delete old snapshot %s of archive: %s", amazonId, err)
+			continue
 		}
-		ListFiles(backup.Path, backup.Include, backup.Exclude, filesChan)
+		archive.DeleteSnapshot(amazonId)
 	}
-	wg.Wait()
 }
 
-func Hash(files chan *File, uploads chan *File) {
-	defer wg.Done()
+/**
+ * Hash calculates the hash of every file it receives and looks it up
+ * in the archive. Files whose content is already in Glacier are
+ * recorded in the archive straight away, all other files are passed
+ * on to the uploaders, once per content. Unless rehash is set, files
+ * whose size, modification time, inode and device didn't change since
+ * they were last hashed are assumed to still have the same hash.
+ * Marks the hashers WaitGroup as done once files is closed.
+ */
+func Hash(archive *archive, run *Run, rehash bool, pending *pendingUploads, files chan *File, uploads chan *File, hashers *sync.WaitGroup) {
+	defer hashers.Done()
 	for {
 		file, ok := <-files
 		if !ok {
 			return
 		}
+		if !rehash {
+			useRecordedHash(archive, file)
+		}
 		hash, err := file.Hash()
 		if err != nil {
 			log.Printf("Could not calculate hash for %s: %s", file.Filename(), err)
 			continue
 		}
-		log.Printf("File: %s, Hash: %s\n", file.Filename(), hash)
+
+		if archived, err := archive.FindFileByFilename(file.Filename()); err == nil && archived.Hash() == hash {
+			markPresent(archive, run, file)
+			continue
+		}
+
+		amazonId, err := archive.FindAmazonIdByHash(hash)
+		if err == sql.ErrNoRows {
+			if pending.add(file, hash) {
+				uploads <- file
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("Could not look up hash for %s: %s", file.Filename(), err)
+			continue
+		}
+
+		log.Printf("Content of %s is already stored in Glacier, not uploading", file.Filename())
+		addToArchive(archive, run, file, *amazonId)
 	}
 }
 
-func Upload(uploader *Uploader, uploads chan *File) {
-	defer wg.Done()
+/**
+ * Upload uploads every file it receives to Glacier and
+ * records the resulting amazon id in the archive.
+ * Files the bundler accepts are added to a bundle instead, or
+ * split into chunks that are, they are recorded once their
+ * bundle is uploaded.
+ * Marks the uploaders WaitGroup as done once uploads is closed.
+ */
+func Upload(uploader *Uploader, bundler *Bundler, archive *archive, run *Run, uploads chan *File, uploaders *sync.WaitGroup) {
+	defer uploaders.Done()
 	for {
 		file, ok := <-uploads
 		if !ok {
 			return
 		}
-		uploader.UploadFile(file.Filename())
+
+		// another uploader may have stored the same content in the meantime
+		hash, _ := file.Hash()
+		if amazonId, err := archive.FindAmazonIdByHash(hash); err == nil {
+			addToArchive(archive, run, file, *amazonId)
+			continue
+		}
+
+		if bundler.AcceptsChunked(file) {
+			if err := bundler.AddChunked(file); err != nil {
+				log.Printf("Could not upload chunks of %s: %s", file.Filename(), err)
+			}
+			continue
+		}
+
+		if bundler.Accepts(file) {
+			if err := bundler.Add(file); err != nil {
+				log.Printf("Could not bundle %s: %s", file.Filename(), err)
+			}
+			continue
+		}
+
+		upload, err := uploader.UploadFile(file)
+		if err != nil {
+			log.Printf("Could not upload %s: %s", file.Filename(), err)
+			continue
+		}
+		log.Printf("Uploaded %s", file.Filename())
+		if err := archive.AddUpload(upload); err != nil {
+			log.Printf("Could not add upload of %s to archive: %s", file.Filename(), err)
+		}
+		addToArchive(archive, run, file, upload.AmazonId())
+	}
+}
+
+/**
+ * addToArchive records a hashed file in the archive as stored
+ * under the given amazon id and as present during the run,
+ * logging any failure.
+ */
+func addToArchive(archive *archive, run *Run, file *File, amazonId string) {
+	hash, _ := file.Hash()
+	err := archive.AddFile(&ArchivedFile{
+		filename: file.Filename(),
+		hash:     hash,
+		amazonId: amazonId,
+	})
+	if err != nil {
+		log.Printf("Could not add %s to archive: %s", file.Filename(), err)
+		return
+	}
+	markPresent(archive, run, file)
+}
+
+/**
+ * markPresent records a hashed file as present during the run,
+ * along with its stat so the next run can skip hashing it if it
+ * stays unmodified, logging any failure.
+ */
+func markPresent(archive *archive, run *Run, file *File) {
+	hash, _ := file.Hash()
+	var size int64
+	stat, err := file.Stat()
+	if err == nil {
+		size = stat.Size()
+		err = archive.AddFileStat(file.Filename(), hash, stat)
+	}
+	if err != nil {
+		log.Printf("Could not record stat of %s in archive: %s", file.Filename(), err)
+	}
+
+	if err := archive.AddFileVersion(run, file.Filename(), hash, size); err != nil {
+		log.Printf("Could not add version of %s to archive: %s", file.Filename(), err)
+	}
+}
+
+/**
+ * useRecordedHash sets the hash of a file to the one recorded
+ * in the archive if the file appears unmodified since then
+ */
+func useRecordedHash(archive *archive, file *File) {
+	stat, err := file.Stat()
+	if err != nil {
+		return
+	}
+
+	hash, recorded, err := archive.FindFileStat(file.Filename())
+	if err == nil && stat.Equal(recorded) {
+		file.hash = hash
+	}
+}
+
+/**
+ * runVerify checks the files of a single backup against its archive,
+ * and exits with exitProblems if any file doesn't match
+ * @param args []string Command line arguments following `verify`
+ */
+func runVerify(config *Config, args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	name := flags.String("backup", "", "Name of the backup to verify")
+	sample := flags.Float64("sample", 1, "Fraction of the files to check, i.e. 0.05 to check 5% of the files")
+	flags.Parse(args)
+
+	backup, err := config.FindBackup(*name)
+	if err != nil {
+		exitf(exitUsage, "%s", err)
+	}
+
+	archive, err := NewArchive(backup.Db)
+	if err != nil {
+		log.Fatalf("Error creating archive: %s", err)
+	}
+
+	checker, err := NewFileChecker(archive, *sample, config.Threads.Hash)
+	if err != nil {
+		log.Fatalf("Unable to start file checker: %s", err)
+	}
+
+	report, err := checker.Check()
+	if err != nil {
+		log.Fatalf("Unable to check files: %s", err)
+	}
+
+	for _, file := range report.Changed {
+		log.Printf("Changed without being uploaded: %s", file.Filename())
+	}
+	for _, file := range report.Missing {
+		log.Printf("Missing: %s", file.Filename())
+	}
+	for _, file := range report.NoUpload {
+		log.Printf("Not uploaded: %s", file.Filename())
+	}
+	log.Printf("Checked %d files, %d changed, %d missing, %d not uploaded", report.Checked, len(report.Changed), len(report.Missing), len(report.NoUpload))
+
+	if len(report.Changed) > 0 || len(report.Missing) > 0 || len(report.NoUpload) > 0 {
+		os.Exit(exitProblems)
+	}
+}
+
+/**
+ * runHistory lists the runs of a single backup, or the
+ * versions of the files given on the command line
+ * @param args []string Command line arguments following `history`
+ */
+func runHistory(config *Config, args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	name := flags.String("backup", "", "Name of the backup to show the history of")
+	flags.Parse(args)
+
+	backup, err := config.FindBackup(*name)
+	if err != nil {
+		exitf(exitUsage, "%s", err)
+	}
+
+	archive, err := NewArchive(backup.Db)
+	if err != nil {
+		log.Fatalf("Error creating archive: %s", err)
+	}
+
+	if flags.NArg() == 0 {
+		runs, err := archive.ListRuns()
+		if err != nil {
+			log.Fatalf("Error listing runs: %s", err)
+		}
+		for _, run := range runs {
+			finished := "unfinished"
+			if !run.Finished().IsZero() {
+				finished = run.Finished().Format(time.RFC3339)
+			}
+			fmt.Printf("%d\t%s\t%s\n", run.Id(), run.Started().Format(time.RFC3339), finished)
+		}
+		return
+	}
+
+	for _, filename := range flags.Args() {
+		versions, err := archive.ListVersions(filename)
+		if err != nil {
+			log.Fatalf("Error listing versions of %s: %s", filename, err)
+		}
+		for _, version := range versions {
+			fmt.Printf("%s\t%s\t%d-%d\n", version.Filename(), version.Hash(), version.FirstRun(), version.LastRun())
+		}
+	}
+}
+
+/**
+ * runPrune deletes the archives of a single backup that are no longer
+ * referenced by any version its retention policy retains
+ * @param args []string Command line arguments following `prune`
+ */
+func runPrune(config *Config, args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	name := flags.String("backup", "", "Name of the backup to prune")
+	dryRun := flags.Bool("dry-run", false, "Only list what would be pruned")
+	flags.Parse(args)
+
+	backup, err := config.FindBackup(*name)
+	if err != nil {
+		exitf(exitUsage, "%s", err)
+	}
+
+	policy := newBackupRetentionPolicy(backup)
+	if policy == nil {
+		exitf(exitConfig, "No retention configured for backup `%s`", *name)
+	}
+
+	archive, err := NewArchive(backup.Db)
+	if err != nil {
+		log.Fatalf("Error creating archive: %s", err)
+	}
+
+	plan, err := PlanPrune(archive, policy, time.Now())
+	if err != nil {
+		log.Fatalf("Unable to plan prune: %s", err)
+	}
+
+	for _, upload := range plan.Deferred {
+		log.Printf("Keeping %s until %s to avoid the early deletion fee", upload.AmazonId(), upload.Uploaded().Add(earlyDeletionPeriod).Format(time.RFC3339))
+	}
+	if *dryRun {
+		for _, version := range plan.Versions {
+			fmt.Printf("version\t%s\t%s\t%d-%d\n", version.Filename(), version.Hash(), version.FirstRun(), version.LastRun())
+		}
+		for _, upload := range plan.Delete {
+			fmt.Printf("archive\t%s\t%d\n", upload.AmazonId(), upload.Size())
+		}
+		return
+	}
+
+	backend, err := NewBackend(backup)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	deleted, err := Prune(archive, backend, backup.Vault, plan)
+	if err != nil {
+		log.Fatalf("Pruning failed after deleting %d archives: %s", deleted, err)
+	}
+	log.Printf("Pruned %d versions and %d archives, %d archives kept to avoid the early deletion fee", len(plan.Versions), deleted, len(plan.Deferred))
+
+	// the previous snapshot refers to the archives just deleted
+	uploader, err := newBackupUploader(config, backup, backend, archive)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	if err := uploadSnapshot(archive, uploader); err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
+/**
+ * runConfig runs the config subcommands, which don't need a valid config.
+ * `config check` exits with exitConfig if the config has any problems.
+ * @param configFile string Path to the config file
+ * @param args []string Command line arguments following `config`
+ */
+func runConfig(configFile string, args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		exitf(exitUsage, "Usage: config check")
+	}
+	flags := flag.NewFlagSet("config check", flag.ExitOnError)
+	flags.Parse(args[1:])
+
+	configDef, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		exitf(exitConfig, "Error reading config file: %s", err)
+	}
+
+	config, err := ReadConfig(string(configDef))
+	if err != nil {
+		exitf(exitConfig, "Error parsing config: %s", err)
+	}
+
+	problems := config.Check()
+	for _, problem := range problems {
+		log.Printf("%s", problem)
+	}
+	if len(problems) > 0 {
+		os.Exit(exitConfig)
+	}
+
+	names, _ := config.SelectBackups(nil)
+	for _, name := range names {
+		fmt.Printf("%s\t%s\t%s\n", name, config.Backup[name].Path, config.Backup[name].Vault)
 	}
 }
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bytes"
+	"github.com/rdwilliamson/aws"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/**
+ * newFakeGlacierBackup creates a backup of a copy of filesets/fileset1
+ * that is stored in a fake Glacier. Remove the returned directory and
+ * close the server when done.
+ */
+func newFakeGlacierBackup(t *testing.T) (*Config, *BackupConfig, *fakeGlacier, *httptest.Server, string) {
+	root, err := ioutil.TempDir("", "gobackup-main")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+
+	data := filepath.Join(root, "data")
+	if err := copyTree("filesets/fileset1", data); err != nil {
+		os.RemoveAll(root)
+		t.Fatalf("Could not copy fileset: %s", err)
+	}
+
+	fake := newFakeGlacier()
+	server := httptest.NewServer(fake)
+
+	config := &Config{}
+	config.Threads.Hash = 2
+	config.Threads.Upload = 2
+	config.Threads.Parts = 2
+
+	backup := &BackupConfig{
+		Region:    MyAwsRegion{aws.USEast1},
+		Path:      data,
+		Db:        filepath.Join(root, "archive.db"),
+		AwsAccess: "access",
+		AwsSecret: "secret",
+		Vault:     "test",
+		PartSize:  1,
+		Backend:   "glacier",
+		Endpoint:  server.URL,
+	}
+
+	return config, backup, fake, server, root
+}
+
+func TestBackupAndRestoreWithFakeGlacier(t *testing.T) {
+	config, backup, fake, server, root := newFakeGlacierBackup(t)
+	defer os.RemoveAll(root)
+	defer server.Close()
+	fake.latency = time.Millisecond
+
+	if err := runBackup(config, backup, false); err != nil {
+		t.Fatalf("First backup failed: %s", err)
+	}
+
+	// the empty files are skipped and all other files differ
+	if archives := len(fake.vault("test").archives); archives != 4 {
+		t.Errorf("Expected 4 archives after the first backup, got %d", archives)
+	}
+	if snapshots := len(fake.vault("test_index").archives); snapshots != 1 {
+		t.Errorf("Expected 1 snapshot after the first backup, got %d", snapshots)
+	}
+
+	data := backup.Path
+	ioutil.WriteFile(filepath.Join(data, "file1.txt"), []byte("The content of file1 has changed\n"), 0644)
+	os.Remove(filepath.Join(data, "sub", "file2.txt"))
+	copyFile(filepath.Join(data, "file3.txt"), filepath.Join(data, "sub", "copy-of-file3.txt"))
+	large := make([]byte, 2*1024*1024+5)
+	rand.Read(large)
+	ioutil.WriteFile(filepath.Join(data, "large.bin"), large, 0644)
+
+	// the uploader retries failed parts
+	fake.failNext("UploadMultipart", 1)
+
+	if err := runBackup(config, backup, false); err != nil {
+		t.Fatalf("Second backup failed: %s", err)
+	}
+
+	if archives := len(fake.vault("test").archives); archives != 6 {
+		t.Errorf("Expected 6 archives after the second backup, got %d", archives)
+	}
+	if snapshots := len(fake.vault("test_index").archives); snapshots != 2 {
+		t.Errorf("Expected 2 snapshots after the second backup, got %d", snapshots)
+	}
+	if uploads := fake.count("UploadMultipart"); uploads != 4 {
+		t.Errorf("Expected 3 parts to be uploaded and 1 to be retried, got %d part uploads", uploads)
+	}
+	if pending := len(fake.vault("test").uploads); pending != 0 {
+		t.Errorf("Expected all multipart uploads to be completed, %d are pending", pending)
+	}
+
+	archive, err := NewArchive(backup.Db)
+	if err != nil {
+		t.Fatalf("Unable to open archive: %s", err)
+	}
+
+	runs, err := archive.ListRuns()
+	if err != nil || len(runs) != 2 {
+		t.Fatalf("Expected 2 runs, got %d (%v)", len(runs), err)
+	}
+
+	// jobs take a while, so the restorer has to wait for them
+	fake.jobDuration = 20 * time.Millisecond
+	backend, err := NewBackend(backup)
+	if err != nil {
+		t.Fatalf("Unable to create backend: %s", err)
+	}
+
+	files, err := archive.ListFiles()
+	if err != nil || len(files) != 5 {
+		t.Fatalf("Expected 5 files in the archive, got %d (%v)", len(files), err)
+	}
+	current := filepath.Join(root, "current")
+	restorer := NewRestorer(backend, archive, backup.Vault, data, current)
+	restorer.pollInterval = 10 * time.Millisecond
+	if err := restorer.Restore(files); err != nil {
+		t.Fatalf("Unable to restore current files: %s", err)
+	}
+	assertSameTree(t, data, current)
+
+	files, err = archive.ListFilesAtRun(runs[0].Id(), "")
+	if err != nil || len(files) != 4 {
+		t.Fatalf("Expected 4 files in the first run, got %d (%v)", len(files), err)
+	}
+	first := filepath.Join(root, "first")
+	restorer = NewRestorer(backend, archive, backup.Vault, data, first)
+	restorer.pollInterval = 10 * time.Millisecond
+	if err := restorer.Restore(files); err != nil {
+		t.Fatalf("Unable to restore files of the first run: %s", err)
+	}
+	assertSameTree(t, "filesets/fileset1", first)
+}
+
+func TestRestoreWithoutWaitingWithFakeGlacier(t *testing.T) {
+	config, backup, fake, server, root := newFakeGlacierBackup(t)
+	defer os.RemoveAll(root)
+	defer server.Close()
+
+	if err := runBackup(config, backup, false); err != nil {
+		t.Fatalf("Backup failed: %s", err)
+	}
+
+	archive, err := NewArchive(backup.Db)
+	if err != nil {
+		t.Fatalf("Unable to open archive: %s", err)
+	}
+	backend, _ := NewBackend(backup)
+	files, _ := archive.ListFiles()
+	target := filepath.Join(root, "restore")
+
+	fake.jobDuration = time.Hour
+	restorer := NewRestorer(backend, archive, backup.Vault, backup.Path, target)
+	restorer.wait = false
+	if err := restorer.Restore(files); err != errRestorePending {
+		t.Fatalf("Expected the restore to be pending, got %v", err)
+	}
+	if err := restorer.Resume(); err != errRestorePending {
+		t.Fatalf("Expected the resumed restore to be pending, got %v", err)
+	}
+
+	fake.jobDuration = 0
+	if err := restorer.Resume(); err != nil {
+		t.Fatalf("Unable to resume restore: %s", err)
+	}
+	assertSameTree(t, backup.Path, target)
+}
+
+func TestResumeInterruptedUploadWithFakeGlacier(t *testing.T) {
+	config, backup, fake, server, root := newFakeGlacierBackup(t)
+	defer os.RemoveAll(root)
+	defer server.Close()
+	config.Threads.Parts = 1
+
+	large := make([]byte, 4*1024*1024-7)
+	rand.Read(large)
+	ioutil.WriteFile(filepath.Join(backup.Path, "large.bin"), large, 0644)
+
+	// the third part never makes it
+	fake.setFailWhen(func(operation string, r *http.Request) bool {
+		return operation == "UploadMultipart" && strings.HasPrefix(r.Header.Get("Content-Range"), "bytes 2097152-")
+	})
+	if err := runBackup(config, backup, false); err != nil {
+		t.Fatalf("First backup failed: %s", err)
+	}
+	if pending := len(fake.vault("test").uploads); pending != 1 {
+		t.Fatalf("Expected the multipart upload to be pending, got %d pending uploads", pending)
+	}
+	if uploads := fake.count("UploadMultipart"); uploads != 5 {
+		t.Errorf("Expected 2 parts to be uploaded and the third one to be tried 3 times, got %d part uploads", uploads)
+	}
+
+	fake.setFailWhen(nil)
+	if err := runBackup(config, backup, false); err != nil {
+		t.Fatalf("Second backup failed: %s", err)
+	}
+
+	if uploads := fake.count("UploadMultipart"); uploads != 7 {
+		t.Errorf("Expected only the last 2 parts to be uploaded when resuming, got %d part uploads in total", uploads-5)
+	}
+	if initiated := fake.count("InitiateMultipart"); initiated != 1 {
+		t.Errorf("Expected the multipart upload to be resumed, but %d were initiated", initiated)
+	}
+	if pending := len(fake.vault("test").uploads); pending != 0 {
+		t.Errorf("Expected the multipart upload to be completed, %d are pending", pending)
+	}
+
+	found := false
+	for _, archive := range fake.vault("test").archives {
+		if bytes.Equal(archive.data, large) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Resumed upload does not match the original file")
+	}
+}
+
+func TestEncryptedBackupAndRestoreWithFakeGlacier(t *testing.T) {
+	config, backup, fake, server, root := newFakeGlacierBackup(t)
+	defer os.RemoveAll(root)
+	defer server.Close()
+	backup.Passphrase = "correct horse battery staple"
+
+	large := make([]byte, 2*1024*1024+5)
+	rand.Read(large)
+	ioutil.WriteFile(filepath.Join(backup.Path, "large.bin"), large, 0644)
+
+	if err := runBackup(config, backup, false); err != nil {
+		t.Fatalf("Backup failed: %s", err)
+	}
+
+	original, _ := ioutil.ReadFile("filesets/fileset1/file1.txt")
+	for _, vault := range []string{"test", "test_index"} {
+		for id, a := range fake.vault(vault).archives {
+			if bytes.Contains(a.data, original) || bytes.Contains(a.data, large[:1024]) || bytes.Contains(a.data, []byte("file1.txt")) {
+				t.Errorf("Archive %s in vault %s contains plaintext", id, vault)
+			}
+			if strings.Contains(a.description, "file") {
+				t.Errorf("Description `%s` of archive %s contains the path", a.description, id)
+			}
+		}
+	}
+
+	archive, err := NewArchive(backup.Db)
+	if err != nil {
+		t.Fatalf("Unable to open archive: %s", err)
+	}
+	uploads, _ := archive.ListUploads()
+	for _, upload := range uploads {
+		if !upload.Encrypted() || upload.KeyId() == "" {
+			t.Errorf("Upload %s should be recorded as encrypted", upload.AmazonId())
+		}
+	}
+
+	backend, _ := NewBackend(backup)
+	files, _ := archive.ListFiles()
+	target := filepath.Join(root, "restore")
+	restorer := NewRestorer(backend, archive, backup.Vault, backup.Path, target)
+	if err := restorer.Restore(files); err == nil {
+		t.Errorf("Restore without a passphrase should fail")
+	}
+
+	restorer = NewRestorer(backend, archive, backup.Vault, backup.Path, target)
+	restorer.encrypter, _ = newBackupEncrypter(backup, archive)
+	if err := restorer.Restore(files); err != nil {
+		t.Fatalf("Unable to restore files: %s", err)
+	}
+	assertSameTree(t, backup.Path, target)
+
+	// the catalog can be rebuilt from the encrypted descriptions
+	inventory, err := fetchInventory(backend, backup.Vault, time.Millisecond, true)
+	if err != nil {
+		t.Fatalf("Unable to fetch inventory: %s", err)
+	}
+	rebuilt, _ := NewArchive(":memory:")
+	encrypter, _ := newBackupEncrypter(backup, archive)
+	if added, err := rebuildCatalog(rebuilt, inventory, encrypter); err != nil || added != len(files) {
+		t.Errorf("Expected %d archives to be added to the rebuilt catalog, got %d (%v)", len(files), added, err)
+	}
+	for _, file := range files {
+		found, err := rebuilt.FindFileByFilename(file.Filename())
+		if err != nil || found.Hash() != file.Hash() {
+			t.Errorf("Expected %s to be in the rebuilt catalog", file.Filename())
+		}
+	}
+	if upload, err := rebuilt.FindUpload(files[0].Hash(), files[0].AmazonId()); err != nil || !upload.Encrypted() {
+		t.Errorf("Expected rebuilt upload to be recorded as encrypted")
+	}
+}
+
+func TestCompressedBackupAndRestoreWithFakeGlacier(t *testing.T) {
+	for _, passphrase := range []string{"", "correct horse battery staple"} {
+		config, backup, fake, server, root := newFakeGlacierBackup(t)
+		defer os.RemoveAll(root)
+		defer server.Close()
+		backup.Passphrase = passphrase
+		backup.Compression = "gzip"
+		backup.CompressSkip = []string{"bin"}
+
+		log := []byte(strings.Repeat("2015-05-22 12:00:00 INFO all is well\n", 100000))
+		ioutil.WriteFile(filepath.Join(backup.Path, "app.log"), log, 0644)
+
+		if err := runBackup(config, backup, false); err != nil {
+			t.Fatalf("Backup failed: %s", err)
+		}
+
+		for _, a := range fake.vault("test").archives {
+			if len(a.data) > len(log)/10 {
+				t.Errorf("Expected the log to be compressed, got an archive of %d bytes", len(a.data))
+			}
+		}
+
+		archive, err := NewArchive(backup.Db)
+		if err != nil {
+			t.Fatalf("Unable to open archive: %s", err)
+		}
+		files, _ := archive.ListFiles()
+		for _, file := range files {
+			upload, err := archive.FindUpload(file.Hash(), file.AmazonId())
+			expected := "gzip"
+			if strings.HasSuffix(file.Filename(), ".bin") {
+				expected = ""
+			}
+			if err != nil || upload.Codec() != expected {
+				t.Errorf("Expected %s to be uploaded with codec `%s`", file.Filename(), expected)
+			}
+			if err == nil && upload.Encrypted() != (passphrase != "") {
+				t.Errorf("Expected encryption of %s to be %v", file.Filename(), passphrase != "")
+			}
+		}
+
+		backend, _ := NewBackend(backup)
+		target := filepath.Join(root, "restore")
+		restorer := NewRestorer(backend, archive, backup.Vault, backup.Path, target)
+		restorer.encrypter, _ = newBackupEncrypter(backup, archive)
+		if err := restorer.Restore(files); err != nil {
+			t.Fatalf("Unable to restore files: %s", err)
+		}
+		assertSameTree(t, backup.Path, target)
+
+		// the codec is recovered from the description when rebuilding the catalog
+		inventory, _ := fetchInventory(backend, backup.Vault, time.Millisecond, true)
+		rebuilt, _ := NewArchive(":memory:")
+		rebuildCatalog(rebuilt, inventory, restorer.encrypter)
+		uploads, _ := rebuilt.ListUploads()
+		for _, upload := range uploads {
+			if original, err := archive.FindUpload(upload.Hash(), upload.AmazonId()); err != nil || original.Codec() != upload.Codec() {
+				t.Errorf("Expected codec of rebuilt upload %s to be recovered", upload.AmazonId())
+			}
+		}
+	}
+}
+
+/**
+ * copyTree copies all files in src to dst, creating directories as needed
+ */
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		return copyFile(path, filepath.Join(dst, rel))
+	})
+}
+
+/**
+ * assertSameTree checks that every non-empty file in expected
+ * has been restored with the same content in actual
+ */
+func assertSameTree(t *testing.T, expected, actual string) {
+	filepath.Walk(expected, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Size() == 0 {
+			return err
+		}
+		rel, _ := filepath.Rel(expected, path)
+		original, _ := ioutil.ReadFile(path)
+		restored, err := ioutil.ReadFile(filepath.Join(actual, rel))
+		if err != nil {
+			t.Errorf("%s was not restored: %s", rel, err)
+		} else if !bytes.Equal(original, restored) {
+			t.Errorf("Restored %s does not match the original", rel)
+		}
+		return nil
+	})
+}
+
+func TestBundledBackupAndRestoreWithFakeGlacier(t *testing.T) {
+	for _, passphrase := range []string{"", "correct horse battery staple"} {
+		config, backup, fake, server, root := newFakeGlacierBackup(t)
+		defer os.RemoveAll(root)
+		defer server.Close()
+		backup.Passphrase = passphrase
+		backup.Compression = "gzip"
+		backup.BundleThreshold = 1
+		backup.BundleSize = 1
+
+		large := make([]byte, 2*1024*1024+5)
+		rand.Read(large)
+		ioutil.WriteFile(filepath.Join(backup.Path, "large.bin"), large, 0644)
+
+		if err := runBackup(config, backup, false); err != nil {
+			t.Fatalf("Backup failed: %s", err)
+		}
+
+		// all small files share a single bundle, the large file is uploaded on its own
+		if archives := len(fake.vault("test").archives); archives != 2 {
+			t.Errorf("Expected 2 archives, got %d", archives)
+		}
+
+		archive, err := NewArchive(backup.Db)
+		if err != nil {
+			t.Fatalf("Unable to open archive: %s", err)
+		}
+		files, _ := archive.ListFiles()
+		bundled := 0
+		for _, file := range files {
+			if _, err := archive.FindBundleMember(file.Hash(), file.AmazonId()); err == nil {
+				bundled++
+			}
+		}
+		if bundled != len(files)-1 {
+			t.Errorf("Expected %d files to be bundled, got %d", len(files)-1, bundled)
+		}
+
+		backend, _ := NewBackend(backup)
+		inventory, _ := fetchInventory(backend, backup.Vault, time.Millisecond, true)
+		uploads, _ := archive.ListUploads()
+		if report := compareInventory(uploads, inventory); report.HasDrift() {
+			t.Errorf("Expected no drift for bundled uploads, got %+v", report)
+		}
+
+		// members of the same bundle share a retrieval job
+		jobs := fake.count("InitiateJob")
+		target := filepath.Join(root, "restore")
+		restorer := NewRestorer(backend, archive, backup.Vault, backup.Path, target)
+		restorer.encrypter, _ = newBackupEncrypter(backup, archive)
+		if err := restorer.Restore(files); err != nil {
+			t.Fatalf("Unable to restore files: %s", err)
+		}
+		if initiated := fake.count("InitiateJob") - jobs; initiated != 2 {
+			t.Errorf("Expected 2 retrieval jobs, got %d", initiated)
+		}
+		assertSameTree(t, backup.Path, target)
+
+		// unchanged files are neither bundled nor uploaded again
+		if err := runBackup(config, backup, false); err != nil {
+			t.Fatalf("Second backup failed: %s", err)
+		}
+		if archives := len(fake.vault("test").archives); archives != 2 {
+			t.Errorf("Expected 2 archives after the second backup, got %d", archives)
+		}
+	}
+}
+
+func TestChunkedBackupAndRestoreWithFakeGlacier(t *testing.T) {
+	for _, passphrase := range []string{"", "correct horse battery staple"} {
+		config, backup, fake, server, root := newFakeGlacierBackup(t)
+		defer os.RemoveAll(root)
+		defer server.Close()
+		backup.Passphrase = passphrase
+		backup.ChunkThreshold = 1
+		backup.ChunkSize = 64
+		backup.BundleSize = 1
+
+		image := make([]byte, 3*1024*1024)
+		rand.Read(image)
+		ioutil.WriteFile(filepath.Join(backup.Path, "disk.img"), image, 0644)
+		copyFile(filepath.Join(backup.Path, "disk.img"), filepath.Join(backup.Path, "copy-of-disk.img"))
+
+		// zero filled regions consist of the same chunk over and over
+		sparse := make([]byte, 3*1024*1024)
+		rand.Read(sparse[:512*1024])
+		ioutil.WriteFile(filepath.Join(backup.Path, "sparse.img"), sparse, 0644)
+
+		if err := runBackup(config, backup, false); err != nil {
+			t.Fatalf("First backup failed: %s", err)
+		}
+		stored := vaultSize(fake.vault("test"))
+		if stored > int64(len(image)+1024*1024)*11/10 {
+			t.Errorf("Expected the images to be stored once, the vault holds %d bytes", stored)
+		}
+
+		// changing a block only uploads the chunks around it
+		copy(image[1500000:], []byte("a changed block"))
+		ioutil.WriteFile(filepath.Join(backup.Path, "disk.img"), image, 0644)
+		if err := runBackup(config, backup, false); err != nil {
+			t.Fatalf("Second backup failed: %s", err)
+		}
+		if added := vaultSize(fake.vault("test")) - stored; added > 1024*1024 {
+			t.Errorf("Expected only the changed chunks to be uploaded, got %d bytes", added)
+		}
+
+		archive, err := NewArchive(backup.Db)
+		if err != nil {
+			t.Fatalf("Unable to open archive: %s", err)
+		}
+		files, _ := archive.ListFiles()
+		backend, _ := NewBackend(backup)
+		target := filepath.Join(root, "restore")
+		restorer := NewRestorer(backend, archive, backup.Vault, backup.Path, target)
+		restorer.encrypter, _ = newBackupEncrypter(backup, archive)
+		if err := restorer.Restore(files); err != nil {
+			t.Fatalf("Unable to restore files: %s", err)
+		}
+		assertSameTree(t, backup.Path, target)
+
+		inventory, _ := fetchInventory(backend, backup.Vault, time.Millisecond, true)
+		uploads, _ := archive.ListUploads()
+		if report := compareInventory(uploads, inventory); report.HasDrift() {
+			t.Errorf("Expected no drift for chunked uploads, got %+v", report)
+		}
+	}
+}
+
+func TestPruneKeepsSnapshotEncrypted(t *testing.T) {
+	config, backup, fake, server, root := newFakeGlacierBackup(t)
+	defer os.RemoveAll(root)
+	defer server.Close()
+	backup.Passphrase = "correct horse battery staple"
+	backup.KeepVersions = 1
+	config.Backup = map[string]*BackupConfig{"test": backup}
+
+	if err := runBackup(config, backup, false); err != nil {
+		t.Fatalf("Backup failed: %s", err)
+	}
+	runPrune(config, []string{"-backup", "test"})
+
+	snapshots := fake.vault("test_index").archives
+	if len(snapshots) != 2 {
+		t.Fatalf("Expected a snapshot to be uploaded after pruning, got %d snapshots", len(snapshots))
+	}
+	for id, a := range snapshots {
+		if bytes.Contains(a.data, []byte("SQLite format")) || bytes.Contains(a.data, []byte("file1.txt")) {
+			t.Errorf("Snapshot %s contains plaintext", id)
+		}
+	}
+}
+
+/**
+ * vaultSize returns the number of bytes stored in a vault of the fake Glacier
+ */
+func vaultSize(vault *fakeVault) int64 {
+	var size int64
+	for _, a := range vault.archives {
+		size += int64(len(a.data))
+	}
+	return size
+}
+
+func TestPruneWithFakeGlacier(t *testing.T) {
+	// a bundle is kept as long as any of its members is referenced
+	for bundleThreshold, expected := range map[int64]int{0: 2, 1: 0} {
+		config, backup, fake, server, root := newFakeGlacierBackup(t)
+		defer os.RemoveAll(root)
+		defer server.Close()
+		backup.BundleThreshold = bundleThreshold
+		backup.BundleSize = 1
+		backup.KeepVersions = 1
+		backup.KeepDeleted = 1
+
+		if err := runBackup(config, backup, false); err != nil {
+			t.Fatalf("First backup failed: %s", err)
+		}
+		ioutil.WriteFile(filepath.Join(backup.Path, "file1.txt"), []byte("The content of file1 has changed\n"), 0644)
+		os.Remove(filepath.Join(backup.Path, "sub", "file2.txt"))
+		if err := runBackup(config, backup, false); err != nil {
+			t.Fatalf("Second backup failed: %s", err)
+		}
+		archives := len(fake.vault("test").archives)
+
+		archive, err := NewArchive(backup.Db)
+		if err != nil {
+			t.Fatalf("Unable to open archive: %s", err)
+		}
+		policy := newBackupRetentionPolicy(backup)
+
+		// archives uploaded days ago are within the early deletion period
+		plan, err := PlanPrune(archive, policy, time.Now().Add(2*24*time.Hour))
+		if err != nil {
+			t.Fatalf("Unable to plan prune: %s", err)
+		}
+		if len(plan.Versions) != 2 || len(plan.Delete) != 0 || len(plan.Deferred) != expected {
+			t.Errorf("Expected 2 versions and %d deferred archives, got %d versions, %d archives and %d deferred", expected, len(plan.Versions), len(plan.Delete), len(plan.Deferred))
+		}
+
+		plan, err = PlanPrune(archive, policy, time.Now().Add(earlyDeletionPeriod))
+		if err != nil {
+			t.Fatalf("Unable to plan prune: %s", err)
+		}
+		if len(plan.Versions) != 2 || len(plan.Delete) != expected || len(plan.Deferred) != 0 {
+			t.Errorf("Expected 2 versions and %d archives, got %d versions, %d archives and %d deferred", expected, len(plan.Versions), len(plan.Delete), len(plan.Deferred))
+		}
+
+		backend, _ := NewBackend(backup)
+		deleted, err := Prune(archive, backend, backup.Vault, plan)
+		if err != nil || deleted != expected {
+			t.Fatalf("Expected %d archives to be deleted, got %d (%v)", expected, deleted, err)
+		}
+		if remaining := len(fake.vault("test").archives); remaining != archives-expected {
+			t.Errorf("Expected %d archives after pruning, got %d", archives-expected, remaining)
+		}
+		if versions, _ := archive.ListVersions(filepath.Join(backup.Path, "file1.txt")); len(versions) != 1 {
+			t.Errorf("Expected only the current version of file1.txt to be left, got %d", len(versions))
+		}
+
+		inventory, _ := fetchInventory(backend, backup.Vault, time.Millisecond, true)
+		uploads, _ := archive.ListUploads()
+		if report := compareInventory(uploads, inventory); report.HasDrift() {
+			t.Errorf("Expected no drift after pruning, got %+v", report)
+		}
+
+		files, _ := archive.ListFiles()
+		target := filepath.Join(root, "restore")
+		restorer := NewRestorer(backend, archive, backup.Vault, backup.Path, target)
+		if err := restorer.Restore(files); err != nil {
+			t.Fatalf("Unable to restore files: %s", err)
+		}
+		assertSameTree(t, backup.Path, target)
+
+		if plan, _ := PlanPrune(archive, policy, time.Now().Add(earlyDeletionPeriod)); len(plan.Versions) != 0 || len(plan.Delete) != 0 {
+			t.Errorf("Expected nothing left to prune, got %d versions and %d archives", len(plan.Versions), len(plan.Delete))
+		}
+	}
+}
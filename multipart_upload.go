@@ -0,0 +1,49 @@
+package main
+
+/**
+ * MultipartUpload is a multipart upload to Glacier that
+ * has been initiated but not yet completed
+ */
+type MultipartUpload struct {
+	uploadId string
+	vault    string
+	filename string
+	hash     string
+	partSize int64
+	size     int64
+	parts    map[int64]string
+}
+
+func (m *MultipartUpload) UploadId() string {
+	return m.uploadId
+}
+
+func (m *MultipartUpload) Vault() string {
+	return m.vault
+}
+
+func (m *MultipartUpload) Filename() string {
+	return m.filename
+}
+
+func (m *MultipartUpload) Hash() string {
+	return m.hash
+}
+
+func (m *MultipartUpload) PartSize() int64 {
+	return m.partSize
+}
+
+func (m *MultipartUpload) Size() int64 {
+	return m.size
+}
+
+/**
+ * PartTreeHash returns the hex encoded tree hash of the
+ * completed part starting at the given offset
+ * @return bool false if the part has not been completed yet
+ */
+func (m *MultipartUpload) PartTreeHash(start int64) (string, bool) {
+	treeHash, ok := m.parts[start]
+	return treeHash, ok
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+/**
+ * pendingUploads keeps track of the content the hashers passed on to
+ * the uploaders during a run, so content shared by several new files
+ * is only uploaded once. The other files with that content are
+ * recorded once the uploaders are done.
+ */
+type pendingUploads struct {
+	mu         sync.Mutex
+	hashes     map[string]bool
+	duplicates []*File
+}
+
+/**
+ * newPendingUploads creates an empty pendingUploads instance
+ */
+func newPendingUploads() *pendingUploads {
+	return &pendingUploads{
+		hashes: make(map[string]bool),
+	}
+}
+
+/**
+ * add marks the content of a file as passed on to the uploaders.
+ * If it already was the file is kept until the uploaders are done.
+ * @return bool Whether the file should be passed on to the uploaders
+ */
+func (p *pendingUploads) add(file *File, hash string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.hashes[hash] {
+		p.duplicates = append(p.duplicates, file)
+		return false
+	}
+	p.hashes[hash] = true
+	return true
+}
+
+/**
+ * recordDuplicates records the files whose content was uploaded
+ * for another file. Must only be called once the uploaders are done.
+ */
+func (p *pendingUploads) recordDuplicates(archive *archive, run *Run) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, file := range p.duplicates {
+		hash, _ := file.Hash()
+		amazonId, err := archive.FindAmazonIdByHash(hash)
+		if err != nil {
+			log.Printf("Could not store %s, its content was not uploaded: %s", file.Filename(), err)
+			continue
+		}
+		addToArchive(archive, run, file, *amazonId)
+	}
+	p.duplicates = nil
+}
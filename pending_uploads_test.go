@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPendingUploads(t *testing.T) {
+	archive, err := NewArchive(":memory:")
+	if err != nil {
+		t.Errorf("Could not create archive instance: %s", err)
+	}
+
+	pending := newPendingUploads()
+	first, dup, other := NewFile("first.txt"), NewFile("copy.txt"), NewFile("other.txt")
+	first.hash, dup.hash, other.hash = "h12345", "h12345", "h54321"
+
+	if !pending.add(first, "h12345") || !pending.add(other, "h54321") {
+		t.Errorf("Expected new content to be passed on to the uploaders")
+	}
+	if pending.add(dup, "h12345") {
+		t.Errorf("Expected content to be passed on to the uploaders only once")
+	}
+
+	archive.AddFile(&ArchivedFile{filename: "first.txt", hash: "h12345", amazonId: "a12345"})
+	run, err := archive.StartRun()
+	if err != nil {
+		t.Fatalf("Unexpected error while starting run: %s", err)
+	}
+	pending.recordDuplicates(archive, run)
+
+	file, err := archive.FindFileByFilename("copy.txt")
+	if err != nil || file.AmazonId() != "a12345" {
+		t.Errorf("Expected copy.txt to be recorded with the content of first.txt, got %v (%v)", file, err)
+	}
+}
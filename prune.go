@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// earlyDeletionPeriod is the minimum storage duration Glacier charges
+// for, deleting an archive sooner is charged as if it was kept that long
+const earlyDeletionPeriod = 90 * 24 * time.Hour
+
+/**
+ * PrunePlan lists what pruning a backup removes
+ */
+type PrunePlan struct {
+	// Versions are the versions of files no longer retained
+	Versions []*FileVersion
+	// Delete are the archives no retained version references,
+	// one upload per archive
+	Delete []*UploadRecord
+	// Deferred are the archives no retained version references,
+	// but that are still within the early deletion period
+	Deferred []*UploadRecord
+}
+
+/**
+ * PlanPrune computes which versions the retention policy no longer
+ * retains and which archives are no longer referenced by any retained
+ * version. An archive holding several files, like a bundle, is only
+ * deleted once none of its files is referenced anymore.
+ * @param now time.Time Time to compute the age of versions and archives against
+ * @return (*PrunePlan, error)
+ */
+func PlanPrune(archive *archive, policy *RetentionPolicy, now time.Time) (*PrunePlan, error) {
+	runs, err := archive.ListRuns()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list runs: %s", err)
+	}
+
+	files, err := archive.ListFiles()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list files: %s", err)
+	}
+	current := make(map[string]string)
+	referenced := make(map[string]bool)
+	for _, file := range files {
+		current[file.Filename()] = file.Hash()
+		referenced[file.Hash()] = true
+	}
+
+	versions, err := archive.ListAllVersions()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list versions: %s", err)
+	}
+	keep, prune := policy.Retained(versions, current, runs, now)
+	for _, version := range keep {
+		referenced[version.Hash()] = true
+	}
+
+	uploads, err := archive.ListUploads()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list uploads: %s", err)
+	}
+	for _, upload := range uploads {
+		if upload.AmazonId() != chunkedArchiveId || !referenced[upload.Hash()] {
+			continue
+		}
+		chunks, err := archive.ListChunks(upload.Hash())
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list chunks of %s: %s", upload.Hash(), err)
+		}
+		for _, chunk := range chunks {
+			referenced[chunk.Hash()] = true
+		}
+	}
+
+	used := make(map[string]bool)
+	archives := make(map[string]*UploadRecord)
+	var order []string
+	for _, upload := range uploads {
+		if upload.AmazonId() == chunkedArchiveId {
+			continue
+		}
+		if referenced[upload.Hash()] {
+			used[upload.AmazonId()] = true
+		}
+		// the members of a bundle are recorded without a size,
+		// the bundle itself is the upload describing the archive
+		if known, ok := archives[upload.AmazonId()]; !ok {
+			archives[upload.AmazonId()] = upload
+			order = append(order, upload.AmazonId())
+		} else if upload.Size() > known.Size() {
+			archives[upload.AmazonId()] = upload
+		}
+	}
+
+	plan := &PrunePlan{Versions: prune}
+	for _, amazonId := range order {
+		if used[amazonId] {
+			continue
+		}
+		upload := archives[amazonId]
+		if now.Sub(upload.Uploaded()) < earlyDeletionPeriod {
+			plan.Deferred = append(plan.Deferred, upload)
+		} else {
+			plan.Delete = append(plan.Delete, upload)
+		}
+	}
+
+	return plan, nil
+}
+
+/**
+ * Prune removes the versions in the plan from the archive and deletes
+ * the archives in the plan from the vault. Archives that can't be
+ * deleted are kept in the archive, so a later prune retries them.
+ * @return (int, error) Number of archives deleted
+ */
+func Prune(archive *archive, backend Backend, vault string, plan *PrunePlan) (int, error) {
+	for _, version := range plan.Versions {
+		if err := archive.DeleteFileVersion(version); err != nil {
+			return 0, fmt.Errorf("Unable to forget version of %s: %s", version.Filename(), err)
+		}
+	}
+
+	deleted := 0
+	for _, upload := range plan.Delete {
+		if err := backend.DeleteArchive(vault, upload.AmazonId()); err != nil {
+			log.Printf("Unable to delete archive %s: %s", upload.AmazonId(), err)
+			continue
+		}
+		if err := archive.DeleteUpload(upload.AmazonId()); err != nil {
+			return deleted, fmt.Errorf("Deleted archive %s, but unable to remove it from the archive: %s", upload.AmazonId(), err)
+		}
+		deleted++
+	}
+
+	if deleted < len(plan.Delete) {
+		return deleted, fmt.Errorf("Unable to delete %d of %d archives", len(plan.Delete)-deleted, len(plan.Delete))
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,764 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/rdwilliamson/aws/glacier"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// restoreChunkSize is the number of bytes requested per download
+// of a retrieval job. It's a power of two MiB so Glacier returns
+// the tree hash of every chunk.
+const restoreChunkSize = 64 * 1024 * 1024
+
+// errRestorePending is returned by a restore that doesn't wait
+// when retrieval jobs have not completed yet
+var errRestorePending = errors.New("Retrieval jobs are still in progress, resume the restore later")
+
+/**
+ * Restorer is responsible for retrieving files from AWS Glacier.
+ * Retrieval jobs are kept track of in the archive, so a restore
+ * can be resumed by a later process.
+ */
+type Restorer struct {
+	backend      Backend
+	archive      *archive
+	vault        string
+	root         string
+	target       string
+	pollInterval time.Duration
+	wait         bool
+	// encrypter decrypts encrypted archives, nil if there is no key
+	encrypter *Encrypter
+}
+
+/**
+ * NewRestorer creates a new restorer instance
+ * @param root string The path that was backed up
+ * @param target string The directory to restore files to.
+ *                      Files are placed relative to root in this directory.
+ */
+func NewRestorer(backend Backend, archive *archive, vault, root, target string) *Restorer {
+	return &Restorer{
+		backend:      backend,
+		archive:      archive,
+		vault:        vault,
+		root:         root,
+		target:       target,
+		pollInterval: 15 * time.Minute,
+		wait:         true,
+	}
+}
+
+/**
+ * runRestore restores files of a single backup
+ * @param args []string Command line arguments following `restore`
+ */
+func runRestore(config *Config, args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	name := flags.String("backup", "", "Name of the backup to restore from")
+	target := flags.String("target", "", "Directory to restore files to")
+	poll := flags.Duration("poll", 15*time.Minute, "Interval to check for completed retrieval jobs")
+	resume := flags.Bool("resume", false, "Continue restores started earlier instead of starting a new one")
+	wait := flags.Bool("wait", true, "Wait for all retrieval jobs to complete. Otherwise only completed jobs are downloaded.")
+	run := flags.Int64("run", 0, "Restore files as they were during this run instead of their current version")
+	flags.Parse(args)
+
+	if *target == "" && !*resume {
+		exitf(exitUsage, "No target directory supplied")
+	}
+
+	backup, err := config.FindBackup(*name)
+	if err != nil {
+		exitf(exitUsage, "%s", err)
+	}
+
+	archive, err := NewArchive(backup.Db)
+	if err != nil {
+		log.Fatalf("Error creating archive: %s", err)
+	}
+
+	backend, err := NewBackend(backup)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	restorer := NewRestorer(backend, archive, backup.Vault, backup.Path, *target)
+	restorer.pollInterval = *poll
+	restorer.wait = *wait
+	if restorer.encrypter, err = newBackupEncrypter(backup, archive); err != nil {
+		log.Fatalf("Unable to set up encryption: %s", err)
+	}
+
+	if *resume {
+		err = restorer.Resume()
+	} else {
+		var files []*ArchivedFile
+		if *run > 0 {
+			files, err = archive.ListFilesAtRun(*run, "")
+		} else {
+			files, err = archive.ListFiles()
+		}
+		if err != nil {
+			log.Fatalf("Error listing files: %s", err)
+		}
+
+		files = selectFiles(files, backup.Path, flags.Args())
+		if len(files) == 0 {
+			exitf(exitUsage, "No files to restore")
+		}
+		err = restorer.Restore(files)
+	}
+
+	if err == errRestorePending {
+		exitf(exitPending, "%s", err)
+	}
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+}
+
+/**
+ * Restore retrieves the given files from Glacier. Files with the
+ * same content share a single restore job. Content stored in the
+ * same bundle archive shares a single retrieval job. Content stored
+ * as chunks is assembled once all its chunks are restored.
+ */
+func (r *Restorer) Restore(files []*ArchivedFile) error {
+	byContent := make(map[string]*RestoreJob)
+	add := func(amazonId, hash, target string) *RestoreJob {
+		key := amazonId + " " + hash
+		job, ok := byContent[key]
+		if !ok {
+			job = &RestoreJob{amazonId: amazonId, hash: hash}
+			byContent[key] = job
+		}
+		// content can occur more than once, i.e. a repeated chunk
+		for _, existing := range job.targets {
+			if existing == target {
+				return job
+			}
+		}
+		job.targets = append(job.targets, target)
+		return job
+	}
+
+	var chunked []*RestoreJob
+	for _, file := range files {
+		job := add(file.AmazonId(), file.Hash(), r.targetPath(file))
+		if file.AmazonId() == chunkedArchiveId && len(job.Targets()) == 1 {
+			chunked = append(chunked, job)
+		}
+	}
+
+	failed := 0
+	var jobs []*RestoreJob
+	for _, job := range chunked {
+		delete(byContent, job.AmazonId()+" "+job.Hash())
+		if err := r.addChunks(job, add); err != nil {
+			log.Printf("Could not look up chunks of %s: %s", job.Targets()[0], err)
+			failed += len(job.Targets())
+			continue
+		}
+
+		job.status = "Chunked"
+		if err := r.archive.AddRestoreJob(job); err != nil {
+			log.Printf("Could not record restore of %s: %s", job.Targets()[0], err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	retrievals := make(map[string]string)
+	for _, job := range byContent {
+		if jobId, ok := retrievals[job.AmazonId()]; ok {
+			job.jobId = jobId
+			job.status = "InProgress"
+		} else if err := r.initiate(job); err != nil {
+			log.Printf("Could not initiate retrieval of %s: %s", job.Targets()[0], err)
+			failed += len(job.Targets())
+			continue
+		}
+		retrievals[job.AmazonId()] = job.JobId()
+
+		if err := r.archive.AddRestoreJob(job); err != nil {
+			log.Printf("Could not record retrieval of %s: %s", job.Targets()[0], err)
+		}
+		jobs = append(jobs, job)
+	}
+
+	err := r.complete(jobs)
+	if failed > 0 && (err == nil || err == errRestorePending) {
+		return fmt.Errorf("%d files could not be restored", failed)
+	}
+	return err
+}
+
+/**
+ * addChunks adds the chunks of content stored as chunks to
+ * be restored to the chunk directory of its restore job
+ */
+func (r *Restorer) addChunks(job *RestoreJob, add func(amazonId, hash, target string) *RestoreJob) error {
+	chunks, err := r.archive.ListChunks(job.Hash())
+	if err != nil {
+		return err
+	}
+	if len(chunks) == 0 {
+		return errors.New("No chunks recorded")
+	}
+
+	dir := chunkDir(job)
+	for _, chunk := range chunks {
+		amazonId, err := r.archive.FindChunkAmazonId(chunk.Hash())
+		if err != nil {
+			return fmt.Errorf("No archive found for chunk %s: %s", chunk.Hash(), err)
+		}
+		add(amazonId, chunk.Hash(), filepath.Join(dir, chunk.Hash()))
+	}
+	return nil
+}
+
+/**
+ * Resume continues the retrieval jobs recorded in the archive
+ * that have not been restored yet
+ */
+func (r *Restorer) Resume() error {
+	jobs, err := r.archive.ListRestoreJobs()
+	if err != nil {
+		return err
+	}
+
+	if len(jobs) == 0 {
+		log.Printf("No restores to resume")
+		return nil
+	}
+
+	return r.complete(jobs)
+}
+
+/**
+ * initiate starts a retrieval job for the content of a restore job
+ */
+func (r *Restorer) initiate(job *RestoreJob) error {
+	jobId, err := r.backend.InitiateRetrievalJob(r.vault, job.AmazonId(), "gobackup restore")
+	if err != nil {
+		return err
+	}
+	job.jobId = jobId
+	job.status = "InProgress"
+	job.bytesDownloaded = 0
+	return nil
+}
+
+/**
+ * complete downloads the output of the given jobs once Glacier has
+ * completed them. When waiting, this function blocks until all
+ * jobs are done, checking their status every pollInterval.
+ * Otherwise it returns after downloading the jobs that are
+ * already completed, with errRestorePending if any are not.
+ */
+func (r *Restorer) complete(jobs []*RestoreJob) error {
+	failed := 0
+	for {
+		remote, err := r.listJobs()
+		if err != nil {
+			return err
+		}
+
+		var pending, chunked []*RestoreJob
+		for _, job := range jobs {
+			if job.AmazonId() == chunkedArchiveId {
+				chunked = append(chunked, job)
+				continue
+			}
+
+			status, ok := remote[job.JobId()]
+			if !ok {
+				// Glacier forgets about jobs about a day after completing them
+				log.Printf("Retrieval job for %s expired, starting a new one", job.Targets()[0])
+				if err := r.initiate(job); err != nil {
+					log.Printf("Could not initiate retrieval of %s: %s", job.Targets()[0], err)
+				}
+				r.archive.UpdateRestoreJob(job)
+				pending = append(pending, job)
+				continue
+			}
+
+			if !status.Completed {
+				pending = append(pending, job)
+				continue
+			}
+
+			if status.StatusCode != "Succeeded" {
+				log.Printf("Retrieval of %s failed: %s", job.Targets()[0], status.StatusMessage)
+				job.status = status.StatusCode
+				r.archive.UpdateRestoreJob(job)
+				failed += len(job.Targets())
+				continue
+			}
+
+			if err := r.download(job, status); err != nil {
+				log.Printf("Could not restore %s: %s", job.Targets()[0], err)
+				failed += len(job.Targets())
+			}
+		}
+
+		// chunks are restored first, so their content can be assembled
+		for _, job := range chunked {
+			assembled, err := r.assemble(job)
+			if err == nil && !assembled && len(pending) == 0 {
+				err = errors.New("Not all chunks could be restored")
+			}
+			if err != nil {
+				log.Printf("Could not restore %s: %s", job.Targets()[0], err)
+				job.status = "Failed"
+				r.archive.UpdateRestoreJob(job)
+				failed += len(job.Targets())
+				continue
+			}
+			if !assembled {
+				pending = append(pending, job)
+			}
+		}
+
+		jobs = pending
+		if len(jobs) == 0 || !r.wait {
+			break
+		}
+		log.Printf("Waiting for %d retrieval jobs to complete", len(jobs))
+		time.Sleep(r.pollInterval)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be restored", failed)
+	}
+	if len(jobs) > 0 {
+		log.Printf("%d retrieval jobs are still in progress", len(jobs))
+		return errRestorePending
+	}
+	return nil
+}
+
+/**
+ * assemble writes content stored as chunks to all target paths of
+ * its restore job once all its chunks are restored, and verifies
+ * it against the hash in the archive.
+ * @return bool Whether the content is assembled, false if
+ *              chunks are still being restored
+ */
+func (r *Restorer) assemble(job *RestoreJob) (bool, error) {
+	chunks, err := r.archive.ListChunks(job.Hash())
+	if err != nil {
+		return false, err
+	}
+
+	dir := chunkDir(job)
+	for _, chunk := range chunks {
+		if _, err := os.Stat(filepath.Join(dir, chunk.Hash())); err != nil {
+			return false, nil
+		}
+	}
+
+	targets := job.Targets()
+	path := targets[0]
+	tmp := path + ".gobackup-restore"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp)
+
+	hasher := sha1.New()
+	buffered := bufio.NewWriterSize(out, 1024*1024)
+	for _, chunk := range chunks {
+		if err := appendFile(io.MultiWriter(buffered, hasher), filepath.Join(dir, chunk.Hash())); err != nil {
+			out.Close()
+			return false, err
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		out.Close()
+		return false, err
+	}
+	if err := out.Close(); err != nil {
+		return false, err
+	}
+
+	if actual := fmt.Sprintf("%x", hasher.Sum(nil)); actual != job.Hash() {
+		return false, fmt.Errorf("Hash of assembled chunks `%s` does not match `%s`", actual, job.Hash())
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return false, err
+	}
+	os.RemoveAll(dir)
+	log.Printf("Restored %s", path)
+
+	for _, target := range targets[1:] {
+		if err := copyFile(path, target); err != nil {
+			return false, err
+		}
+		log.Printf("Restored %s", target)
+	}
+
+	job.status = "Restored"
+	return true, r.archive.UpdateRestoreJob(job)
+}
+
+/**
+ * chunkDir returns the directory the chunks of content stored
+ * as chunks are restored to before they are assembled
+ */
+func chunkDir(job *RestoreJob) string {
+	return job.Targets()[0] + ".gobackup-chunks"
+}
+
+/**
+ * appendFile writes the content of the file at path to dst
+ */
+func appendFile(dst io.Writer, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	_, err = io.Copy(dst, in)
+	return err
+}
+
+/**
+ * listJobs returns all jobs the backend knows about for the vault by id
+ */
+func (r *Restorer) listJobs() (map[string]glacier.Job, error) {
+	list, err := r.backend.ListJobs(r.vault)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make(map[string]glacier.Job)
+	for _, job := range list {
+		jobs[job.JobId] = job
+	}
+	return jobs, nil
+}
+
+/**
+ * download downloads the output of a completed retrieval job
+ * and writes it to all target paths of the job. Progress is
+ * recorded in the archive after every chunk, so an interrupted
+ * download continues where it was left. The download is verified
+ * against both the tree hash Glacier reports and the hash in the archive.
+ * For content stored in a bundle only its range of the bundle is
+ * downloaded, which is verified against the tree hash in the archive.
+ */
+func (r *Restorer) download(job *RestoreJob, status glacier.Job) error {
+	targets := job.Targets()
+	path := targets[0]
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".gobackup-restore"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	offset, size, treeHash := int64(0), status.ArchiveSizeInBytes, status.SHA256TreeHash
+	if member, err := r.archive.FindBundleMember(job.Hash(), job.AmazonId()); err == nil {
+		offset, size, treeHash = member.Offset(), member.Length(), member.TreeHash()
+	}
+
+	start := job.BytesDownloaded()
+	if info, err := out.Stat(); err != nil || info.Size() < start {
+		start = 0
+	}
+
+	for start < size {
+		end := start + restoreChunkSize
+		if end > size {
+			end = size
+		}
+		if err := r.downloadRange(out, job.JobId(), offset, start, end-1); err != nil {
+			out.Close()
+			return err
+		}
+		start = end
+		job.bytesDownloaded = end
+		if err := r.archive.UpdateRestoreJob(job); err != nil {
+			log.Printf("Could not record progress of %s: %s", path, err)
+		}
+	}
+	if err := out.Truncate(size); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	if err := r.verifyDownload(tmp, treeHash, job); err != nil {
+		os.Remove(tmp)
+		job.bytesDownloaded = 0
+		r.archive.UpdateRestoreJob(job)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	log.Printf("Restored %s", path)
+
+	for _, target := range targets[1:] {
+		if err := copyFile(path, target); err != nil {
+			return err
+		}
+		log.Printf("Restored %s", target)
+	}
+
+	job.status = "Restored"
+	return r.archive.UpdateRestoreJob(job)
+}
+
+/**
+ * verifyDownload checks that the downloaded file matches the tree
+ * hash Glacier reports. Encrypted or compressed archives are then
+ * decoded in place. Finally the content is checked against the hash
+ * in the archive.
+ */
+func (r *Restorer) verifyDownload(path, treeHash string, job *RestoreJob) error {
+	upload, err := r.archive.FindUpload(job.Hash(), job.AmazonId())
+	encoded := err == nil && (upload.Encrypted() || upload.Codec() != "")
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hasher := sha1.New()
+	plain := io.Writer(hasher)
+	if encoded {
+		plain = ioutil.Discard
+	}
+	_, actual, err := copyWithTreeHash(plain, f)
+	if err != nil {
+		return err
+	}
+	if actual != treeHash {
+		return fmt.Errorf("Tree hash of download `%s` does not match `%s`", actual, treeHash)
+	}
+
+	if encoded {
+		if err := r.decode(path, upload, hasher); err != nil {
+			return err
+		}
+	}
+
+	// content restored from a vault inventory might not have a known hash
+	if actual := fmt.Sprintf("%x", hasher.Sum(nil)); actual != job.Hash() && !strings.HasPrefix(job.Hash(), treeHashPrefix) {
+		return fmt.Errorf("Hash of download `%s` does not match `%s`", actual, job.Hash())
+	}
+
+	return nil
+}
+
+/**
+ * decode replaces the encrypted or compressed archive at path by
+ * its original content, which is written to hasher as well
+ */
+func (r *Restorer) decode(path string, upload *UploadRecord, hasher io.Writer) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var src io.Reader = bufio.NewReaderSize(in, 1024*1024)
+	if upload.Encrypted() {
+		decrypted, err := r.decrypt(src, upload)
+		if err != nil {
+			return err
+		}
+		defer decrypted.Close()
+		src = decrypted
+	}
+	if upload.Codec() != "" {
+		decompressed, err := decompressReader(upload.Codec(), src)
+		if err != nil {
+			return err
+		}
+		defer decompressed.Close()
+		src = decompressed
+	}
+
+	out, err := os.Create(path + ".plain")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	buffered := bufio.NewWriterSize(out, 1024*1024)
+	if _, err := io.Copy(io.MultiWriter(buffered, hasher), src); err != nil {
+		out.Close()
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), path)
+}
+
+/**
+ * decrypt returns a reader of the plaintext of the encrypted archive
+ * read from src. Reading fails once the archive turns out to be corrupt.
+ */
+func (r *Restorer) decrypt(src io.Reader, upload *UploadRecord) (io.ReadCloser, error) {
+	if r.encrypter == nil {
+		return nil, fmt.Errorf("Archive is encrypted with key %s, but no passphrase or key file is configured", upload.KeyId())
+	}
+	if upload.EncryptionVersion() != encryptionVersion {
+		return nil, fmt.Errorf("Unsupported encryption format version %d", upload.EncryptionVersion())
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(r.encrypter.Decrypt(pw, src))
+	}()
+	return pr, nil
+}
+
+/**
+ * downloadRange downloads the bytes start up to and including end
+ * of the content at offset in the output of a retrieval job into
+ * out, trying 3 times before giving up.
+ */
+func (r *Restorer) downloadRange(out *os.File, jobId string, offset, start, end int64) (err error) {
+	for retries := 1; retries <= 3; retries++ {
+		if err = r.tryDownloadRange(out, jobId, offset, start, end); err == nil {
+			return
+		}
+	}
+	return fmt.Errorf("Download failed after 3 retries: %s", err)
+}
+
+func (r *Restorer) tryDownloadRange(out *os.File, jobId string, offset, start, end int64) error {
+	body, expected, err := r.backend.GetRetrievalJob(r.vault, jobId, offset+start, offset+end)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if _, err := out.Seek(start, 0); err != nil {
+		return err
+	}
+
+	th := glacier.NewTreeHash()
+	n, err := io.Copy(io.MultiWriter(out, th), body)
+	if err != nil {
+		return err
+	}
+	th.Close()
+
+	if n != end-start+1 {
+		return fmt.Errorf("Expected %d bytes, got %d", end-start+1, n)
+	}
+
+	if treeHash := fmt.Sprintf("%x", th.TreeHash()); expected != "" && treeHash != expected {
+		return fmt.Errorf("Tree hash of range `%s` does not match `%s`", treeHash, expected)
+	}
+
+	return nil
+}
+
+/**
+ * targetPath returns the path a file is restored to,
+ * which is its path relative to the backup root in the target directory
+ */
+func (r *Restorer) targetPath(file *ArchivedFile) string {
+	rel, err := filepath.Rel(r.root, file.Filename())
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = file.Filename()
+	}
+	return filepath.Join(r.target, rel)
+}
+
+/**
+ * selectFiles returns the files matching any of the given paths.
+ * A path matches a file if it is either the file itself or one of
+ * its parent directories. Paths may be given as they were backed up
+ * or relative to the backup root. When no paths are given
+ * all files are returned.
+ */
+func selectFiles(files []*ArchivedFile, root string, paths []string) []*ArchivedFile {
+	if len(paths) == 0 {
+		return files
+	}
+
+	var selected []*ArchivedFile
+	for _, file := range files {
+		filename := filepath.Clean(file.Filename())
+		rel, _ := filepath.Rel(root, filename)
+		for _, path := range paths {
+			path = filepath.Clean(path)
+			if isPathOrParent(path, filename) || isPathOrParent(path, rel) {
+				selected = append(selected, file)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+/**
+ * isPathOrParent checks if parent is either equal
+ * to path or one of its parent directories
+ */
+func isPathOrParent(parent, path string) bool {
+	return path == parent || parent == "." || strings.HasPrefix(path, strings.TrimSuffix(parent, string(filepath.Separator))+string(filepath.Separator))
+}
+
+/**
+ * copyFile copies the file at src to dst,
+ * creating the parent directories of dst as needed
+ */
+func copyFile(src, dst string) error {
+	if filepath.Clean(src) == filepath.Clean(dst) {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,52 @@
+package main
+
+/**
+ * RestoreJob is a Glacier retrieval job initiated to restore
+ * the files with the same content to one or more target paths
+ */
+type RestoreJob struct {
+	id              int64
+	jobId           string
+	amazonId        string
+	hash            string
+	status          string
+	bytesDownloaded int64
+	targets         []string
+}
+
+func (r *RestoreJob) JobId() string {
+	return r.jobId
+}
+
+func (r *RestoreJob) AmazonId() string {
+	return r.amazonId
+}
+
+/**
+ * Hash returns the hash of the content being restored
+ * @return string
+ */
+func (r *RestoreJob) Hash() string {
+	return r.hash
+}
+
+/**
+ * Status returns the status of the job, which is either a
+ * Glacier status code or `Restored` once the files are written
+ * @return string
+ */
+func (r *RestoreJob) Status() string {
+	return r.status
+}
+
+func (r *RestoreJob) BytesDownloaded() int64 {
+	return r.bytesDownloaded
+}
+
+/**
+ * Targets returns the paths the content is restored to
+ * @return []string
+ */
+func (r *RestoreJob) Targets() []string {
+	return r.targets
+}
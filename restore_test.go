@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSelectFiles(t *testing.T) {
+	files := []*ArchivedFile{
+		&ArchivedFile{filename: "/data/file1.txt", hash: "h1", amazonId: "a1"},
+		&ArchivedFile{filename: "/data/sub/file2.txt", hash: "h2", amazonId: "a2"},
+		&ArchivedFile{filename: "/data/subdir/file3.txt", hash: "h3", amazonId: "a3"},
+	}
+
+	tests := []struct {
+		paths    []string
+		expected int
+	}{
+		{[]string{}, 3},
+		{[]string{"/data/file1.txt"}, 1},
+		{[]string{"file1.txt"}, 1},
+		{[]string{"sub"}, 1},
+		{[]string{"/data/sub/"}, 1},
+		{[]string{"sub", "subdir"}, 2},
+		{[]string{"/data"}, 3},
+		{[]string{"file"}, 0},
+	}
+
+	for _, test := range tests {
+		if selected := selectFiles(files, "/data", test.paths); len(selected) != test.expected {
+			t.Errorf("Expected %d files to be selected by %v, got %d", test.expected, test.paths, len(selected))
+		}
+	}
+}
+
+func TestTargetPath(t *testing.T) {
+	restorer := NewRestorer(nil, nil, "test", "/data/", "/restore")
+
+	tests := map[string]string{
+		"/data/file1.txt":     "/restore/file1.txt",
+		"/data/sub/file2.txt": "/restore/sub/file2.txt",
+		"/other/file3.txt":    "/restore/other/file3.txt",
+		"/data/..cache/x":     "/restore/..cache/x",
+		"/data../file4.txt":   "/restore/data../file4.txt",
+	}
+
+	for filename, expected := range tests {
+		if actual := restorer.targetPath(&ArchivedFile{filename: filename}); actual != expected {
+			t.Errorf("Target path for `%s` was expected to be `%s`, got `%s`", filename, expected, actual)
+		}
+	}
+}
+
+func TestBackupAndRestoreWithDirectoryBackend(t *testing.T) {
+	root, err := ioutil.TempDir("", "gobackup-restore")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	// larger than the part size, so it's uploaded in parts
+	data := make([]byte, 3*1024*1024+123)
+	rand.Read(data)
+	large := filepath.Join(root, "large.bin")
+	ioutil.WriteFile(large, data, 0644)
+
+	archive, _ := NewArchive(":memory:")
+	backend := NewDirectoryBackend(root)
+	uploader, err := NewUploader(backend, "test", 1024*1024, 2, archive)
+	if err != nil {
+		t.Fatalf("Unable to create uploader: %s", err)
+	}
+
+	var files []*ArchivedFile
+	for _, filename := range []string{"filesets/fileset1/file1.txt", large} {
+		file := NewFile(filename)
+		upload, err := uploader.UploadFile(file)
+		if err != nil {
+			t.Fatalf("Unable to upload %s: %s", filename, err)
+		}
+		archive.AddUpload(upload)
+		files = append(files, &ArchivedFile{filename: filename, hash: upload.Hash(), amazonId: upload.AmazonId()})
+	}
+
+	target := filepath.Join(root, "restore")
+	restorer := NewRestorer(backend, archive, "test", "", target)
+	if err := restorer.Restore(files); err != nil {
+		t.Fatalf("Unable to restore files: %s", err)
+	}
+
+	for _, file := range files {
+		restored, err := NewFile(restorer.targetPath(file)).Hash()
+		if err != nil || restored != file.Hash() {
+			t.Errorf("Restored %s does not match the original", file.Filename())
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+/**
+ * RetentionPolicy decides which versions of files are worth keeping.
+ * The current version of a file is always kept. Of files that still
+ * exist the most recent versions are kept, versions of deleted files
+ * are kept for a number of days after the file was last seen, and
+ * every version present during one of the runs kept under the
+ * grandfather-father-son scheme is kept too. A rule that is 0 doesn't
+ * limit anything: without keepDeleted or keepVersions the versions of
+ * deleted or existing files are kept, unless the grandfather-father-son
+ * scheme keeps runs, in which case only the versions present during
+ * those runs are kept.
+ */
+type RetentionPolicy struct {
+	keepDeleted  time.Duration
+	keepVersions int
+	keepDaily    int
+	keepWeekly   int
+	keepMonthly  int
+}
+
+/**
+ * NewRetentionPolicy creates a retention policy
+ * @param keepDeleted time.Duration How long versions of deleted files are kept
+ * @param keepVersions int Number of versions kept of existing files, including the current one
+ * @param keepDaily int Number of days of which the last run is kept
+ * @param keepWeekly int Number of weeks of which the last run is kept
+ * @param keepMonthly int Number of months of which the last run is kept
+ */
+func NewRetentionPolicy(keepDeleted time.Duration, keepVersions, keepDaily, keepWeekly, keepMonthly int) *RetentionPolicy {
+	return &RetentionPolicy{
+		keepDeleted:  keepDeleted,
+		keepVersions: keepVersions,
+		keepDaily:    keepDaily,
+		keepWeekly:   keepWeekly,
+		keepMonthly:  keepMonthly,
+	}
+}
+
+/**
+ * newBackupRetentionPolicy returns the retention policy configured
+ * for the backup, or nil if the backup doesn't configure one
+ */
+func newBackupRetentionPolicy(backup *BackupConfig) *RetentionPolicy {
+	if backup.KeepDeleted == 0 && backup.KeepVersions == 0 && backup.KeepDaily == 0 && backup.KeepWeekly == 0 && backup.KeepMonthly == 0 {
+		return nil
+	}
+	return NewRetentionPolicy(time.Duration(backup.KeepDeleted)*24*time.Hour, backup.KeepVersions, backup.KeepDaily, backup.KeepWeekly, backup.KeepMonthly)
+}
+
+/**
+ * KeptRuns returns the ids of the runs kept under the grandfather-father-son
+ * scheme: the last run of each of the most recent days, weeks and months
+ * that have runs
+ * @param runs []*Run Runs of the backup, oldest first
+ * @return map[int64]bool
+ */
+func (p *RetentionPolicy) KeptRuns(runs []*Run) map[int64]bool {
+	kept := make(map[int64]bool)
+	periods := []struct {
+		keep   int
+		period func(t time.Time) string
+	}{
+		{p.keepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{p.keepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{p.keepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, period := range periods {
+		seen := make(map[string]bool)
+		for i := len(runs) - 1; i >= 0 && len(seen) < period.keep; i-- {
+			key := period.period(runs[i].Started().Local())
+			if !seen[key] {
+				seen[key] = true
+				kept[runs[i].Id()] = true
+			}
+		}
+	}
+	return kept
+}
+
+/**
+ * Retained splits the versions of files in the versions to keep and
+ * the versions to prune
+ * @param versions []*FileVersion Versions of all files, ordered by filename and newest first
+ * @param current map[string]string Hashes of the files that currently exist by filename
+ * @param runs []*Run Runs of the backup, oldest first
+ * @param now time.Time Time to compute the age of versions of deleted files against
+ * @return ([]*FileVersion, []*FileVersion) The versions to keep and the versions to prune
+ */
+func (p *RetentionPolicy) Retained(versions []*FileVersion, current map[string]string, runs []*Run, now time.Time) ([]*FileVersion, []*FileVersion) {
+	keptRuns := p.KeptRuns(runs)
+	started := make(map[int64]time.Time)
+	for _, run := range runs {
+		started[run.Id()] = run.Started()
+	}
+
+	var keep, prune []*FileVersion
+	newer := 0
+	for i, version := range versions {
+		if i > 0 && versions[i-1].Filename() == version.Filename() {
+			newer++
+		} else {
+			newer = 0
+		}
+		if p.retains(version, newer, current, keptRuns, started, now) {
+			keep = append(keep, version)
+		} else {
+			prune = append(prune, version)
+		}
+	}
+	return keep, prune
+}
+
+/**
+ * retains tells if the version of a file is kept
+ * @param newer int Number of versions of the file newer than this one
+ */
+func (p *RetentionPolicy) retains(version *FileVersion, newer int, current map[string]string, keptRuns map[int64]bool, started map[int64]time.Time, now time.Time) bool {
+	for id := range keptRuns {
+		if id >= version.FirstRun() && id <= version.LastRun() {
+			return true
+		}
+	}
+
+	hash, exists := current[version.Filename()]
+	if !exists {
+		if p.keepDeleted == 0 {
+			return !p.keepsRuns()
+		}
+		lastSeen, ok := started[version.LastRun()]
+		return !ok || now.Sub(lastSeen) < p.keepDeleted
+	}
+	if newer == 0 && hash == version.Hash() {
+		return true
+	}
+	if p.keepVersions == 0 {
+		return !p.keepsRuns()
+	}
+	return newer < p.keepVersions
+}
+
+/**
+ * keepsRuns checks if any runs are kept under the grandfather-father-son scheme
+ */
+func (p *RetentionPolicy) keepsRuns() bool {
+	return p.keepDaily > 0 || p.keepWeekly > 0 || p.keepMonthly > 0
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeptRuns(t *testing.T) {
+	started := []string{
+		"2026-01-10 12:00",
+		"2026-02-10 12:00",
+		"2026-03-02 12:00",
+		"2026-03-04 12:00",
+		"2026-03-05 10:00",
+		"2026-03-05 20:00",
+	}
+	var runs []*Run
+	for i, s := range started {
+		when, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		runs = append(runs, &Run{id: int64(i + 1), started: when})
+	}
+
+	tests := []struct {
+		policy   *RetentionPolicy
+		expected []int64
+	}{
+		{NewRetentionPolicy(0, 0, 0, 0, 0), nil},
+		// the last run of a day is kept, weeks without runs are skipped
+		{NewRetentionPolicy(0, 0, 2, 2, 0), []int64{2, 4, 6}},
+		{NewRetentionPolicy(0, 0, 0, 0, 3), []int64{1, 2, 6}},
+		{NewRetentionPolicy(0, 0, 10, 0, 0), []int64{1, 2, 3, 4, 6}},
+	}
+	for _, test := range tests {
+		kept := test.policy.KeptRuns(runs)
+		if len(kept) != len(test.expected) {
+			t.Errorf("Expected runs %v to be kept, got %v", test.expected, kept)
+			continue
+		}
+		for _, id := range test.expected {
+			if !kept[id] {
+				t.Errorf("Expected runs %v to be kept, got %v", test.expected, kept)
+				break
+			}
+		}
+	}
+}
+
+func TestRetainedVersions(t *testing.T) {
+	now := time.Date(2026, 3, 20, 12, 0, 0, 0, time.Local)
+	runs := []*Run{
+		{id: 1, started: now.Add(-30 * 24 * time.Hour)},
+		{id: 2, started: now.Add(-20 * 24 * time.Hour)},
+		{id: 3, started: now.Add(-5 * 24 * time.Hour)},
+	}
+	versions := []*FileVersion{
+		{filename: "/a", hash: "h3", firstRun: 3, lastRun: 3},
+		{filename: "/a", hash: "h2", firstRun: 2, lastRun: 2},
+		{filename: "/a", hash: "h1", firstRun: 1, lastRun: 1},
+		{filename: "/b", hash: "h4", firstRun: 1, lastRun: 2},
+		{filename: "/c", hash: "h5", firstRun: 3, lastRun: 3},
+		{filename: "/d", hash: "h6", firstRun: 1, lastRun: 3},
+	}
+	current := map[string]string{"/a": "h3", "/d": "h6"}
+
+	tests := []struct {
+		policy *RetentionPolicy
+		pruned []string
+	}{
+		// two versions of /a are kept, /b was deleted too long ago
+		{NewRetentionPolicy(10*24*time.Hour, 2, 0, 0, 0), []string{"h1", "h4"}},
+		// only the current versions and the versions of the last run
+		{NewRetentionPolicy(0, 1, 1, 0, 0), []string{"h2", "h1", "h4"}},
+		// the second run is the last run of february
+		{NewRetentionPolicy(0, 0, 0, 0, 3), []string{"h1"}},
+		// a single rule only limits what it is about
+		{NewRetentionPolicy(10*24*time.Hour, 0, 0, 0, 0), []string{"h4"}},
+		{NewRetentionPolicy(0, 2, 0, 0, 0), []string{"h1"}},
+		{NewRetentionPolicy(0, 0, 1, 0, 0), []string{"h2", "h1", "h4"}},
+		{NewRetentionPolicy(0, 0, 0, 1, 0), []string{"h2", "h1", "h4"}},
+	}
+	for _, test := range tests {
+		keep, prune := test.policy.Retained(versions, current, runs, now)
+		if len(keep)+len(prune) != len(versions) {
+			t.Errorf("Expected every version to be either kept or pruned, got %d and %d", len(keep), len(prune))
+		}
+		var pruned []string
+		for _, version := range prune {
+			pruned = append(pruned, version.Hash())
+		}
+		if len(pruned) != len(test.pruned) || !compareInclusions(pruned, test.pruned) {
+			t.Errorf("Expected %v to be pruned, got %v", test.pruned, pruned)
+		}
+	}
+}
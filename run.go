@@ -0,0 +1,33 @@
+package main
+
+import (
+	"time"
+)
+
+/**
+ * Run is a single run of a backup. Every file present
+ * during a run is recorded as a version tied to that run.
+ */
+type Run struct {
+	id       int64
+	previous int64
+	started  time.Time
+	finished time.Time
+}
+
+func (r *Run) Id() int64 {
+	return r.id
+}
+
+func (r *Run) Started() time.Time {
+	return r.started
+}
+
+/**
+ * Finished returns the time the run completed,
+ * or the zero time if it didn't (yet)
+ * @return time.Time
+ */
+func (r *Run) Finished() time.Time {
+	return r.finished
+}
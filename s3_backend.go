@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/rdwilliamson/aws"
+	"github.com/rdwilliamson/aws/glacier"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * s3Backend stores archives as objects in a bucket of an S3 compatible
+ * store. Every vault is a prefix in the bucket. Since S3 doesn't know
+ * about tree hashes, descriptions and jobs, these are stored as JSON
+ * objects next to the archives. Archives are available right away,
+ * so jobs complete as soon as they are initiated.
+ *
+ * Layout of a vault:
+ *   <vault>/archives/<id>                  the archive
+ *   <vault>/archives/<id>.json             its glacier.Archive
+ *   <vault>/multipart/<id>/upload.json     an unfinished multipart upload
+ *   <vault>/multipart/<id>/<start>         tree hash of an uploaded part
+ *   <vault>/jobs/<id>.json                 a glacier.Job
+ */
+type s3Backend struct {
+	client  *s3Client
+	uploads map[string]*s3Upload
+	mu      sync.Mutex
+}
+
+/**
+ * s3Upload is a multipart upload of an archive. The multipart upload
+ * id is the id the archive will get once it's completed.
+ */
+type s3Upload struct {
+	glacier.Multipart
+	S3UploadId string
+}
+
+/**
+ * NewS3Backend creates a backend storing archives in a bucket
+ * @param endpoint string Scheme and host of the store, i.e. https://s3.amazonaws.com
+ * @param client *http.Client Client to perform requests with, or nil to use
+ *                            http.DefaultClient
+ */
+func NewS3Backend(endpoint, bucket, awsSecret, awsAccess string, awsRegion *aws.Region, client *http.Client) *s3Backend {
+	return &s3Backend{
+		client:  newS3Client(endpoint, bucket, awsSecret, awsAccess, awsRegion, client),
+		uploads: make(map[string]*s3Upload),
+	}
+}
+
+/**
+ * EnsureVault checks that the bucket exists. Vaults are
+ * prefixes in the bucket, so they don't need to be created.
+ */
+func (s *s3Backend) EnsureVault(vault string) error {
+	return s.client.HeadBucket()
+}
+
+/**
+ * UploadArchive stores an archive as an object, along with its metadata.
+ * Its hashes are calculated first unless they are known.
+ */
+func (s *s3Backend) UploadArchive(vault string, archive io.ReadSeeker, description string, hashes *ArchiveHashes) (string, error) {
+	id, err := newId()
+	if err != nil {
+		return "", err
+	}
+
+	if hashes == nil {
+		if hashes, err = hashArchive(archive); err != nil {
+			return "", err
+		}
+		if _, err := archive.Seek(0, 0); err != nil {
+			return "", err
+		}
+	}
+
+	if err := s.client.PutHashedObject(s.archiveKey(vault, id), archive, hashes.Size(), hashes.sha256); err != nil {
+		return "", err
+	}
+
+	return id, s.putJson(s.archiveKey(vault, id)+".json", glacier.Archive{
+		ArchiveId:          id,
+		ArchiveDescription: description,
+		CreationDate:       time.Now().UTC(),
+		Size:               hashes.Size(),
+		SHA256TreeHash:     hashes.TreeHash(),
+	})
+}
+
+func (s *s3Backend) DeleteArchive(vault, archiveId string) error {
+	if err := s.client.DeleteObject(s.archiveKey(vault, archiveId)); err != nil {
+		return err
+	}
+	return s.client.DeleteObject(s.archiveKey(vault, archiveId) + ".json")
+}
+
+func (s *s3Backend) InitiateMultipart(vault string, partSize int64, description string) (string, error) {
+	id, err := newId()
+	if err != nil {
+		return "", err
+	}
+
+	s3UploadId, err := s.client.InitiateMultipartUpload(s.archiveKey(vault, id))
+	if err != nil {
+		return "", err
+	}
+
+	upload := &s3Upload{
+		Multipart: glacier.Multipart{
+			ArchiveDescription: description,
+			CreationDate:       time.Now().UTC(),
+			MultipartUploadId:  id,
+			PartSizeInBytes:    partSize,
+		},
+		S3UploadId: s3UploadId,
+	}
+	if err := s.putJson(s.multipartKey(vault, id)+"upload.json", upload); err != nil {
+		s.client.AbortMultipartUpload(s.archiveKey(vault, id), s3UploadId)
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.uploads[id] = upload
+	s.mu.Unlock()
+	return id, nil
+}
+
+func (s *s3Backend) UploadMultipart(vault, uploadId string, start int64, body io.ReadSeeker) error {
+	upload, err := s.findUpload(vault, uploadId)
+	if err != nil {
+		return err
+	}
+
+	_, treeHash, err := copyWithTreeHash(ioutil.Discard, body)
+	if err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, 0); err != nil {
+		return err
+	}
+
+	partNumber := int(start/upload.PartSizeInBytes) + 1
+	if err := s.client.UploadPart(s.archiveKey(vault, uploadId), upload.S3UploadId, partNumber, body); err != nil {
+		return err
+	}
+
+	return s.client.PutObject(s.multipartKey(vault, uploadId)+strconv.FormatInt(start, 10), strings.NewReader(treeHash))
+}
+
+func (s *s3Backend) CompleteMultipart(vault, uploadId, treeHash string, size int64) (string, error) {
+	upload, err := s.findUpload(vault, uploadId)
+	if err != nil {
+		return "", err
+	}
+
+	treeHashes, err := s.ListMultipartParts(vault, uploadId)
+	if err != nil {
+		return "", err
+	}
+	parts, err := s.client.ListParts(s.archiveKey(vault, uploadId), upload.S3UploadId)
+	if err != nil {
+		return "", err
+	}
+	sort.Sort(byPartNumber(parts))
+
+	var hashes [][]byte
+	var total int64
+	for i, part := range parts {
+		start := int64(i) * upload.PartSizeInBytes
+		hash, ok := treeHashes[start]
+		if part.PartNumber != i+1 || !ok {
+			return "", fmt.Errorf("Part at offset %d of upload %s is missing", start, uploadId)
+		}
+		decoded, err := hex.DecodeString(hash)
+		if err != nil {
+			return "", err
+		}
+		hashes = append(hashes, decoded)
+		total += part.Size
+	}
+
+	if total != size {
+		return "", fmt.Errorf("Size of upload %s is %d bytes, expected %d", uploadId, total, size)
+	}
+	if actual := fmt.Sprintf("%x", combineTreeHashes(hashes)); actual != treeHash {
+		return "", fmt.Errorf("Tree hash of upload %s is `%s`, expected `%s`", uploadId, actual, treeHash)
+	}
+
+	if err := s.client.CompleteMultipartUpload(s.archiveKey(vault, uploadId), upload.S3UploadId, parts); err != nil {
+		return "", err
+	}
+
+	err = s.putJson(s.archiveKey(vault, uploadId)+".json", glacier.Archive{
+		ArchiveId:          uploadId,
+		ArchiveDescription: upload.ArchiveDescription,
+		CreationDate:       time.Now().UTC(),
+		Size:               size,
+		SHA256TreeHash:     treeHash,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return uploadId, s.forgetUpload(vault, uploadId)
+}
+
+func (s *s3Backend) AbortMultipart(vault, uploadId string) error {
+	upload, err := s.findUpload(vault, uploadId)
+	if err != nil {
+		return err
+	}
+
+	if err := s.client.AbortMultipartUpload(s.archiveKey(vault, uploadId), upload.S3UploadId); err != nil {
+		return err
+	}
+	return s.forgetUpload(vault, uploadId)
+}
+
+func (s *s3Backend) ListMultipartUploads(vault string) ([]glacier.Multipart, error) {
+	objects, err := s.client.ListObjects(vault + "/multipart/")
+	if err != nil {
+		return nil, err
+	}
+
+	var uploads []glacier.Multipart
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, "/upload.json") {
+			continue
+		}
+		upload := &s3Upload{}
+		if err := s.getJson(object.Key, upload); err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload.Multipart)
+	}
+	return uploads, nil
+}
+
+func (s *s3Backend) ListMultipartParts(vault, uploadId string) (map[int64]string, error) {
+	objects, err := s.client.ListObjects(s.multipartKey(vault, uploadId))
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make(map[int64]string)
+	for _, object := range objects {
+		start, err := strconv.ParseInt(strings.TrimPrefix(object.Key, s.multipartKey(vault, uploadId)), 10, 64)
+		if err != nil {
+			continue
+		}
+		body, err := s.client.GetObject(object.Key, 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		treeHash, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		parts[start] = string(treeHash)
+	}
+	return parts, nil
+}
+
+func (s *s3Backend) InitiateRetrievalJob(vault, archiveId, description string) (string, error) {
+	var archive glacier.Archive
+	if err := s.getJson(s.archiveKey(vault, archiveId)+".json", &archive); err != nil {
+		return "", err
+	}
+
+	return s.addJob(vault, glacier.Job{
+		Action:             "ArchiveRetrieval",
+		ArchiveId:          archiveId,
+		ArchiveSizeInBytes: archive.Size,
+		JobDescription:     description,
+		SHA256TreeHash:     archive.SHA256TreeHash,
+	})
+}
+
+func (s *s3Backend) InitiateInventoryJob(vault, description string) (string, error) {
+	return s.addJob(vault, glacier.Job{
+		Action:         "InventoryRetrieval",
+		JobDescription: description,
+	})
+}
+
+func (s *s3Backend) DescribeJob(vault, jobId string) (*glacier.Job, error) {
+	job := &glacier.Job{}
+	if err := s.getJson(s.jobKey(vault, jobId), job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (s *s3Backend) ListJobs(vault string) ([]glacier.Job, error) {
+	objects, err := s.client.ListObjects(vault + "/jobs/")
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []glacier.Job
+	for _, object := range objects {
+		var job glacier.Job
+		if err := s.getJson(object.Key, &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (s *s3Backend) GetRetrievalJob(vault, jobId string, start, end int64) (io.ReadCloser, string, error) {
+	job, err := s.DescribeJob(vault, jobId)
+	if err != nil {
+		return nil, "", err
+	}
+	if job.Action != "ArchiveRetrieval" {
+		return nil, "", fmt.Errorf("Job %s is not an archive retrieval", jobId)
+	}
+
+	body, err := s.client.GetObject(s.archiveKey(vault, job.ArchiveId), start, end)
+	return body, "", err
+}
+
+func (s *s3Backend) GetInventoryJob(vault, jobId string) (*glacier.Inventory, error) {
+	job, err := s.DescribeJob(vault, jobId)
+	if err != nil {
+		return nil, err
+	}
+	if job.Action != "InventoryRetrieval" {
+		return nil, fmt.Errorf("Job %s is not an inventory retrieval", jobId)
+	}
+
+	// the archives are listed now, not when the job was initiated
+	inventory := &glacier.Inventory{InventoryDate: time.Now().UTC()}
+	objects, err := s.client.ListObjects(vault + "/archives/")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".json") {
+			continue
+		}
+		var archive glacier.Archive
+		if err := s.getJson(object.Key, &archive); err != nil {
+			return nil, err
+		}
+		inventory.ArchiveList = append(inventory.ArchiveList, archive)
+	}
+	return inventory, nil
+}
+
+/**
+ * findUpload returns a multipart upload of this
+ * process, or one started by an earlier one
+ */
+func (s *s3Backend) findUpload(vault, uploadId string) (*s3Upload, error) {
+	s.mu.Lock()
+	upload, ok := s.uploads[uploadId]
+	s.mu.Unlock()
+	if ok {
+		return upload, nil
+	}
+
+	upload = &s3Upload{}
+	if err := s.getJson(s.multipartKey(vault, uploadId)+"upload.json", upload); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.uploads[uploadId] = upload
+	s.mu.Unlock()
+	return upload, nil
+}
+
+/**
+ * forgetUpload removes the objects describing a multipart upload
+ */
+func (s *s3Backend) forgetUpload(vault, uploadId string) error {
+	s.mu.Lock()
+	delete(s.uploads, uploadId)
+	s.mu.Unlock()
+
+	objects, err := s.client.ListObjects(s.multipartKey(vault, uploadId))
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := s.client.DeleteObject(object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * addJob records a job, which completes right away
+ */
+func (s *s3Backend) addJob(vault string, job glacier.Job) (string, error) {
+	id, err := newId()
+	if err != nil {
+		return "", err
+	}
+
+	job.JobId = id
+	job.CreationDate = time.Now().UTC()
+	job.CompletionDate = job.CreationDate
+	job.Completed = true
+	job.StatusCode = "Succeeded"
+	return id, s.putJson(s.jobKey(vault, id), job)
+}
+
+func (s *s3Backend) archiveKey(vault, archiveId string) string {
+	return vault + "/archives/" + archiveId
+}
+
+func (s *s3Backend) multipartKey(vault, uploadId string) string {
+	return vault + "/multipart/" + uploadId + "/"
+}
+
+func (s *s3Backend) jobKey(vault, jobId string) string {
+	return vault + "/jobs/" + jobId + ".json"
+}
+
+func (s *s3Backend) putJson(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.client.PutObject(key, bytes.NewReader(data))
+}
+
+func (s *s3Backend) getJson(key string, v interface{}) error {
+	body, err := s.client.GetObject(key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return json.NewDecoder(body).Decode(v)
+}
+
+type byPartNumber []s3Part
+
+func (p byPartNumber) Len() int           { return len(p) }
+func (p byPartNumber) Less(i, j int) bool { return p[i].PartNumber < p[j].PartNumber }
+func (p byPartNumber) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"github.com/rdwilliamson/aws"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/**
+ * fakeS3 is a minimal stand-in for an S3 compatible store
+ * serving a single bucket
+ */
+type fakeS3 struct {
+	bucket   string
+	pageSize int
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	mu       sync.Mutex
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:   bucket,
+		pageSize: 2,
+		objects:  make(map[string][]byte),
+		uploads:  make(map[string]map[int][]byte),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		f.error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	if r.Header.Get("x-amz-content-sha256") != fmt.Sprintf("%x", sha256.Sum256(body)) {
+		f.error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+		return
+	}
+
+	if r.URL.Path == "/"+f.bucket {
+		switch r.Method {
+		case "HEAD":
+			return
+		case "GET":
+			f.list(w, r.URL.Query())
+			return
+		}
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/"+f.bucket+"/") {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/"+f.bucket+"/")
+	query := r.URL.Query()
+
+	if _, ok := query["uploads"]; ok && r.Method == "POST" {
+		uploadId := fmt.Sprintf("upload-%d", len(f.uploads)+1)
+		f.uploads[uploadId] = make(map[int][]byte)
+		f.xml(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadId string
+		}{UploadId: uploadId})
+		return
+	}
+
+	if uploadId := query.Get("uploadId"); uploadId != "" {
+		parts, ok := f.uploads[uploadId]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+
+		switch r.Method {
+		case "PUT":
+			partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+			parts[partNumber] = body
+			w.Header().Set("ETag", fmt.Sprintf("\"%x\"", md5.Sum(body)))
+		case "GET":
+			result := struct {
+				XMLName xml.Name `xml:"ListPartsResult"`
+				Part    []s3Part
+			}{}
+			for partNumber, data := range parts {
+				result.Part = append(result.Part, s3Part{partNumber, fmt.Sprintf("\"%x\"", md5.Sum(data)), int64(len(data))})
+			}
+			f.xml(w, result)
+		case "POST":
+			var complete struct {
+				Part []s3Part
+			}
+			xml.Unmarshal(body, &complete)
+			var object []byte
+			for _, part := range complete.Part {
+				object = append(object, parts[part.PartNumber]...)
+			}
+			f.objects[key] = object
+			delete(f.uploads, uploadId)
+			f.xml(w, struct {
+				XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			}{})
+		case "DELETE":
+			delete(f.uploads, uploadId)
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		f.objects[key] = body
+	case "GET":
+		object, ok := f.objects[key]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil {
+			w.WriteHeader(http.StatusPartialContent)
+			object = object[start : end+1]
+		}
+		w.Write(object)
+	case "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query map[string][]string) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, query["prefix"][0]) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start := 0
+	if token, ok := query["continuation-token"]; ok {
+		start, _ = strconv.Atoi(token[0])
+	}
+
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		IsTruncated           bool
+		NextContinuationToken string
+		Contents              []s3Object
+	}{}
+	for i := start; i < len(keys) && i < start+f.pageSize; i++ {
+		result.Contents = append(result.Contents, s3Object{Key: keys[i], Size: int64(len(f.objects[keys[i]]))})
+	}
+	if start+f.pageSize < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(start + f.pageSize)
+	}
+	f.xml(w, result)
+}
+
+func (f *fakeS3) xml(w http.ResponseWriter, v interface{}) {
+	data, _ := xml.Marshal(v)
+	w.Write(data)
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	f.xml(w, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: "fake S3 error"})
+}
+
+func newTestS3Backend(bucket string) (*s3Backend, *fakeS3, *httptest.Server) {
+	fake := newFakeS3("backups")
+	server := httptest.NewServer(fake)
+	return NewS3Backend(server.URL, bucket, "secret", "access", aws.USEast1, nil), fake, server
+}
+
+func TestS3BackendArchives(t *testing.T) {
+	backend, fake, server := newTestS3Backend("backups")
+	defer server.Close()
+
+	if err := backend.EnsureVault("test"); err != nil {
+		t.Fatalf("Bucket should exist, but got error: %s", err)
+	}
+
+	data := []byte("Hello, world!")
+	archiveId, err := backend.UploadArchive("test", bytes.NewReader(data), "hello", nil)
+	if err != nil {
+		t.Fatalf("Archive should have been uploaded, but got error: %s", err)
+	}
+	if !bytes.Equal(fake.objects["test/archives/"+archiveId], data) {
+		t.Errorf("Expected archive to be stored as test/archives/%s", archiveId)
+	}
+
+	jobId, err := backend.InitiateRetrievalJob("test", archiveId, "restore")
+	if err != nil {
+		t.Fatalf("Retrieval job should have been initiated, but got error: %s", err)
+	}
+	job, err := backend.DescribeJob("test", jobId)
+	if err != nil || !job.Completed || job.ArchiveSizeInBytes != int64(len(data)) {
+		t.Errorf("Expected a completed retrieval job of %d bytes", len(data))
+	}
+
+	body, _, err := backend.GetRetrievalJob("test", jobId, 7, 11)
+	if err != nil {
+		t.Fatalf("Unexpected error while getting job output: %s", err)
+	}
+	output, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(output) != "world" {
+		t.Errorf("Expected `world`, got `%s`", output)
+	}
+
+	// enough archives to need more than one page of objects
+	hashes, _ := hashArchive(bytes.NewReader(data))
+	for i := 0; i < 3; i++ {
+		if _, err := backend.UploadArchive("test", bytes.NewReader(data), "hello", hashes); err != nil {
+			t.Errorf("Archive with known hashes should have been uploaded, but got error: %s", err)
+		}
+	}
+	jobId, _ = backend.InitiateInventoryJob("test", "inventory")
+	inventory, err := backend.GetInventoryJob("test", jobId)
+	if err != nil {
+		t.Fatalf("Unexpected error while getting inventory: %s", err)
+	}
+	if len(inventory.ArchiveList) != 4 {
+		t.Errorf("Expected 4 archives in inventory, got %d", len(inventory.ArchiveList))
+	}
+
+	if jobs, err := backend.ListJobs("test"); err != nil || len(jobs) != 2 {
+		t.Errorf("Expected 2 jobs")
+	}
+
+	if err := backend.DeleteArchive("test", archiveId); err != nil {
+		t.Errorf("Archive should have been deleted, but got error: %s", err)
+	}
+	if _, err := backend.InitiateRetrievalJob("test", archiveId, "restore"); err == nil || !strings.HasPrefix(err.Error(), "NoSuchKey") {
+		t.Errorf("Expected NoSuchKey error when retrieving deleted archive, got %v", err)
+	}
+}
+
+func TestS3BackendMissingBucket(t *testing.T) {
+	backend, _, server := newTestS3Backend("other")
+	defer server.Close()
+
+	if err := backend.EnsureVault("test"); err == nil {
+		t.Errorf("Expected error when the bucket doesn't exist")
+	}
+}
+
+func TestEscapePathSegment(t *testing.T) {
+	tests := map[string]string{
+		"archives":        "archives",
+		"vault_1.a-b~c":   "vault_1.a-b~c",
+		"with space+plus": "with%20space%2Bplus",
+		"café":            "caf%C3%A9",
+		"a/b":             "a%2Fb",
+	}
+
+	for segment, expected := range tests {
+		if actual := escapePathSegment(segment); actual != expected {
+			t.Errorf("Expected `%s` to be escaped to `%s`, got `%s`", segment, expected, actual)
+		}
+	}
+}
+
+func TestS3BackendMultipart(t *testing.T) {
+	backend, fake, server := newTestS3Backend("backups")
+	defer server.Close()
+
+	partSize := int64(1024 * 1024)
+	data := make([]byte, 2*partSize+12345)
+	rand.Read(data)
+
+	uploadId, err := backend.InitiateMultipart("test", partSize, "multi")
+	if err != nil {
+		t.Fatalf("Multipart upload should have been initiated, but got error: %s", err)
+	}
+	if err := backend.UploadMultipart("test", uploadId, partSize, bytes.NewReader(data[partSize:2*partSize])); err != nil {
+		t.Fatalf("Part should have been uploaded, but got error: %s", err)
+	}
+
+	// a new process resumes the upload
+	backend = NewS3Backend(server.URL, "backups", "secret", "access", aws.USEast1, nil)
+	uploads, err := backend.ListMultipartUploads("test")
+	if err != nil || len(uploads) != 1 || uploads[0].MultipartUploadId != uploadId || uploads[0].ArchiveDescription != "multi" {
+		t.Fatalf("Expected multipart upload %s to be listed", uploadId)
+	}
+
+	parts, err := backend.ListMultipartParts("test", uploadId)
+	_, treeHash, _ := copyWithTreeHash(ioutil.Discard, bytes.NewReader(data[partSize:2*partSize]))
+	if err != nil || len(parts) != 1 || parts[partSize] != treeHash {
+		t.Errorf("Expected the uploaded part to be listed with its tree hash")
+	}
+
+	backend.UploadMultipart("test", uploadId, 0, bytes.NewReader(data[:partSize]))
+	backend.UploadMultipart("test", uploadId, 2*partSize, bytes.NewReader(data[2*partSize:]))
+
+	_, treeHash, _ = copyWithTreeHash(ioutil.Discard, bytes.NewReader(data))
+	if _, err := backend.CompleteMultipart("test", uploadId, strings.Repeat("0", 64), int64(len(data))); err == nil {
+		t.Errorf("Expected error when completing upload with the wrong tree hash")
+	}
+
+	archiveId, err := backend.CompleteMultipart("test", uploadId, treeHash, int64(len(data)))
+	if err != nil {
+		t.Fatalf("Multipart upload should have been completed, but got error: %s", err)
+	}
+	if !bytes.Equal(fake.objects["test/archives/"+archiveId], data) {
+		t.Errorf("Completed archive is not the same as the one that was uploaded")
+	}
+
+	if uploads, _ := backend.ListMultipartUploads("test"); len(uploads) != 0 {
+		t.Errorf("Expected no multipart uploads after completing the upload")
+	}
+}
+
+func TestBackupAndRestoreWithS3Backend(t *testing.T) {
+	backend, _, server := newTestS3Backend("backups")
+	defer server.Close()
+
+	root, err := ioutil.TempDir("", "gobackup-restore")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	data := make([]byte, 3*1024*1024+123)
+	rand.Read(data)
+	large := filepath.Join(root, "large.bin")
+	ioutil.WriteFile(large, data, 0644)
+
+	archive, _ := NewArchive(":memory:")
+	uploader, err := NewUploader(backend, "test", 1024*1024, 2, archive)
+	if err != nil {
+		t.Fatalf("Unable to create uploader: %s", err)
+	}
+
+	upload, err := uploader.UploadFile(NewFile(large))
+	if err != nil {
+		t.Fatalf("Unable to upload %s: %s", large, err)
+	}
+
+	file := &ArchivedFile{filename: large, hash: upload.Hash(), amazonId: upload.AmazonId()}
+	restorer := NewRestorer(backend, archive, "test", root, filepath.Join(root, "restore"))
+	if err := restorer.Restore([]*ArchivedFile{file}); err != nil {
+		t.Fatalf("Unable to restore files: %s", err)
+	}
+
+	restored, err := ioutil.ReadFile(filepath.Join(root, "restore", "large.bin"))
+	if err != nil || !bytes.Equal(restored, data) {
+		t.Errorf("Restored file does not match the original")
+	}
+}
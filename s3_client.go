@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"github.com/rdwilliamson/aws"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * s3Client performs signed requests on the objects
+ * in a bucket of an S3 compatible store
+ */
+type s3Client struct {
+	endpoint  string
+	bucket    string
+	signature *aws.Signature
+	client    *http.Client
+}
+
+/**
+ * s3Object is an object listed in a bucket
+ */
+type s3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+/**
+ * s3Part is a part of a multipart upload
+ */
+type s3Part struct {
+	PartNumber int
+	ETag       string
+	Size       int64 `xml:",omitempty"`
+}
+
+/**
+ * s3Error is the error document returned by S3
+ */
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+/**
+ * newS3Client creates a client for a bucket
+ * @param endpoint string Scheme and host of the store, i.e. https://s3.amazonaws.com
+ * @param client *http.Client Client to perform requests with, or nil to use
+ *                            http.DefaultClient
+ */
+func newS3Client(endpoint, bucket, awsSecret, awsAccess string, awsRegion *aws.Region, client *http.Client) *s3Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	signature := aws.NewSignature(awsSecret, awsAccess, awsRegion, "s3")
+	signature.NewKeys = func() (string, string) {
+		return awsAccess, awsSecret
+	}
+
+	return &s3Client{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		bucket:    bucket,
+		signature: signature,
+		client:    client,
+	}
+}
+
+/**
+ * escapePathSegment escapes a segment of a request path the way
+ * SigV4 expects it, all bytes except unreserved characters are
+ * percent encoded.
+ */
+func escapePathSegment(segment string) string {
+	var escaped bytes.Buffer
+	for _, c := range []byte(segment) {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+/**
+ * do performs a signed request on an object, or on the bucket if key
+ * is empty. Responses with a status other than 2xx are turned into
+ * an error, in which case the response body is closed already.
+ */
+func (c *s3Client) do(method, key string, query url.Values, header http.Header, body io.ReadSeeker) (*http.Response, error) {
+	hasher := sha256.New()
+	var length int64
+	if body != nil {
+		var err error
+		if length, err = io.Copy(hasher, body); err != nil {
+			return nil, err
+		}
+		if _, err = body.Seek(0, 0); err != nil {
+			return nil, err
+		}
+	}
+	return c.doHashed(method, key, query, header, body, length, hasher.Sum(nil))
+}
+
+/**
+ * doHashed performs a signed request like do,
+ * with the length and SHA256 hash of the body known
+ */
+func (c *s3Client) doHashed(method, key string, query url.Values, header http.Header, body io.ReadSeeker, length int64, hash []byte) (*http.Response, error) {
+	u := c.endpoint + "/" + escapePathSegment(c.bucket)
+	if key != "" {
+		var segments []string
+		for _, segment := range strings.Split(key, "/") {
+			segments = append(segments, escapePathSegment(segment))
+		}
+		u += "/" + strings.Join(segments, "/")
+	}
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = body
+	}
+	request, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = length
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	request.Header.Set("x-amz-content-sha256", fmt.Sprintf("%x", hash))
+	if err := c.signature.Sign(request, aws.HashedPayload(hash)); err != nil {
+		return nil, err
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		defer response.Body.Close()
+		return nil, parseS3Error(response)
+	}
+	return response, nil
+}
+
+/**
+ * parseS3Error reads the error document from a response
+ */
+func parseS3Error(response *http.Response) error {
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	s3Err := &s3Error{}
+	if err := xml.Unmarshal(data, s3Err); err != nil || s3Err.Code == "" {
+		return fmt.Errorf("Unexpected response %s", response.Status)
+	}
+	return s3Err
+}
+
+/**
+ * discard reads and closes the body of a response
+ */
+func discard(response *http.Response) {
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+}
+
+/**
+ * HeadBucket checks if the bucket exists and is accessible
+ */
+func (c *s3Client) HeadBucket() error {
+	response, err := c.do("HEAD", "", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	discard(response)
+	return nil
+}
+
+func (c *s3Client) PutObject(key string, body io.ReadSeeker) error {
+	response, err := c.do("PUT", key, nil, nil, body)
+	if err != nil {
+		return err
+	}
+	discard(response)
+	return nil
+}
+
+/**
+ * PutHashedObject stores an object like PutObject,
+ * with the size and SHA256 hash of the body known
+ */
+func (c *s3Client) PutHashedObject(key string, body io.ReadSeeker, size int64, hash []byte) error {
+	response, err := c.doHashed("PUT", key, nil, nil, body, size, hash)
+	if err != nil {
+		return err
+	}
+	discard(response)
+	return nil
+}
+
+/**
+ * GetObject returns the bytes start up to and including end of an
+ * object, or the whole object if end is negative
+ */
+func (c *s3Client) GetObject(key string, start, end int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if end >= 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	}
+
+	response, err := c.do("GET", key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (c *s3Client) DeleteObject(key string) error {
+	response, err := c.do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	discard(response)
+	return nil
+}
+
+/**
+ * ListObjects returns all objects whose key starts with prefix
+ */
+func (c *s3Client) ListObjects(prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		var result struct {
+			IsTruncated           bool
+			NextContinuationToken string
+			Contents              []s3Object
+		}
+		if err := c.doXml("GET", "", query, nil, &result); err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+/**
+ * InitiateMultipartUpload starts a multipart upload of an object
+ * @return string The upload id
+ */
+func (c *s3Client) InitiateMultipartUpload(key string) (string, error) {
+	var result struct {
+		UploadId string
+	}
+	if err := c.doXml("POST", key, url.Values{"uploads": {""}}, nil, &result); err != nil {
+		return "", err
+	}
+	return result.UploadId, nil
+}
+
+/**
+ * UploadPart uploads a part of a multipart upload
+ * @param partNumber int Number of the part, starting at 1
+ */
+func (c *s3Client) UploadPart(key, uploadId string, partNumber int, body io.ReadSeeker) error {
+	query := url.Values{"uploadId": {uploadId}, "partNumber": {strconv.Itoa(partNumber)}}
+	response, err := c.do("PUT", key, query, nil, body)
+	if err != nil {
+		return err
+	}
+	discard(response)
+	return nil
+}
+
+/**
+ * ListParts returns all parts uploaded for a multipart upload
+ */
+func (c *s3Client) ListParts(key, uploadId string) ([]s3Part, error) {
+	var parts []s3Part
+	marker := ""
+	for {
+		query := url.Values{"uploadId": {uploadId}}
+		if marker != "" {
+			query.Set("part-number-marker", marker)
+		}
+
+		var result struct {
+			IsTruncated          bool
+			NextPartNumberMarker string
+			Part                 []s3Part
+		}
+		if err := c.doXml("GET", key, query, nil, &result); err != nil {
+			return nil, err
+		}
+
+		parts = append(parts, result.Part...)
+		if !result.IsTruncated {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+/**
+ * CompleteMultipartUpload assembles the given parts to the object
+ */
+func (c *s3Client) CompleteMultipartUpload(key, uploadId string, parts []s3Part) error {
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Part    []s3Part
+	}
+	for _, part := range parts {
+		complete.Part = append(complete.Part, s3Part{PartNumber: part.PartNumber, ETag: part.ETag})
+	}
+	data, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	// S3 may report a failure after it already sent 200 OK
+	var result struct {
+		XMLName xml.Name
+		s3Error
+	}
+	if err := c.doXml("POST", key, url.Values{"uploadId": {uploadId}}, bytes.NewReader(data), &result); err != nil {
+		return err
+	}
+	if result.XMLName.Local == "Error" {
+		return &result.s3Error
+	}
+	return nil
+}
+
+func (c *s3Client) AbortMultipartUpload(key, uploadId string) error {
+	response, err := c.do("DELETE", key, url.Values{"uploadId": {uploadId}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	discard(response)
+	return nil
+}
+
+/**
+ * doXml performs a request and decodes the XML response into v
+ */
+func (c *s3Client) doXml(method, key string, query url.Values, body io.ReadSeeker, v interface{}) error {
+	response, err := c.do(method, key, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer discard(response)
+	return xml.NewDecoder(response.Body).Decode(v)
+}
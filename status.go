@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+/**
+ * BackupStatus is the state of a backup as recorded in its archive
+ */
+type BackupStatus struct {
+	Name string
+	// LastRun is the most recent run, nil if the backup never ran
+	LastRun *Run
+	Files   int
+	// Archives and Bytes count what is stored in the vault
+	Archives int
+	Bytes    int64
+	// LastSnapshot is when the archive was last uploaded
+	// to the index vault, zero if it never was
+	LastSnapshot time.Time
+	// MultipartUploads and RestoreJobs count the unfinished ones
+	MultipartUploads int
+	RestoreJobs      int
+}
+
+/**
+ * Healthy checks if the last run of the backup finished
+ * @return bool
+ */
+func (s *BackupStatus) Healthy() bool {
+	return s.LastRun != nil && !s.LastRun.Finished().IsZero()
+}
+
+/**
+ * backupStatus reads the state of a backup from its archive
+ * without writing to it
+ * @param name string Name of the backup
+ * @return (*BackupStatus, error)
+ */
+func backupStatus(name string, backup *BackupConfig) (*BackupStatus, error) {
+	status := &BackupStatus{Name: name}
+
+	archive, err := NewReadOnlyArchive(backup.Db)
+	if os.IsNotExist(err) {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	runs, err := archive.ListRuns()
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) > 0 {
+		status.LastRun = runs[len(runs)-1]
+	}
+
+	files, err := archive.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+	status.Files = len(files)
+
+	uploads, err := archive.ListUploads()
+	if err != nil {
+		return nil, err
+	}
+	archives := make(map[string]bool)
+	for _, upload := range uploads {
+		if upload.AmazonId() == chunkedArchiveId {
+			continue
+		}
+		archives[upload.AmazonId()] = true
+		status.Bytes += upload.Size()
+	}
+	status.Archives = len(archives)
+
+	_, status.LastSnapshot, err = archive.FindLatestSnapshot()
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	multipartUploads, err := archive.ListMultipartUploads()
+	if err != nil {
+		return nil, err
+	}
+	status.MultipartUploads = len(multipartUploads)
+
+	jobs, err := archive.ListRestoreJobs()
+	if err != nil {
+		return nil, err
+	}
+	status.RestoreJobs = len(jobs)
+
+	return status, nil
+}
+
+/**
+ * runStatus shows the state of all configured backups, or the ones
+ * named on the command line, and exits with exitProblems if the
+ * last run of any of them didn't finish
+ * @param args []string Command line arguments following `status`
+ */
+func runStatus(config *Config, args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	flags.Parse(args)
+
+	names, err := config.SelectBackups(flags.Args())
+	if err != nil {
+		exitf(exitUsage, "%s", err)
+	}
+
+	healthy := true
+	for _, name := range names {
+		status, err := backupStatus(name, config.Backup[name])
+		if err != nil {
+			log.Fatalf("Unable to read status of backup `%s`: %s", name, err)
+		}
+		healthy = healthy && status.Healthy()
+		printStatus(status)
+	}
+
+	if !healthy {
+		os.Exit(exitProblems)
+	}
+}
+
+/**
+ * printStatus prints the state of a backup
+ */
+func printStatus(status *BackupStatus) {
+	lastRun := "never"
+	if status.LastRun != nil {
+		finished := "unfinished"
+		if !status.LastRun.Finished().IsZero() {
+			finished = "finished " + status.LastRun.Finished().Format(time.RFC3339)
+		}
+		lastRun = fmt.Sprintf("%d, started %s, %s", status.LastRun.Id(), status.LastRun.Started().Format(time.RFC3339), finished)
+	}
+	lastSnapshot := "never"
+	if !status.LastSnapshot.IsZero() {
+		lastSnapshot = status.LastSnapshot.Format(time.RFC3339)
+	}
+
+	fmt.Printf("%s\n", status.Name)
+	fmt.Printf("  %-20s %s\n", "last run:", lastRun)
+	fmt.Printf("  %-20s %d\n", "files:", status.Files)
+	fmt.Printf("  %-20s %d (%d bytes)\n", "archives:", status.Archives, status.Bytes)
+	fmt.Printf("  %-20s %s\n", "last snapshot:", lastSnapshot)
+	fmt.Printf("  %-20s %d\n", "unfinished uploads:", status.MultipartUploads)
+	fmt.Printf("  %-20s %d\n", "pending restores:", status.RestoreJobs)
+}
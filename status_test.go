@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestBackupStatus(t *testing.T) {
+	config, backup, _, server, root := newFakeGlacierBackup(t)
+	defer os.RemoveAll(root)
+	defer server.Close()
+
+	status, err := backupStatus("test", backup)
+	if err != nil {
+		t.Fatalf("Unable to read status: %s", err)
+	}
+	if status.LastRun != nil || status.Healthy() {
+		t.Errorf("Expected a backup that never ran not to be healthy")
+	}
+	if _, err := os.Stat(backup.Db); !os.IsNotExist(err) {
+		t.Errorf("Expected reading the status not to create the archive")
+	}
+
+	if err := runBackup(config, backup, false); err != nil {
+		t.Fatalf("Backup failed: %s", err)
+	}
+	status, err = backupStatus("test", backup)
+	if err != nil {
+		t.Fatalf("Unable to read status: %s", err)
+	}
+	if !status.Healthy() || status.Files != 4 || status.Archives != 4 || status.Bytes != 79 || status.LastSnapshot.IsZero() {
+		t.Errorf("Expected a healthy backup of 4 files in 4 archives of 79 bytes with a snapshot, got %+v", status)
+	}
+
+	// a run that is interrupted is left unfinished
+	archive, err := NewArchive(backup.Db)
+	if err != nil {
+		t.Fatalf("Unable to open archive: %s", err)
+	}
+	if _, err := archive.StartRun(); err != nil {
+		t.Fatalf("Unable to start run: %s", err)
+	}
+	status, err = backupStatus("test", backup)
+	if err != nil {
+		t.Fatalf("Unable to read status: %s", err)
+	}
+	if status.Healthy() {
+		t.Errorf("Expected a backup with an unfinished run not to be healthy")
+	}
+}
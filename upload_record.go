@@ -0,0 +1,101 @@
+package main
+
+import (
+	"time"
+)
+
+/**
+ * UploadRecord is an archive in Glacier holding
+ * the content with a given hash
+ */
+type UploadRecord struct {
+	hash     string
+	amazonId string
+	treeHash string
+	size     int64
+	uploaded time.Time
+	// encryption metadata, empty for archives that are not encrypted
+	keyId             string
+	nonceScheme       string
+	encryptionVersion int
+	// codec the archive is compressed with, empty if it isn't
+	codec string
+}
+
+func (u *UploadRecord) Hash() string {
+	return u.hash
+}
+
+func (u *UploadRecord) AmazonId() string {
+	return u.amazonId
+}
+
+/**
+ * TreeHash returns the hex encoded SHA256 tree hash of the archive.
+ * Empty for archives uploaded before tree hashes were recorded.
+ * @return string
+ */
+func (u *UploadRecord) TreeHash() string {
+	return u.treeHash
+}
+
+/**
+ * Size returns the size of the archive in bytes.
+ * Zero for archives uploaded before sizes were recorded.
+ * @return int64
+ */
+func (u *UploadRecord) Size() int64 {
+	return u.size
+}
+
+/**
+ * Uploaded returns when the archive was uploaded.
+ * Zero for archives uploaded before upload times were recorded.
+ * @return time.Time
+ */
+func (u *UploadRecord) Uploaded() time.Time {
+	return u.uploaded
+}
+
+/**
+ * KeyId returns the id of the key the archive is encrypted with.
+ * Empty for archives that are not encrypted.
+ * @return string
+ */
+func (u *UploadRecord) KeyId() string {
+	return u.keyId
+}
+
+/**
+ * NonceScheme returns how the nonces of the encrypted archive are built
+ * @return string
+ */
+func (u *UploadRecord) NonceScheme() string {
+	return u.nonceScheme
+}
+
+/**
+ * EncryptionVersion returns the version of the format of the
+ * encrypted archive. Zero for archives that are not encrypted.
+ * @return int
+ */
+func (u *UploadRecord) EncryptionVersion() int {
+	return u.encryptionVersion
+}
+
+/**
+ * Encrypted checks if the archive is encrypted
+ * @return bool
+ */
+func (u *UploadRecord) Encrypted() bool {
+	return u.encryptionVersion > 0
+}
+
+/**
+ * Codec returns the codec the archive is compressed with.
+ * Empty for archives that are not compressed.
+ * @return string
+ */
+func (u *UploadRecord) Codec() string {
+	return u.codec
+}
@@ -1,75 +1,253 @@
 package main
 
 import (
+	"bufio"
+	"crypto/sha256"
 	"errors"
 	"fmt"
-	"github.com/rdwilliamson/aws"
 	"github.com/rdwilliamson/aws/glacier"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
+// multipartGracePeriod is how long a multipart upload the archive doesn't
+// know about is left alone, so uploads still in progress aren't aborted
+const multipartGracePeriod = 24 * time.Hour
+
 /**
- * Uploader is responsible for uploading files to AWS Glacier
+ * Uploader is responsible for uploading files to a backend
  */
 type Uploader struct {
-	conn       *glacier.Connection
-	vault      string
-	indexVault string
+	backend     Backend
+	archive     *archive
+	vault       string
+	indexVault  string
+	partSize    int64
+	partThreads int
+	// encrypter encrypts archives before they are uploaded, nil if they aren't
+	encrypter *Encrypter
+	// compression decides which files are compressed, nil if none are
+	compression *CompressionPolicy
 }
 
 /**
  * NewUploader creates a new uploader instance
  * and makes sure all needed vaults exist. If they don't exist
  * they will be created
+ * @param backend Backend The backend to store the vaults in
+ * @param partSize int64 Size in bytes of the parts of a multipart upload.
+ *                       Files larger than this are uploaded in parts.
+ * @param partThreads int Number of parts of a file to upload in parallel
+ * @param archive *archive Archive to keep track of multipart uploads in
  */
-func NewUploader(awsSecret, awsAccess string, awsRegion *aws.Region, vault string) (*Uploader, error) {
+func NewUploader(backend Backend, vault string, partSize int64, partThreads int, archive *archive) (*Uploader, error) {
 	if strings.HasSuffix(vault, "_index") {
 		return nil, errors.New("Vault names can not end in `_index`")
 	}
 
-	conn := glacier.NewConnection(awsSecret, awsAccess, awsRegion)
 	indexVault := vault + "_index"
 
-	vaults, _, err := conn.ListVaults("", 0)
+	for _, v := range []string{vault, indexVault} {
+		if err := backend.EnsureVault(v); err != nil {
+			return nil, fmt.Errorf("Vault `%s` does not exist and could not be created: %s", v, err)
+		}
+	}
+
+	return &Uploader{
+		backend:     backend,
+		archive:     archive,
+		vault:       vault,
+		indexVault:  indexVault,
+		partSize:    partSize,
+		partThreads: partThreads,
+	}, nil
+}
+
+/**
+ * newBackupUploader creates the uploader for a backup, with the
+ * encryption and compression configured for it
+ */
+func newBackupUploader(config *Config, backup *BackupConfig, backend Backend, archive *archive) (*Uploader, error) {
+	uploader, err := NewUploader(backend, backup.Vault, backup.PartSize*1024*1024, config.Threads.Parts, archive)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating uploader: %s", err)
+	}
+
+	if uploader.encrypter, err = newBackupEncrypter(backup, archive); err != nil {
+		return nil, fmt.Errorf("Unable to set up encryption: %s", err)
+	}
+
+	if uploader.compression, err = newBackupCompressionPolicy(backup); err != nil {
+		return nil, fmt.Errorf("Unable to set up compression: %s", err)
+	}
+
+	return uploader, nil
+}
+
+/**
+ * UploadFile tries to upload a file to the backend.
+ * Files larger than the part size are uploaded in parts.
+ * Will bail after 3 failed attempts.
+ */
+func (u *Uploader) UploadFile(file *File) (*UploadRecord, error) {
+	hash, err := file.Hash()
 	if err != nil {
 		return nil, err
 	}
 
-	mainVaultFound, indexVaultFound := false, false
-	for _, i := range vaults {
-		if vault == i.VaultName {
-			mainVaultFound = true
-		}
-		if indexVault == i.VaultName {
-			indexVaultFound = true
+	codec := u.compression.CodecFor(file.Filename())
+	if u.encrypter == nil && codec == "" {
+		hashes, err := file.ArchiveHashes()
+		if err != nil {
+			return nil, err
 		}
+		return u.upload(u.vault, file.Filename(), hash, archiveDescription(hash, file.Filename()), hashes)
 	}
 
-	if !mainVaultFound {
-		if err := conn.CreateVault(vault); err != nil {
-			return nil, fmt.Errorf("Vault `%s` does not exist and could not be created", vault)
-		}
+	description, err := u.describe(hash, file.Filename(), codec)
+	if err != nil {
+		return nil, err
+	}
+	return u.uploadEncoded(u.vault, file.Filename(), hash, description, codec)
+}
+
+/**
+ * UploadSnapshot uploads a snapshot of the archive to the index vault
+ */
+func (u *Uploader) UploadSnapshot(file *File) (string, error) {
+	hash, err := file.Hash()
+	if err != nil {
+		return "", err
+	}
+
+	description := snapshotDescriptionPrefix + time.Now().UTC().Format(time.RFC3339)
+	var upload *UploadRecord
+	if u.encrypter != nil {
+		upload, err = u.uploadEncoded(u.indexVault, file.Filename(), hash, description, "")
+	} else {
+		upload, err = u.upload(u.indexVault, file.Filename(), hash, description, nil)
+	}
+	if err != nil {
+		return "", err
+	}
+	return upload.AmazonId(), nil
+}
+
+/**
+ * DeleteSnapshot deletes a snapshot of the archive from the index vault
+ */
+func (u *Uploader) DeleteSnapshot(amazonId string) error {
+	return u.backend.DeleteArchive(u.indexVault, amazonId)
+}
+
+/**
+ * uploadEncoded compresses a file with codec and encrypts it, if
+ * configured, to a temporary file and uploads that. The hash is of
+ * the original content, so content is still deduplicated. Since the
+ * temporary file is gone by then, a failed multipart upload of an
+ * encoded file is started over by the next run.
+ * @param codec string Codec to compress with, empty to not compress
+ */
+func (u *Uploader) uploadEncoded(vault, filename, hash, description, codec string) (*UploadRecord, error) {
+	tmp, err := ioutil.TempFile("", "gobackup-upload")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	out := bufio.NewWriterSize(tmp, 1024*1024)
+	err = u.encode(out, filename, codec)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("Unable to encode %s: %s", filename, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	upload, err := u.upload(vault, tmp.Name(), hash, description, nil)
+	if err != nil {
+		return nil, err
+	}
+	u.setEncoding(upload, codec)
+	return upload, nil
+}
+
+/**
+ * encode writes the content of a file to dst, compressed
+ * with codec and encrypted if the uploader encrypts
+ * @param codec string Codec to compress with, empty to not compress
+ */
+func (u *Uploader) encode(dst io.Writer, filename, codec string) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
 	}
+	defer in.Close()
 
-	if !indexVaultFound {
-		if err := conn.CreateVault(indexVault); err != nil {
-			return nil, fmt.Errorf("Vault `%s` does not exist and could not be created", indexVault)
+	return u.encodeFrom(dst, in, codec)
+}
+
+/**
+ * encodeFrom writes the content read from src to dst, compressed
+ * with codec and encrypted if the uploader encrypts
+ */
+func (u *Uploader) encodeFrom(dst io.Writer, src io.Reader, codec string) error {
+	if codec != "" {
+		compressed, err := compressReader(codec, src)
+		if err != nil {
+			return err
 		}
+		defer compressed.Close()
+		src = compressed
 	}
 
-	return &Uploader{
-		conn:       conn,
-		vault:      vault,
-		indexVault: indexVault,
-	}, nil
+	if u.encrypter != nil {
+		return u.encrypter.Encrypt(dst, src)
+	}
+	_, err := io.Copy(dst, src)
+	return err
 }
 
 /**
- * UploadFile tries to upload a file to AWS glacier.
- * Will bail after 3 failed attempts.
+ * setEncoding records the codec and encryption of
+ * content written by encode in its upload
  */
-func (u *Uploader) UploadFile(path string) (amazonId string, err error) {
+func (u *Uploader) setEncoding(upload *UploadRecord, codec string) {
+	upload.codec = codec
+	if u.encrypter != nil {
+		upload.keyId = u.encrypter.KeyId()
+		upload.nonceScheme = nonceScheme
+		upload.encryptionVersion = encryptionVersion
+	}
+}
+
+/**
+ * describe returns the description of the content of a file
+ * encoded with codec, which is encrypted if the uploader encrypts
+ */
+func (u *Uploader) describe(hash, filename, codec string) (string, error) {
+	if u.encrypter != nil {
+		return u.encrypter.EncryptDescription(hash, filename, codec)
+	}
+	return describeArchive(hash, filename, codec), nil
+}
+
+/**
+ * upload uploads the file at path with the given content hash to
+ * the given vault, in parts if it's larger than the part size
+ * @param hashes *ArchiveHashes The hashes of the file if they are
+ *                              known already, otherwise nil
+ */
+func (u *Uploader) upload(vault, path, hash, description string, hashes *ArchiveHashes) (upload *UploadRecord, err error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return
@@ -81,16 +259,265 @@ func (u *Uploader) UploadFile(path string) (amazonId string, err error) {
 		}
 	}()
 
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	upload = &UploadRecord{
+		hash: hash,
+		size: info.Size(),
+	}
+
+	// the file changed since it was hashed
+	if hashes != nil && hashes.Size() != info.Size() {
+		hashes = nil
+	}
+	if hashes == nil {
+		if hashes, err = hashArchive(f); err != nil {
+			return nil, err
+		}
+	}
+
+	if info.Size() > u.partSize {
+		upload.amazonId, upload.treeHash, err = u.uploadMultipart(vault, f, hash, description, hashes)
+		if err != nil {
+			return nil, err
+		}
+		upload.uploaded = time.Now()
+		return upload, nil
+	}
+
+	upload.treeHash = hashes.TreeHash()
+
 	for retries := 1; retries <= 3; retries++ {
 		f.Seek(0, 0)
-		if amazonId, err = u.conn.UploadArchive(u.vault, f, path); err != nil {
-			if retries == 3 {
-				err = fmt.Errorf("Upload failed after 3 retries: %s", err)
-				return
+		if upload.amazonId, err = u.backend.UploadArchive(vault, f, description, hashes); err == nil {
+			upload.uploaded = time.Now()
+			return upload, nil
+		}
+	}
+	return nil, fmt.Errorf("Upload failed after 3 retries: %s", err)
+}
+
+/**
+ * uploadMultipart uploads a file in parts of partSize bytes,
+ * uploading up to partThreads parts in parallel. Every part is
+ * tried 3 times. Progress is kept in the archive, so when a part
+ * still fails the next run resumes the upload where it was left.
+ * The tree hashes of the parts are derived from hashes.
+ */
+func (u *Uploader) uploadMultipart(vault string, f *os.File, hash, description string, hashes *ArchiveHashes) (string, string, error) {
+	size := hashes.Size()
+	upload, err := u.archive.FindMultipartUpload(vault, hash, size, u.partSize)
+	if err == nil {
+		log.Printf("Resuming upload of %s", f.Name())
+	} else {
+		uploadId, err := u.backend.InitiateMultipart(vault, u.partSize, description)
+		if err != nil {
+			return "", "", err
+		}
+		upload = &MultipartUpload{
+			uploadId: uploadId,
+			vault:    vault,
+			filename: f.Name(),
+			hash:     hash,
+			partSize: u.partSize,
+			size:     size,
+		}
+		if err := u.archive.AddMultipartUpload(upload); err != nil {
+			u.backend.AbortMultipart(vault, uploadId)
+			return "", "", err
+		}
+	}
+
+	numParts := int((size + u.partSize - 1) / u.partSize)
+	parts := make(chan int, numParts)
+	for i := 0; i < numParts; i++ {
+		parts <- i
+	}
+	close(parts)
+
+	var failed error
+	var mu sync.Mutex
+	var partWg sync.WaitGroup
+	for i := 0; i < u.partThreads; i++ {
+		partWg.Add(1)
+		go func() {
+			defer partWg.Done()
+			for part := range parts {
+				mu.Lock()
+				stop := failed != nil
+				mu.Unlock()
+				if stop {
+					return
+				}
+
+				start := int64(part) * u.partSize
+				err := u.uploadPart(vault, io.NewSectionReader(f, start, u.partSize), upload, start, hashes.PartTreeHash(start, u.partSize))
+				mu.Lock()
+				if err != nil && failed == nil {
+					failed = fmt.Errorf("Upload of part %d failed: %s", part, err)
+				}
+				mu.Unlock()
 			}
-		} else {
-			return
+		}()
+	}
+	partWg.Wait()
+
+	if failed != nil {
+		return "", "", failed
+	}
+
+	treeHash := hashes.TreeHash()
+	amazonId, err := u.backend.CompleteMultipart(vault, upload.UploadId(), treeHash, size)
+	if err != nil {
+		// the uploaded parts don't add up to the file, start over next time
+		u.abortMultipart(vault, upload.UploadId())
+		return "", "", err
+	}
+	u.archive.DeleteMultipartUpload(upload.UploadId())
+	return amazonId, treeHash, nil
+}
+
+/**
+ * uploadPart uploads a single part of a multipart upload,
+ * trying 3 times before giving up. Parts that were already
+ * uploaded with the same content are skipped.
+ * @param treeHash []byte The tree hash of the part
+ */
+func (u *Uploader) uploadPart(vault string, part *io.SectionReader, upload *MultipartUpload, start int64, treeHash []byte) error {
+	hexTreeHash := fmt.Sprintf("%x", treeHash)
+	if uploaded, ok := upload.PartTreeHash(start); ok && uploaded == hexTreeHash {
+		return nil
+	}
+
+	var err error
+	for retries := 1; retries <= 3; retries++ {
+		part.Seek(0, 0)
+		if err = u.backend.UploadMultipart(vault, upload.UploadId(), start, part); err == nil {
+			if err := u.archive.AddMultipartPart(upload.UploadId(), start, hexTreeHash); err != nil {
+				log.Printf("Could not record part of %s in archive: %s", upload.Filename(), err)
+			}
+			return nil
 		}
 	}
-	return
+	return fmt.Errorf("failed after 3 retries: %s", err)
+}
+
+/**
+ * ReconcileMultipartUploads brings the multipart uploads recorded in
+ * the archive in line with the ones the backend knows about, for both
+ * the vault and the index vault, so interrupted uploads can be resumed.
+ * Uploads the backend no longer knows about are forgotten and uploads
+ * of files that have since changed or disappeared are aborted. Uploads
+ * unknown to the archive may belong to another backup sharing the
+ * vault or to an overlapping run, so they are only aborted if this
+ * tool started them longer than multipartGracePeriod ago.
+ */
+func (u *Uploader) ReconcileMultipartUploads() error {
+	local, err := u.archive.ListMultipartUploads()
+	if err != nil {
+		return err
+	}
+
+	for _, vault := range []string{u.vault, u.indexVault} {
+		if err := u.reconcileMultipartUploads(vault, local); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * reconcileMultipartUploads reconciles the multipart uploads of a single vault
+ * @param local []*MultipartUpload The uploads recorded in the archive for all vaults
+ */
+func (u *Uploader) reconcileMultipartUploads(vault string, local []*MultipartUpload) error {
+	uploads, err := u.backend.ListMultipartUploads(vault)
+	if err != nil {
+		return err
+	}
+
+	remote := make(map[string]glacier.Multipart)
+	for _, upload := range uploads {
+		remote[upload.MultipartUploadId] = upload
+	}
+
+	for _, upload := range local {
+		if upload.Vault() != vault {
+			continue
+		}
+		if _, ok := remote[upload.UploadId()]; !ok {
+			u.archive.DeleteMultipartUpload(upload.UploadId())
+			continue
+		}
+		delete(remote, upload.UploadId())
+
+		// uploads are resumed by hash, so an upload of content
+		// the file no longer has would never be resumed
+		if hash, err := NewFile(upload.Filename()).Hash(); err != nil || hash != upload.Hash() {
+			log.Printf("Aborting upload of %s, the file has changed", upload.Filename())
+			u.abortMultipart(vault, upload.UploadId())
+			continue
+		}
+
+		parts, err := u.backend.ListMultipartParts(vault, upload.UploadId())
+		if err != nil {
+			return err
+		}
+		if err := u.archive.SetMultipartParts(upload.UploadId(), parts); err != nil {
+			return err
+		}
+	}
+
+	for uploadId, upload := range remote {
+		if !isOwnDescription(upload.ArchiveDescription) || time.Since(upload.CreationDate) < multipartGracePeriod {
+			log.Printf("Leaving unknown upload %s of %s alone, it may be in progress elsewhere", uploadId, upload.ArchiveDescription)
+			continue
+		}
+		log.Printf("Aborting abandoned upload of %s", upload.ArchiveDescription)
+		if err := u.backend.AbortMultipart(vault, uploadId); err != nil {
+			log.Printf("Could not abort upload %s: %s", uploadId, err)
+		}
+	}
+
+	return nil
+}
+
+/**
+ * abortMultipart aborts a multipart upload in the backend
+ * and removes it from the archive
+ */
+func (u *Uploader) abortMultipart(vault, uploadId string) {
+	if err := u.backend.AbortMultipart(vault, uploadId); err != nil {
+		log.Printf("Could not abort upload %s: %s", uploadId, err)
+	}
+	u.archive.DeleteMultipartUpload(uploadId)
+}
+
+/**
+ * combineTreeHashes calculates the tree hash of a whole archive
+ * from the tree hashes of its parts. Since part sizes are a
+ * power of two MiB every part is a complete subtree of the
+ * archive's tree hash.
+ */
+func combineTreeHashes(hashes [][]byte) []byte {
+	for len(hashes) > 1 {
+		var next [][]byte
+		for i := 0; i+1 < len(hashes); i += 2 {
+			hasher := sha256.New()
+			hasher.Write(hashes[i])
+			hasher.Write(hashes[i+1])
+			next = append(next, hasher.Sum(nil))
+		}
+		if len(hashes)%2 == 1 {
+			next = append(next, hashes[len(hashes)-1])
+		}
+		hashes = next
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	return hashes[0]
 }
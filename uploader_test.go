@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"github.com/rdwilliamson/aws/glacier"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCombineTreeHashes(t *testing.T) {
+	partSize := 2 * 1024 * 1024
+	for _, size := range []int{1, partSize - 1, partSize, 3*partSize + 12345, 5 * partSize} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		whole := glacier.NewTreeHash()
+		copyToTreeHash(whole, bytes.NewReader(data))
+		whole.Close()
+
+		hashes, _ := hashArchive(bytes.NewReader(data))
+		var parts [][]byte
+		for start := 0; start < size; start += partSize {
+			end := start + partSize
+			if end > size {
+				end = size
+			}
+			th := glacier.NewTreeHash()
+			copyToTreeHash(th, bytes.NewReader(data[start:end]))
+			th.Close()
+			parts = append(parts, th.TreeHash())
+
+			if !bytes.Equal(hashes.PartTreeHash(int64(start), int64(partSize)), th.TreeHash()) {
+				t.Errorf("Tree hash of the part at %d derived from the archive hashes of %d bytes is wrong", start, size)
+			}
+		}
+
+		if !bytes.Equal(combineTreeHashes(parts), whole.TreeHash()) {
+			t.Errorf("Combined tree hash of %d parts does not match tree hash of the whole %d bytes", len(parts), size)
+		}
+	}
+}
+
+func TestReconcileLeavesForeignAndRecentUploadsAlone(t *testing.T) {
+	root, err := ioutil.TempDir("", "gobackup-backend")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	archive, _ := NewArchive(":memory:")
+	backend := NewDirectoryBackend(root)
+	uploader, err := NewUploader(backend, "test", 1024*1024, 1, archive)
+	if err != nil {
+		t.Fatalf("Unable to create uploader: %s", err)
+	}
+
+	hash := "32d10c7b8cf96570ca04ce37f2a19d84240d3a89"
+	initiate := func(description string, age time.Duration) string {
+		uploadId, err := backend.InitiateMultipart("test", 1024*1024, description)
+		if err != nil {
+			t.Fatalf("Unable to initiate upload: %s", err)
+		}
+		writeJson(filepath.Join(backend.multipartPath("test", uploadId), "upload.json"), glacier.Multipart{
+			ArchiveDescription: description,
+			CreationDate:       time.Now().Add(-age).UTC(),
+			MultipartUploadId:  uploadId,
+			PartSizeInBytes:    1024 * 1024,
+		})
+		return uploadId
+	}
+	abandoned := initiate(archiveDescription(hash, "/tmp/foo.txt"), 2*multipartGracePeriod)
+	recent := initiate(archiveDescription(hash, "/tmp/bar.txt"), time.Minute)
+	foreign := initiate("some other tool", 2*multipartGracePeriod)
+
+	if err := uploader.ReconcileMultipartUploads(); err != nil {
+		t.Fatalf("Unable to reconcile uploads: %s", err)
+	}
+
+	uploads, _ := backend.ListMultipartUploads("test")
+	remaining := make(map[string]bool)
+	for _, upload := range uploads {
+		remaining[upload.MultipartUploadId] = true
+	}
+	if remaining[abandoned] || !remaining[recent] || !remaining[foreign] || len(remaining) != 2 {
+		t.Errorf("Expected only the abandoned upload to be aborted, %v remain", remaining)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/rdwilliamson/aws/glacier"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+/**
+ * DriftReport lists the differences between the
+ * archive and the inventory of a vault
+ */
+type DriftReport struct {
+	Vault         string       `json:"vault"`
+	InventoryDate time.Time    `json:"inventory_date"`
+	Archives      int          `json:"archives"`
+	Missing       []DriftEntry `json:"missing"`
+	Unknown       []DriftEntry `json:"unknown"`
+	Mismatched    []DriftEntry `json:"mismatched"`
+}
+
+/**
+ * DriftEntry is a single archive that differs between the archive
+ * and the vault inventory. Expected values come from the archive,
+ * actual values from the inventory.
+ */
+type DriftEntry struct {
+	AmazonId         string `json:"amazon_id"`
+	Hash             string `json:"hash,omitempty"`
+	Description      string `json:"description,omitempty"`
+	ExpectedTreeHash string `json:"expected_tree_hash,omitempty"`
+	ActualTreeHash   string `json:"actual_tree_hash,omitempty"`
+	ExpectedSize     int64  `json:"expected_size,omitempty"`
+	ActualSize       int64  `json:"actual_size,omitempty"`
+}
+
+/**
+ * HasDrift checks if the report found any differences
+ * @return bool
+ */
+func (d *DriftReport) HasDrift() bool {
+	return len(d.Missing) > 0 || len(d.Unknown) > 0 || len(d.Mismatched) > 0
+}
+
+/**
+ * runVerifyRemote compares the archive of a single backup
+ * with the inventory of its vault, and exits with exitProblems
+ * if they differ and the differences weren't fixed
+ * @param args []string Command line arguments following `verify-remote`
+ */
+func runVerifyRemote(config *Config, args []string) {
+	flags := flag.NewFlagSet("verify-remote", flag.ExitOnError)
+	name := flags.String("backup", "", "Name of the backup to verify")
+	output := flags.String("json", "", "Write the report as JSON to this file, - for stdout")
+	fix := flags.Bool("fix", false, "Forget about missing and mismatched archives so the next backup uploads them again")
+	poll := flags.Duration("poll", 15*time.Minute, "Interval to check for a completed inventory job")
+	wait := flags.Bool("wait", true, "Wait for the inventory job to complete")
+	flags.Parse(args)
+
+	backup, err := config.FindBackup(*name)
+	if err != nil {
+		exitf(exitUsage, "%s", err)
+	}
+
+	archive, err := NewArchive(backup.Db)
+	if err != nil {
+		log.Fatalf("Error creating archive: %s", err)
+	}
+
+	backend, err := NewBackend(backup)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	inventory, err := fetchInventory(backend, backup.Vault, *poll, *wait)
+	if err == errInventoryPending {
+		exitf(exitPending, "%s", err)
+	}
+	if err != nil {
+		log.Fatalf("Unable to retrieve inventory: %s", err)
+	}
+
+	uploads, err := archive.ListUploads()
+	if err != nil {
+		log.Fatalf("Error listing uploads: %s", err)
+	}
+
+	report := compareInventory(uploads, inventory)
+	report.Vault = backup.Vault
+
+	if *output != "" {
+		if err := writeDriftReport(report, *output); err != nil {
+			log.Fatalf("Unable to write report: %s", err)
+		}
+	}
+
+	log.Printf("Compared %d archives with the inventory of %s", report.Archives, report.InventoryDate)
+	log.Printf("%d archives missing from the vault", len(report.Missing))
+	log.Printf("%d archives in the vault unknown to the catalog", len(report.Unknown))
+	log.Printf("%d archives with a different tree hash or size", len(report.Mismatched))
+
+	if *fix {
+		broken := append(report.Missing, report.Mismatched...)
+		for _, entry := range broken {
+			if err := archive.DeleteUpload(entry.AmazonId); err != nil {
+				log.Fatalf("Unable to remove archive %s from the catalog: %s", entry.AmazonId, err)
+			}
+		}
+		log.Printf("Removed %d broken archives from the catalog, the next backup uploads their content again", len(broken))
+		return
+	}
+
+	if report.HasDrift() {
+		os.Exit(exitProblems)
+	}
+}
+
+/**
+ * compareInventory compares the uploads in the archive with the archives
+ * in a vault inventory. Uploads made after the inventory was taken can't
+ * be in it yet, so they are not reported as missing. Content stored
+ * as chunks has no archive of its own, its chunks are compared instead.
+ */
+func compareInventory(uploads []*UploadRecord, inventory *glacier.Inventory) *DriftReport {
+	report := &DriftReport{
+		InventoryDate: inventory.InventoryDate,
+		Archives:      len(uploads),
+		Missing:       []DriftEntry{},
+		Unknown:       []DriftEntry{},
+		Mismatched:    []DriftEntry{},
+	}
+
+	remote := make(map[string]glacier.Archive)
+	for _, a := range inventory.ArchiveList {
+		remote[a.ArchiveId] = a
+	}
+
+	// a bundle archive has an upload for itself and each of its members
+	known := make(map[string]bool)
+	for _, upload := range uploads {
+		if upload.AmazonId() == chunkedArchiveId {
+			continue
+		}
+		a, ok := remote[upload.AmazonId()]
+		if !ok {
+			if upload.Uploaded().Before(inventory.InventoryDate) {
+				report.Missing = append(report.Missing, DriftEntry{
+					AmazonId:         upload.AmazonId(),
+					Hash:             upload.Hash(),
+					ExpectedTreeHash: upload.TreeHash(),
+					ExpectedSize:     upload.Size(),
+				})
+			}
+			continue
+		}
+		known[upload.AmazonId()] = true
+
+		// tree hash and size are unknown for uploads by older versions
+		if (upload.TreeHash() != "" && upload.TreeHash() != a.SHA256TreeHash) || (upload.Size() != 0 && upload.Size() != a.Size) {
+			report.Mismatched = append(report.Mismatched, DriftEntry{
+				AmazonId:         upload.AmazonId(),
+				Hash:             upload.Hash(),
+				Description:      a.ArchiveDescription,
+				ExpectedTreeHash: upload.TreeHash(),
+				ActualTreeHash:   a.SHA256TreeHash,
+				ExpectedSize:     upload.Size(),
+				ActualSize:       a.Size,
+			})
+		}
+	}
+
+	for _, a := range inventory.ArchiveList {
+		if !known[a.ArchiveId] {
+			report.Unknown = append(report.Unknown, DriftEntry{
+				AmazonId:       a.ArchiveId,
+				Description:    a.ArchiveDescription,
+				ActualTreeHash: a.SHA256TreeHash,
+				ActualSize:     a.Size,
+			})
+		}
+	}
+
+	return report
+}
+
+/**
+ * writeDriftReport writes a report as JSON to a file,
+ * or to stdout if the filename is -
+ */
+func writeDriftReport(report *DriftReport, filename string) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if filename == "-" {
+		_, err = fmt.Fprintf(os.Stdout, "%s\n", data)
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0644)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/rdwilliamson/aws/glacier"
+	"testing"
+	"time"
+)
+
+func TestCompareInventory(t *testing.T) {
+	inventoryDate := time.Now().Add(-12 * time.Hour)
+	before := inventoryDate.Add(-time.Hour)
+
+	uploads := []*UploadRecord{
+		&UploadRecord{hash: "h1", amazonId: "a1", treeHash: "t1", size: 10, uploaded: before},
+		&UploadRecord{hash: "h2", amazonId: "a2", treeHash: "t2", size: 20, uploaded: before},
+		&UploadRecord{hash: "h3", amazonId: "a3", treeHash: "t3", size: 30, uploaded: before},
+		&UploadRecord{hash: "h4", amazonId: "a4", treeHash: "t4", size: 40, uploaded: time.Now()},
+		&UploadRecord{hash: "h5", amazonId: "a5"},
+		&UploadRecord{hash: "h6", amazonId: "a6"},
+	}
+
+	inventory := &glacier.Inventory{
+		InventoryDate: inventoryDate,
+		ArchiveList: []glacier.Archive{
+			glacier.Archive{ArchiveId: "a1", SHA256TreeHash: "t1", Size: 10},
+			glacier.Archive{ArchiveId: "a3", SHA256TreeHash: "tx", Size: 30},
+			glacier.Archive{ArchiveId: "a5", SHA256TreeHash: "t5", Size: 50},
+			glacier.Archive{ArchiveId: "a7", SHA256TreeHash: "t7", Size: 70},
+		},
+	}
+
+	report := compareInventory(uploads, inventory)
+
+	if !report.HasDrift() {
+		t.Errorf("Expected report to have drift")
+	}
+
+	checkDriftEntries(t, "missing", report.Missing, []string{"a2", "a6"})
+	checkDriftEntries(t, "unknown", report.Unknown, []string{"a7"})
+	checkDriftEntries(t, "mismatched", report.Mismatched, []string{"a3"})
+}
+
+func TestCompareInventoryNoDrift(t *testing.T) {
+	uploads := []*UploadRecord{
+		&UploadRecord{hash: "h1", amazonId: "a1", treeHash: "t1", size: 10},
+	}
+
+	inventory := &glacier.Inventory{
+		InventoryDate: time.Now(),
+		ArchiveList: []glacier.Archive{
+			glacier.Archive{ArchiveId: "a1", SHA256TreeHash: "t1", Size: 10},
+		},
+	}
+
+	if report := compareInventory(uploads, inventory); report.HasDrift() {
+		t.Errorf("Expected report without drift, got %+v", report)
+	}
+}
+
+func checkDriftEntries(t *testing.T, kind string, entries []DriftEntry, expected []string) {
+	if len(entries) != len(expected) {
+		t.Errorf("Expected %d %s archives, got %d", len(expected), kind, len(entries))
+		return
+	}
+
+	for i, amazonId := range expected {
+		if entries[i].AmazonId != amazonId {
+			t.Errorf("Expected %s archive `%s`, got `%s`", kind, amazonId, entries[i].AmazonId)
+		}
+	}
+}